@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"crud-gokit-postgres/internal/endpoint"
+	"crud-gokit-postgres/internal/middleware"
 	"crud-gokit-postgres/internal/proto"
 	httptransport "crud-gokit-postgres/internal/transport/http"
 
@@ -19,12 +27,18 @@ import (
 )
 
 func main() {
+	jwks := flag.String("jwks", "", "JSON Web Key Set file or http(s) URL with the keys verifying Bearer access tokens; only Basic credentials are accepted when empty")
+	jwtIssuer := flag.String("jwt-issuer", "grpc-server", `required "iss" claim of access tokens`)
+	jwtAudience := flag.String("jwt-audience", "users-api", `required "aud" claim of access tokens`)
+	adminUsers := flag.String("admin-users", "", "comma-separated ids of users whose access tokens have the admin role")
+	supportUsers := flag.String("support-users", "", "comma-separated ids of users whose access tokens have the support role")
+	htpasswd := flag.String("htpasswd", "", "htpasswd file with bcrypt hashed Basic credentials, reloaded when it changes or on SIGHUP")
+	insecureDevUser := flag.Bool("insecure-dev-user", false, `accept the Basic credentials "IOT:1" with the admin role; for local development only`)
+	htpasswdPoll := flag.Duration("htpasswd-poll", 5*time.Second, "how often to check the htpasswd file for changes")
+	flag.Parse()
 
 	initTracer()
 
-	// Authentication details
-	authUser := "IOT"
-	authPassword := "1"
 	authRealm := "ProtectedArea"
 
 	// gRPC connection setup
@@ -38,8 +52,37 @@ func main() {
 	// Create gRPC client
 	userServiceClient := proto.NewUserServiceClient(conn)
 
+	var authenticators []middleware.Authenticator
+	switch {
+	case *htpasswd != "" && *insecureDevUser:
+		log.Fatalf("-htpasswd and -insecure-dev-user can not be combined")
+	case *htpasswd != "":
+		users, err := middleware.LoadHtpasswd(*htpasswd)
+		if err != nil {
+			log.Fatalf("Failed to load htpasswd file: %v", err)
+		}
+		log.Printf("Loaded %d users from %s", users.Len(), *htpasswd)
+		go watchHtpasswd(users, *htpasswd, *htpasswdPoll)
+		authenticators = append(authenticators, users)
+	case *insecureDevUser:
+		log.Printf("Accepting the insecure development credentials IOT:1")
+		authenticators = append(authenticators, middleware.BasicAuthenticator("IOT", "1"))
+	}
+	authenticators = append(authenticators, middleware.APIKeyAuthenticator(userServiceClient))
+	if *jwks != "" {
+		keys, err := middleware.LoadKeySet(context.Background(), *jwks)
+		if err != nil {
+			log.Fatalf("Failed to load JWKS: %v", err)
+		}
+		roles := make(map[int64][]middleware.Role)
+		grantRole(roles, middleware.RoleAdmin, *adminUsers)
+		grantRole(roles, middleware.RoleSupport, *supportUsers)
+		authenticators = append(authenticators, middleware.JWTAuthenticator(keys, *jwtIssuer, *jwtAudience, roles))
+		log.Printf("Accepting access tokens verified with %s", *jwks)
+	}
+
 	// Create endpoints with authentication middleware
-	endpoints := endpoint.MakeEndpoints(userServiceClient, authUser, authPassword, authRealm)
+	endpoints := endpoint.MakeEndpoints(userServiceClient, authRealm, authenticators...)
 
 	// Create HTTP handler
 	httpHandler := httptransport.NewHTTPHandler(endpoints)
@@ -54,6 +97,48 @@ func main() {
 	}
 }
 
+// watchHtpasswd reloads the htpasswd file on SIGHUP and when it changes.
+func watchHtpasswd(users *middleware.Htpasswd, path string, poll time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			changed, err := users.Changed()
+			if err != nil {
+				log.Printf("Failed to check htpasswd file: %v", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+		}
+		if err := users.Reload(); err != nil {
+			log.Printf("Failed to reload htpasswd file, keeping the previous users: %v", err)
+			continue
+		}
+		log.Printf("Reloaded %d users from %s", users.Len(), path)
+	}
+}
+
+// grantRole grants role to the users in ids, a comma-separated list.
+func grantRole(roles map[int64][]middleware.Role, role middleware.Role, ids string) {
+	for _, field := range strings.Split(ids, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || id <= 0 {
+			log.Fatalf("Invalid user id %q for role %s", field, role)
+		}
+		roles[id] = append(roles[id], role)
+	}
+}
+
 func initTracer() {
 	exporter, err := otlptracehttp.New(context.Background(),
 		otlptracehttp.WithInsecure(),
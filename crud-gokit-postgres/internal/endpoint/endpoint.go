@@ -2,13 +2,25 @@ package endpoint
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"crud-gokit-postgres/internal/middleware"
 	"crud-gokit-postgres/internal/model"
+	"crud-gokit-postgres/internal/patch"
 	"crud-gokit-postgres/internal/proto"
 
 	"github.com/go-kit/kit/endpoint"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func NewUserServiceClient(conn *grpc.ClientConn) proto.UserServiceClient {
@@ -16,25 +28,97 @@ func NewUserServiceClient(conn *grpc.ClientConn) proto.UserServiceClient {
 }
 
 type Endpoints struct {
-	CreateUserEndpoint endpoint.Endpoint
-	GetUserEndpoint    endpoint.Endpoint
-	UpdateUserEndpoint endpoint.Endpoint
-	DeleteUserEndpoint endpoint.Endpoint
+	CreateUserEndpoint  endpoint.Endpoint
+	GetUserEndpoint     endpoint.Endpoint
+	UpdateUserEndpoint  endpoint.Endpoint
+	PatchUserEndpoint   endpoint.Endpoint
+	DeleteUserEndpoint  endpoint.Endpoint
+	RestoreUserEndpoint endpoint.Endpoint
+	PurgeUserEndpoint   endpoint.Endpoint
+	ListUsersEndpoint   endpoint.Endpoint
+	HistoryEndpoint     endpoint.Endpoint
+	// VerifyEmailEndpoint, RequestPasswordResetEndpoint and
+	// ResetPasswordEndpoint take no credentials; the emailed token is one.
+	VerifyEmailEndpoint endpoint.Endpoint
+
+	RequestPasswordResetEndpoint endpoint.Endpoint
+	ResetPasswordEndpoint        endpoint.Endpoint
+
+	BatchCreateUsersEndpoint endpoint.Endpoint
+	BatchGetUsersEndpoint    endpoint.Endpoint
+	BatchDeleteUsersEndpoint endpoint.Endpoint
+	ImportUsersEndpoint      endpoint.Endpoint
+	ExportUsersEndpoint      endpoint.Endpoint
+
+	// LoginEndpoint and RefreshTokenEndpoint take no credentials.
+	LoginEndpoint        endpoint.Endpoint
+	RefreshTokenEndpoint endpoint.Endpoint
+
+	CreateAPIKeyEndpoint endpoint.Endpoint
+	ListAPIKeysEndpoint  endpoint.Endpoint
+	RevokeAPIKeyEndpoint endpoint.Endpoint
 }
 
-func MakeEndpoints(client proto.UserServiceClient, authUser, authPassword, authRealm string) Endpoints {
-	authMiddleware := middleware.AuthMiddleware(authUser, authPassword, authRealm)
+func MakeEndpoints(client proto.UserServiceClient, authRealm string, authenticators ...middleware.Authenticator) Endpoints {
+	authMiddleware := endpoint.Chain(
+		middleware.AuthMiddleware(authRealm, authenticators...),
+		middleware.AuditMetadataMiddleware(),
+	)
 	createUserEndpoint := makeCreateUserEndpoint(client)
 	getUserEndpoint := makeGetUserEndpoint(client)
 	updateUserEndpoint := makeUpdateUserEndpoint(client)
+	patchUserEndpoint := makePatchUserEndpoint(client)
 	deleteUserEndpoint := makeDeleteUserEndpoint(client)
+	restoreUserEndpoint := makeRestoreUserEndpoint(client)
+	purgeUserEndpoint := makePurgeUserEndpoint(client)
+	listUsersEndpoint := makeListUsersEndpoint(client)
+	historyEndpoint := makeHistoryEndpoint(client)
+	verifyEmailEndpoint := makeVerifyEmailEndpoint(client)
+	requestPasswordResetEndpoint := makeRequestPasswordResetEndpoint(client)
+	resetPasswordEndpoint := makeResetPasswordEndpoint(client)
+	loginEndpoint := makeLoginEndpoint(client)
+	refreshTokenEndpoint := makeRefreshTokenEndpoint(client)
+	batchCreateUsersEndpoint := makeBatchCreateUsersEndpoint(client)
+	batchGetUsersEndpoint := makeBatchGetUsersEndpoint(client)
+	batchDeleteUsersEndpoint := makeBatchDeleteUsersEndpoint(client)
+	importUsersEndpoint := makeImportUsersEndpoint(client)
+	exportUsersEndpoint := makeExportUsersEndpoint(client)
+	createAPIKeyEndpoint := makeCreateAPIKeyEndpoint(client)
+	listAPIKeysEndpoint := makeListAPIKeysEndpoint(client)
+	revokeAPIKeyEndpoint := makeRevokeAPIKeyEndpoint(client)
 
-	// Apply authentication middleware to each endpoint
+	// Apply authentication middleware to each endpoint, and check the
+	// caller's roles where a permission is needed
+	protect := func(perm middleware.Permission, e endpoint.Endpoint) endpoint.Endpoint {
+		return authMiddleware(middleware.Authorize(perm)(e))
+	}
 	return Endpoints{
-		CreateUserEndpoint: authMiddleware(createUserEndpoint),
-		GetUserEndpoint:    authMiddleware(getUserEndpoint),
-		UpdateUserEndpoint: authMiddleware(updateUserEndpoint),
-		DeleteUserEndpoint: authMiddleware(deleteUserEndpoint),
+		CreateUserEndpoint:  protect(middleware.PermCreateUsers, createUserEndpoint),
+		GetUserEndpoint:     protect(middleware.PermReadUsers, getUserEndpoint),
+		UpdateUserEndpoint:  protect(middleware.PermUpdateUsers, updateUserEndpoint),
+		PatchUserEndpoint:   protect(middleware.PermUpdateUsers, patchUserEndpoint),
+		DeleteUserEndpoint:  protect(middleware.PermDeleteUsers, deleteUserEndpoint),
+		RestoreUserEndpoint: protect(middleware.PermDeleteUsers, restoreUserEndpoint),
+		PurgeUserEndpoint:   protect(middleware.PermPurgeUsers, purgeUserEndpoint),
+		ListUsersEndpoint:   protect(middleware.PermReadUsers, listUsersEndpoint),
+		HistoryEndpoint:     protect(middleware.PermReadUsers, historyEndpoint),
+		VerifyEmailEndpoint: middleware.AuditMetadataMiddleware()(verifyEmailEndpoint),
+
+		RequestPasswordResetEndpoint: middleware.AuditMetadataMiddleware()(requestPasswordResetEndpoint),
+		ResetPasswordEndpoint:        middleware.AuditMetadataMiddleware()(resetPasswordEndpoint),
+
+		BatchCreateUsersEndpoint: protect(middleware.PermCreateUsers, batchCreateUsersEndpoint),
+		BatchGetUsersEndpoint:    protect(middleware.PermReadUsers, batchGetUsersEndpoint),
+		BatchDeleteUsersEndpoint: protect(middleware.PermDeleteUsers, batchDeleteUsersEndpoint),
+		ImportUsersEndpoint:      protect(middleware.PermImportUsers, importUsersEndpoint),
+		ExportUsersEndpoint:      protect(middleware.PermExportUsers, exportUsersEndpoint),
+
+		LoginEndpoint:        middleware.AuditMetadataMiddleware()(loginEndpoint),
+		RefreshTokenEndpoint: middleware.AuditMetadataMiddleware()(refreshTokenEndpoint),
+
+		CreateAPIKeyEndpoint: protect(middleware.PermManageAPIKeys, createAPIKeyEndpoint),
+		ListAPIKeysEndpoint:  protect(middleware.PermManageAPIKeys, listAPIKeysEndpoint),
+		RevokeAPIKeyEndpoint: protect(middleware.PermManageAPIKeys, revokeAPIKeyEndpoint),
 	}
 }
 
@@ -67,30 +151,123 @@ func makeGetUserEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
 		if err != nil {
 			return nil, err
 		}
-		user := model.User{
-			Id:       grpcResp.User.Id,
-			Name:     grpcResp.User.Name,
-			Email:    grpcResp.User.Email,
-			Password: grpcResp.User.Password,
-		}
-		return GetUserResponse{User: user}, nil
+		return GetUserResponse{User: toModelUser(grpcResp.User)}, nil
 	}
 }
 
 func makeUpdateUserEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(UpdateUserRequest)
+		current, err := client.GetUser(ctx, &proto.UserID{Id: req.Id})
+		if err != nil {
+			return nil, err
+		}
+		if err := middleware.AuthorizeChange(ctx, req.Id, req.changedFields(current.User), req.CurrentPassword != ""); err != nil {
+			return nil, err
+		}
 		grpcReq := &proto.User{
-			Id:       req.Id,
-			Name:     req.Name,
-			Email:    req.Email,
-			Password: req.Password,
+			Id:              req.Id,
+			Name:            req.Name,
+			Email:           req.Email,
+			Password:        req.Password,
+			Status:          req.Status,
+			Version:         req.Version,
+			CurrentPassword: req.CurrentPassword,
 		}
-		_, err := client.UpdateUser(ctx, grpcReq)
+		grpcResp, err := client.UpdateUser(ctx, grpcReq)
 		if err != nil {
 			return nil, err
 		}
-		return UpdateUserResponse{Success: true}, nil
+		return UpdateUserResponse{Success: true, Version: grpcResp.User.Version}, nil
+	}
+}
+
+// currentPasswordField is the member of a PATCH carrying the current password.
+const currentPasswordField = "current_password"
+
+// patchableFields are the user members a PATCH may change.
+var patchableFields = map[string]bool{
+	"name":     true,
+	"email":    true,
+	"password": true,
+	"status":   true,
+}
+
+// makePatchUserEndpoint applies a merge or JSON patch to the current user
+// and sends the changed fields to PatchUser. The update is conditional on
+// the version the patch was applied to, so concurrent changes are not lost.
+func makePatchUserEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(PatchUserRequest)
+		current, err := client.GetUser(ctx, &proto.UserID{Id: req.Id})
+		if err != nil {
+			return nil, err
+		}
+		if req.Version != 0 && req.Version != current.User.Version {
+			return nil, status.Error(codes.FailedPrecondition, "user was modified by someone else")
+		}
+
+		doc, err := patch.NewDocument(toModelUser(current.User))
+		if err != nil {
+			return nil, err
+		}
+		var patched patch.Document
+		if req.JSONPatch {
+			patched, err = patch.JSONPatch(doc, req.Patch)
+		} else {
+			patched, err = patch.MergePatch(doc, req.Patch)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The current password may be sent along as if it were a member,
+		// to prove it before changing the password.
+		currentPassword, ok := patched[currentPasswordField].(string)
+		if _, sent := patched[currentPasswordField]; sent && !ok {
+			return nil, patch.Error{Status: http.StatusUnprocessableEntity, Msg: fmt.Sprintf("%q must be a string", currentPasswordField)}
+		}
+		delete(patched, currentPasswordField)
+
+		grpcReq := &proto.PatchUserRequest{
+			User:       &proto.User{Id: req.Id, Version: current.User.Version, CurrentPassword: currentPassword},
+			UpdateMask: &fieldmaskpb.FieldMask{},
+		}
+		for _, field := range doc.Changed(patched) {
+			if !patchableFields[field] {
+				return nil, patch.Error{Status: http.StatusUnprocessableEntity, Msg: fmt.Sprintf("%q cannot be changed", field)}
+			}
+			raw, ok := patched[field]
+			if !ok {
+				return nil, patch.Error{Status: http.StatusUnprocessableEntity, Msg: fmt.Sprintf("%q cannot be removed", field)}
+			}
+			value, ok := raw.(string)
+			if !ok {
+				return nil, patch.Error{Status: http.StatusUnprocessableEntity, Msg: fmt.Sprintf("%q must be a string", field)}
+			}
+			switch field {
+			case "name":
+				grpcReq.User.Name = value
+			case "email":
+				grpcReq.User.Email = value
+			case "password":
+				grpcReq.User.Password = value
+			case "status":
+				grpcReq.User.Status = value
+			}
+			grpcReq.UpdateMask.Paths = append(grpcReq.UpdateMask.Paths, field)
+		}
+		if len(grpcReq.UpdateMask.Paths) == 0 {
+			return PatchUserResponse{User: toModelUser(current.User)}, nil
+		}
+		if err := middleware.AuthorizeChange(ctx, req.Id, grpcReq.UpdateMask.Paths, currentPassword != ""); err != nil {
+			return nil, err
+		}
+
+		grpcResp, err := client.PatchUser(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		return PatchUserResponse{User: toModelUser(grpcResp.User)}, nil
 	}
 }
 
@@ -108,6 +285,460 @@ func makeDeleteUserEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
 	}
 }
 
+func makeRestoreUserEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RestoreUserRequest)
+		grpcReq := &proto.UserID{
+			Id: req.Id,
+		}
+		grpcResp, err := client.RestoreUser(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		return RestoreUserResponse{User: toModelUser(grpcResp.User)}, nil
+	}
+}
+
+func makePurgeUserEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(PurgeUserRequest)
+		_, err := client.PurgeUser(ctx, &proto.UserID{Id: req.Id})
+		if err != nil {
+			return nil, err
+		}
+		return PurgeUserResponse{Success: true}, nil
+	}
+}
+
+func makeVerifyEmailEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(VerifyEmailRequest)
+		grpcResp, err := client.VerifyEmail(ctx, &proto.VerifyEmailRequest{Token: req.Token})
+		if err != nil {
+			return nil, err
+		}
+		return VerifyEmailResponse{User: toModelUser(grpcResp.User)}, nil
+	}
+}
+
+func makeRequestPasswordResetEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RequestPasswordResetRequest)
+		_, err := client.RequestPasswordReset(ctx, &proto.RequestPasswordResetRequest{Email: req.Email})
+		if err != nil {
+			return nil, err
+		}
+		return RequestPasswordResetResponse{}, nil
+	}
+}
+
+func makeResetPasswordEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ResetPasswordRequest)
+		grpcReq := &proto.ResetPasswordRequest{
+			Token:       req.Token,
+			NewPassword: req.NewPassword,
+		}
+		grpcResp, err := client.ResetPassword(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		return ResetPasswordResponse{User: toModelUser(grpcResp.User)}, nil
+	}
+}
+
+func makeLoginEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(LoginRequest)
+		grpcReq := &proto.AuthenticateRequest{
+			Email:    req.Email,
+			Password: req.Password,
+		}
+		grpcResp, err := client.Authenticate(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		return toTokenResponse(grpcResp), nil
+	}
+}
+
+func makeRefreshTokenEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RefreshTokenRequest)
+		grpcResp, err := client.RefreshToken(ctx, &proto.RefreshTokenRequest{RefreshToken: req.RefreshToken})
+		if err != nil {
+			return nil, err
+		}
+		return toTokenResponse(grpcResp), nil
+	}
+}
+
+func toTokenResponse(r *proto.AuthenticateResponse) TokenResponse {
+	return TokenResponse{
+		AccessToken:  r.AccessToken,
+		TokenType:    r.TokenType,
+		ExpiresIn:    r.ExpiresIn,
+		RefreshToken: r.RefreshToken,
+		User:         toModelUser(r.User),
+	}
+}
+
+func makeCreateAPIKeyEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateAPIKeyRequest)
+		grpcReq := &proto.CreateApiKeyRequest{Name: req.Name, Scopes: req.Scopes}
+		if req.ExpiresAt != nil {
+			grpcReq.ExpireTime = timestamppb.New(*req.ExpiresAt)
+		}
+		grpcResp, err := client.CreateApiKey(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		return CreateAPIKeyResponse{APIKey: toModelAPIKey(grpcResp.ApiKey), Key: grpcResp.Key}, nil
+	}
+}
+
+func makeListAPIKeysEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		grpcResp, err := client.ListApiKeys(ctx, &proto.ListApiKeysRequest{})
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]model.APIKey, len(grpcResp.ApiKeys))
+		for i, k := range grpcResp.ApiKeys {
+			keys[i] = toModelAPIKey(k)
+		}
+		return ListAPIKeysResponse{APIKeys: keys}, nil
+	}
+}
+
+func makeRevokeAPIKeyEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RevokeAPIKeyRequest)
+		grpcResp, err := client.RevokeApiKey(ctx, &proto.RevokeApiKeyRequest{Id: req.Id})
+		if err != nil {
+			return nil, err
+		}
+		return RevokeAPIKeyResponse{APIKey: toModelAPIKey(grpcResp)}, nil
+	}
+}
+
+func toModelAPIKey(k *proto.ApiKey) model.APIKey {
+	key := model.APIKey{
+		Id:        k.Id,
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		Scopes:    k.Scopes,
+		CreatedAt: k.CreateTime.AsTime(),
+	}
+	if k.ExpireTime != nil {
+		t := k.ExpireTime.AsTime()
+		key.ExpiresAt = &t
+	}
+	if k.LastUsedTime != nil {
+		t := k.LastUsedTime.AsTime()
+		key.LastUsedAt = &t
+	}
+	if k.RevokeTime != nil {
+		t := k.RevokeTime.AsTime()
+		key.RevokedAt = &t
+	}
+	return key
+}
+
+func makeListUsersEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ListUsersRequest)
+		grpcReq := &proto.ListUsersRequest{
+			PageSize:  req.PageSize,
+			PageToken: req.PageToken,
+			OrderBy:   req.OrderBy,
+			Filter: &proto.UserFilter{
+				EmailDomain: req.EmailDomain,
+				NamePrefix:  req.NamePrefix,
+				Status:      req.Status,
+			},
+		}
+		if req.CreatedAfter != nil {
+			grpcReq.Filter.CreatedAfter = timestamppb.New(*req.CreatedAfter)
+		}
+		if req.CreatedBefore != nil {
+			grpcReq.Filter.CreatedBefore = timestamppb.New(*req.CreatedBefore)
+		}
+		grpcResp, err := client.ListUsers(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		users := make([]model.User, 0, len(grpcResp.Users))
+		for _, u := range grpcResp.Users {
+			users = append(users, toModelUser(u))
+		}
+		return ListUsersResponse{Users: users, NextPageToken: grpcResp.NextPageToken}, nil
+	}
+}
+
+func makeBatchCreateUsersEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BatchCreateUsersRequest)
+		grpcReq := &proto.BatchCreateUsersRequest{Atomic: req.Atomic}
+		for _, u := range req.Users {
+			grpcReq.Users = append(grpcReq.Users, &proto.UserRequest{
+				Name:     u.Name,
+				Email:    u.Email,
+				Password: u.Password,
+			})
+		}
+		grpcResp, err := client.BatchCreateUsers(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		return BatchResponse{Results: toModelBatchResults(grpcResp)}, nil
+	}
+}
+
+func makeBatchGetUsersEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BatchGetUsersRequest)
+		grpcResp, err := client.BatchGetUsers(ctx, &proto.BatchGetUsersRequest{Ids: req.Ids, Atomic: req.Atomic})
+		if err != nil {
+			return nil, err
+		}
+		return BatchResponse{Results: toModelBatchResults(grpcResp)}, nil
+	}
+}
+
+func makeBatchDeleteUsersEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BatchDeleteUsersRequest)
+		grpcResp, err := client.BatchDeleteUsers(ctx, &proto.BatchDeleteUsersRequest{Ids: req.Ids, Atomic: req.Atomic})
+		if err != nil {
+			return nil, err
+		}
+		return BatchResponse{Results: toModelBatchResults(grpcResp)}, nil
+	}
+}
+
+// importChunkSize is the number of rows sent per ImportUsers message.
+const importChunkSize = 500
+
+// makeImportUsersEndpoint streams the rows of an import file to ImportUsers
+// as they are read, so the file is never held in memory. Rows that cannot be
+// parsed are reported along with those the server rejects.
+func makeImportUsersEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ImportUsersRequest)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := client.ImportUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		send := func(msg *proto.ImportUsersRequest) error {
+			err := stream.Send(msg)
+			if err == io.EOF {
+				// The server ended the call; its status tells why.
+				_, err = stream.CloseAndRecv()
+			}
+			return err
+		}
+
+		rowErrors := []model.ImportRowError{}
+		msg := &proto.ImportUsersRequest{DryRun: req.DryRun}
+		for {
+			row, err := req.Rows.Next()
+			if err == io.EOF {
+				break
+			}
+			var rowErr *model.ImportRowError
+			if errors.As(err, &rowErr) {
+				rowErrors = append(rowErrors, *rowErr)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			msg.Rows = append(msg.Rows, &proto.ImportUserRow{
+				Row:          row.Row,
+				Name:         row.Name,
+				Email:        row.Email,
+				Password:     row.Password,
+				PasswordHash: row.PasswordHash,
+				Status:       row.Status,
+			})
+			if len(msg.Rows) == importChunkSize {
+				if err := send(msg); err != nil {
+					return nil, err
+				}
+				msg = &proto.ImportUsersRequest{}
+			}
+		}
+		// Always send the last message, so an empty file still carries dry_run.
+		if err := send(msg); err != nil {
+			return nil, err
+		}
+		grpcResp, err := stream.CloseAndRecv()
+		if err != nil {
+			return nil, err
+		}
+
+		parseFailures := int64(len(rowErrors))
+		for _, e := range grpcResp.Errors {
+			rowErrors = append(rowErrors, model.ImportRowError{Row: e.Row, Field: e.Field, Message: e.Message})
+		}
+		sort.SliceStable(rowErrors, func(i, j int) bool { return rowErrors[i].Row < rowErrors[j].Row })
+		return ImportUsersResponse{
+			DryRun:   req.DryRun,
+			Rows:     grpcResp.Rows + parseFailures,
+			Imported: grpcResp.Imported,
+			Errors:   rowErrors,
+		}, nil
+	}
+}
+
+// makeExportUsersEndpoint starts an ExportUsers stream. The first message is
+// received here, so that errors such as an unavailable server are reported
+// with the usual status; the transport then writes users as they arrive.
+func makeExportUsersEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ExportUsersRequest)
+		stream, err := client.ExportUsers(ctx, &proto.ExportUsersRequest{})
+		if err != nil {
+			return nil, err
+		}
+		users := &userStream{stream: stream}
+		first, err := stream.Recv()
+		switch {
+		case err == io.EOF:
+			users.done = true
+		case err != nil:
+			return nil, err
+		default:
+			users.buf = first.Users
+		}
+		return ExportUsersResponse{Format: req.Format, Users: users}, nil
+	}
+}
+
+// userStream reads the users of an ExportUsers stream one at a time.
+type userStream struct {
+	stream proto.UserService_ExportUsersClient
+	buf    []*proto.User
+	done   bool
+}
+
+func (s *userStream) Next() (model.User, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return model.User{}, io.EOF
+		}
+		resp, err := s.stream.Recv()
+		if err == io.EOF {
+			s.done = true
+			continue
+		}
+		if err != nil {
+			return model.User{}, err
+		}
+		s.buf = resp.Users
+	}
+	user := toModelUser(s.buf[0])
+	s.buf = s.buf[1:]
+	return user, nil
+}
+
+func toModelBatchResults(resp *proto.BatchUsersResponse) []model.BatchResult {
+	results := make([]model.BatchResult, 0, len(resp.Results))
+	for _, r := range resp.Results {
+		var result model.BatchResult
+		if r.User != nil {
+			user := toModelUser(r.User)
+			result.User = &user
+		}
+		if e := r.Error; e != nil {
+			result.Error = &model.BatchError{
+				Code:    CodeName(codes.Code(e.Code)),
+				Message: e.Message,
+				Reason:  e.Reason,
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// CodeName turns codes.NotFound into "NOT_FOUND".
+func CodeName(c codes.Code) string {
+	var b strings.Builder
+	for i, r := range c.String() {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToUpper(b.String())
+}
+
+func makeHistoryEndpoint(client proto.UserServiceClient) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(HistoryRequest)
+		grpcReq := &proto.ListUserAuditEventsRequest{
+			UserId:    req.Id,
+			PageSize:  req.PageSize,
+			PageToken: req.PageToken,
+		}
+		grpcResp, err := client.ListUserAuditEvents(ctx, grpcReq)
+		if err != nil {
+			return nil, err
+		}
+		events := make([]model.AuditEvent, 0, len(grpcResp.Events))
+		for _, e := range grpcResp.Events {
+			events = append(events, toModelAuditEvent(e))
+		}
+		return HistoryResponse{Events: events, NextPageToken: grpcResp.NextPageToken}, nil
+	}
+}
+
+func toModelAuditEvent(e *proto.AuditEvent) model.AuditEvent {
+	changes := make(map[string]model.FieldChange, len(e.Changes))
+	for field, c := range e.Changes {
+		changes[field] = model.FieldChange{Before: c.Before, After: c.After}
+	}
+	return model.AuditEvent{
+		Id:        e.Id,
+		Actor:     e.Actor,
+		Operation: e.Operation,
+		Changes:   changes,
+		RequestId: e.RequestId,
+		CreatedAt: e.CreateTime.AsTime(),
+	}
+}
+
+func toModelUser(u *proto.User) model.User {
+	user := model.User{
+		Id:        u.Id,
+		Name:      u.Name,
+		Email:     u.Email,
+		Status:    u.Status,
+		Version:   u.Version,
+		CreatedAt: u.CreateTime.AsTime(),
+		UpdatedAt: u.UpdateTime.AsTime(),
+	}
+	if u.LastLoginTime != nil {
+		t := u.LastLoginTime.AsTime()
+		user.LastLoginAt = &t
+	}
+	if u.EmailVerifiedTime != nil {
+		t := u.EmailVerifiedTime.AsTime()
+		user.EmailVerifiedAt = &t
+	}
+	return user
+}
+
+// ETag returns the entity tag for a user version.
+func ETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
 // Request and Response structs
 type CreateUserRequest struct {
 	Name     string `json:"name"`
@@ -123,25 +754,307 @@ type GetUserRequest struct {
 	Id int64 `json:"id"`
 }
 
+// UserId implements middleware.UserRequest.
+func (r GetUserRequest) UserId() int64 {
+	return r.Id
+}
+
 type GetUserResponse struct {
 	User model.User `json:"user"`
 }
 
+// Headers implements the Headerer interface in go-kit/http.
+func (r GetUserResponse) Headers() http.Header {
+	return http.Header{"Etag": []string{ETag(r.User.Version)}}
+}
+
 type UpdateUserRequest struct {
 	Id       int64  `json:"id"`
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Status   string `json:"status"`
+	// CurrentPassword is needed for users changing their own password.
+	CurrentPassword string `json:"current_password"`
+	// Version comes from the If-Match header; zero updates unconditionally.
+	Version int64 `json:"-"`
+}
+
+// UserId implements middleware.UserRequest.
+func (r UpdateUserRequest) UserId() int64 {
+	return r.Id
+}
+
+// normalizeEmail normalizes email the way the gRPC server stores it:
+// without surrounding whitespace and with a lower-case domain. The local
+// part may be case-sensitive, so changing its case changes the email.
+func normalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	if at := strings.LastIndexByte(email, '@'); at >= 0 {
+		email = email[:at] + strings.ToLower(email[at:])
+	}
+	return email
+}
+
+// changedFields returns the members of user the update changes.
+func (r UpdateUserRequest) changedFields(user *proto.User) []string {
+	var fields []string
+	if r.Name != user.Name {
+		fields = append(fields, "name")
+	}
+	if normalizeEmail(r.Email) != user.Email {
+		fields = append(fields, "email")
+	}
+	if r.Password != "" {
+		fields = append(fields, "password")
+	}
+	if r.Status != "" && r.Status != user.Status {
+		fields = append(fields, "status")
+	}
+	return fields
 }
 
 type UpdateUserResponse struct {
-	Success bool `json:"success"`
+	Success bool  `json:"success"`
+	Version int64 `json:"-"`
+}
+
+// Headers implements the Headerer interface in go-kit/http.
+func (r UpdateUserResponse) Headers() http.Header {
+	return http.Header{"Etag": []string{ETag(r.Version)}}
+}
+
+type PatchUserRequest struct {
+	Id int64
+	// Version comes from the If-Match header; zero patches unconditionally.
+	Version int64
+	// Patch is a JSON Patch document if JSONPatch is set, and a JSON Merge
+	// Patch document otherwise.
+	Patch     []byte
+	JSONPatch bool
+}
+
+// UserId implements middleware.UserRequest.
+func (r PatchUserRequest) UserId() int64 {
+	return r.Id
+}
+
+type PatchUserResponse struct {
+	User model.User `json:"user"`
+}
+
+// Headers implements the Headerer interface in go-kit/http.
+func (r PatchUserResponse) Headers() http.Header {
+	return http.Header{"Etag": []string{ETag(r.User.Version)}}
 }
 
 type DeleteUserRequest struct {
 	Id int64 `json:"id"`
 }
 
+// UserId implements middleware.UserRequest.
+func (r DeleteUserRequest) UserId() int64 {
+	return r.Id
+}
+
 type DeleteUserResponse struct {
 	Success bool `json:"success"`
 }
+
+type RestoreUserRequest struct {
+	Id int64 `json:"id"`
+}
+
+// UserId implements middleware.UserRequest.
+func (r RestoreUserRequest) UserId() int64 {
+	return r.Id
+}
+
+type RestoreUserResponse struct {
+	User model.User `json:"user"`
+}
+
+type PurgeUserRequest struct {
+	Id int64 `json:"id"`
+}
+
+type PurgeUserResponse struct {
+	Success bool `json:"success"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type VerifyEmailResponse struct {
+	User model.User `json:"user"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenResponse follows the OAuth 2.0 access token response (RFC 6749,
+// section 5.1).
+type TokenResponse struct {
+	AccessToken  string     `json:"access_token"`
+	TokenType    string     `json:"token_type"`
+	ExpiresIn    int64      `json:"expires_in"`
+	RefreshToken string     `json:"refresh_token"`
+	User         model.User `json:"user"`
+}
+
+// Headers is an implementation of the Headerer interface in go-kit/http.
+// Responses carrying tokens must not be cached.
+func (TokenResponse) Headers() http.Header {
+	return http.Header{"Cache-Control": []string{"no-store"}}
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateAPIKeyResponse carries the only copy of the key.
+type CreateAPIKeyResponse struct {
+	APIKey model.APIKey `json:"api_key"`
+	Key    string       `json:"key"`
+}
+
+// StatusCode is an implementation of the StatusCoder interface in go-kit/http.
+func (CreateAPIKeyResponse) StatusCode() int {
+	return http.StatusCreated
+}
+
+// Headers implements the Headerer interface in go-kit/http.
+func (CreateAPIKeyResponse) Headers() http.Header {
+	return http.Header{"Cache-Control": []string{"no-store"}}
+}
+
+type ListAPIKeysRequest struct{}
+
+type ListAPIKeysResponse struct {
+	APIKeys []model.APIKey `json:"api_keys"`
+}
+
+type RevokeAPIKeyRequest struct {
+	Id int64 `json:"id"`
+}
+
+type RevokeAPIKeyResponse struct {
+	APIKey model.APIKey `json:"api_key"`
+}
+
+type RequestPasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// RequestPasswordResetResponse is empty: it must not reveal whether the
+// email belongs to a user.
+type RequestPasswordResetResponse struct{}
+
+// StatusCode is an implementation of the StatusCoder interface in go-kit/http.
+func (RequestPasswordResetResponse) StatusCode() int {
+	return http.StatusAccepted
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type ResetPasswordResponse struct {
+	User model.User `json:"user"`
+}
+
+type ListUsersRequest struct {
+	PageSize      int32      `json:"page_size"`
+	PageToken     string     `json:"page_token"`
+	OrderBy       string     `json:"order_by"`
+	EmailDomain   string     `json:"email_domain"`
+	NamePrefix    string     `json:"name_prefix"`
+	CreatedAfter  *time.Time `json:"created_after"`
+	CreatedBefore *time.Time `json:"created_before"`
+	Status        string     `json:"status"`
+}
+
+type ListUsersResponse struct {
+	Users         []model.User `json:"users"`
+	NextPageToken string       `json:"next_page_token,omitempty"`
+}
+
+type BatchCreateUsersRequest struct {
+	Users  []CreateUserRequest `json:"users"`
+	Atomic bool                `json:"atomic"`
+}
+
+type BatchGetUsersRequest struct {
+	Ids    []int64 `json:"ids"`
+	Atomic bool    `json:"atomic"`
+}
+
+type BatchDeleteUsersRequest struct {
+	Ids    []int64 `json:"ids"`
+	Atomic bool    `json:"atomic"`
+}
+
+type BatchResponse struct {
+	Results []model.BatchResult `json:"results"`
+}
+
+// RowSource yields the rows of an import file. Next returns io.EOF after
+// the last row, and a *model.ImportRowError for a row that cannot be parsed,
+// after which reading continues.
+type RowSource interface {
+	Next() (model.ImportRow, error)
+}
+
+type ImportUsersRequest struct {
+	Rows   RowSource
+	DryRun bool
+}
+
+type ImportUsersResponse struct {
+	DryRun   bool                   `json:"dry_run"`
+	Rows     int64                  `json:"rows"`
+	Imported int64                  `json:"imported"`
+	Errors   []model.ImportRowError `json:"errors"`
+}
+
+type ExportUsersRequest struct {
+	Format string // "ndjson" or "csv"
+}
+
+// UserSource yields exported users. Next returns io.EOF after the last one.
+type UserSource interface {
+	Next() (model.User, error)
+}
+
+// ExportUsersResponse is written by the transport as users arrive rather
+// than encoded as a whole.
+type ExportUsersResponse struct {
+	Format string
+	Users  UserSource
+}
+
+type HistoryRequest struct {
+	Id        int64  `json:"id"`
+	PageSize  int32  `json:"page_size"`
+	PageToken string `json:"page_token"`
+}
+
+// UserId implements middleware.UserRequest.
+func (r HistoryRequest) UserId() int64 {
+	return r.Id
+}
+
+type HistoryResponse struct {
+	Events        []model.AuditEvent `json:"events"`
+	NextPageToken string             `json:"next_page_token,omitempty"`
+}
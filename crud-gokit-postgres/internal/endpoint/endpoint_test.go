@@ -0,0 +1,33 @@
+package endpoint
+
+import (
+	"reflect"
+	"testing"
+
+	"crud-gokit-postgres/internal/proto"
+)
+
+func TestChangedFields(t *testing.T) {
+	user := &proto.User{Id: 1, Name: "Alice", Email: "Alice@example.com", Status: "active"}
+	tests := []struct {
+		name string
+		req  UpdateUserRequest
+		want []string
+	}{
+		{"nothing", UpdateUserRequest{Name: "Alice", Email: "Alice@example.com"}, nil},
+		{"same status", UpdateUserRequest{Name: "Alice", Email: "Alice@example.com", Status: "active"}, nil},
+		{"domain in another case", UpdateUserRequest{Name: "Alice", Email: " Alice@EXAMPLE.com "}, nil},
+		{"local part in another case", UpdateUserRequest{Name: "Alice", Email: "alice@example.com"}, []string{"email"}},
+		{"name", UpdateUserRequest{Name: "Alicia", Email: "Alice@example.com"}, []string{"name"}},
+		{"password", UpdateUserRequest{Name: "Alice", Email: "Alice@example.com", Password: "secret"}, []string{"password"}},
+		{"status", UpdateUserRequest{Name: "Alice", Email: "Alice@example.com", Status: "disabled"}, []string{"status"}},
+		{"everything", UpdateUserRequest{Name: "Bob", Email: "bob@example.com", Password: "secret", Status: "disabled"}, []string{"name", "email", "password", "status"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.changedFields(user); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+
+	"crud-gokit-postgres/internal/proto"
+)
+
+type contextKey int
+
+// ContextKeyAPIKey is populated in the context by the HTTP transport with
+// the X-API-Key request header.
+const ContextKeyAPIKey contextKey = iota
+
+// apiKeyScheme is the scheme of API keys, which may be sent in the X-API-Key
+// header or as "Authorization: ApiKey <key>".
+const apiKeyScheme = "ApiKey"
+
+type apiKeyAuthenticator struct {
+	client proto.UserServiceClient
+}
+
+// APIKeyAuthenticator returns an Authenticator accepting API keys, which it
+// checks with the gRPC server. Callers have the key's scopes and no roles.
+func APIKeyAuthenticator(client proto.UserServiceClient) Authenticator {
+	return apiKeyAuthenticator{client: client}
+}
+
+func (apiKeyAuthenticator) Scheme() string {
+	return apiKeyScheme
+}
+
+func (a apiKeyAuthenticator) Authenticate(ctx context.Context, credentials string) (*Principal, error) {
+	key, err := a.client.AuthenticateApiKey(ctx, &proto.AuthenticateApiKeyRequest{Key: credentials})
+	if err != nil {
+		return nil, err
+	}
+	scopes := make([]Permission, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = Permission(scope)
+	}
+	return &Principal{Actor: "apikey:" + key.Prefix, Scheme: apiKeyScheme, Scopes: scopes}, nil
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type htpasswdUser struct {
+	hash  []byte
+	roles []Role
+}
+
+// Htpasswd is a Basic Authenticator for the users in an htpasswd file. Each
+// line holds a user name and a bcrypt hash, as written by
+// "htpasswd -B", optionally followed by a colon and a comma-separated list
+// of roles:
+//
+//	billing:$2y$10$...:admin
+//	helpdesk:$2y$10$...:support
+//
+// Users without roles are authenticated but may do nothing; list "admin"
+// to grant everything. Empty lines and lines starting with "#" are ignored.
+type Htpasswd struct {
+	path string
+	// dummy is compared against for unknown users, so they take as long to
+	// reject as wrong passwords.
+	dummy []byte
+
+	mu      sync.RWMutex
+	users   map[string]htpasswdUser
+	modTime time.Time
+	size    int64
+}
+
+// LoadHtpasswd reads the htpasswd file at path.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	h := &Htpasswd{path: path, dummy: dummy}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the file again. If it can not be read or parsed, the users
+// loaded before are kept.
+func (h *Htpasswd) Reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(data)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Remember the broken version too, so Changed does not report it again.
+	h.modTime, h.size = info.ModTime(), info.Size()
+	if err != nil {
+		return fmt.Errorf("%s: %v", h.path, err)
+	}
+	h.users = users
+	return nil
+}
+
+// Changed reports whether the file was modified since it was last loaded.
+func (h *Htpasswd) Changed() (bool, error) {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return false, err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return !info.ModTime().Equal(h.modTime) || info.Size() != h.size, nil
+}
+
+// Len returns the number of users.
+func (h *Htpasswd) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users)
+}
+
+func parseHtpasswd(data []byte) (map[string]htpasswdUser, error) {
+	users := make(map[string]htpasswdUser)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: want user:hash[:roles]", n)
+		}
+		name, hash := fields[0], fields[1]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: only bcrypt hashes are supported", n, name)
+		}
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, name)
+		}
+		user := htpasswdUser{hash: []byte(hash)}
+		if len(fields) == 3 {
+			for _, r := range strings.Split(fields[2], ",") {
+				role := Role(strings.TrimSpace(r))
+				if _, ok := rolePermissions[role]; !ok || role == RoleSelf {
+					return nil, fmt.Errorf("line %d: user %q: unknown role %q", n, name, role)
+				}
+				user.roles = append(user.roles, role)
+			}
+		}
+		users[name] = user
+	}
+	return users, scanner.Err()
+}
+
+// Scheme implements Authenticator.
+func (h *Htpasswd) Scheme() string {
+	return "Basic"
+}
+
+// Authenticate implements Authenticator.
+func (h *Htpasswd) Authenticate(_ context.Context, credentials string) (*Principal, error) {
+	givenUser, givenPassword, ok := parseBasicAuth(credentials)
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	h.mu.RLock()
+	user, found := h.users[string(givenUser)]
+	h.mu.RUnlock()
+
+	hash := user.hash
+	if !found {
+		hash = h.dummy
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, givenPassword); err != nil || !found {
+		return nil, errInvalidCredentials
+	}
+	return &Principal{Actor: string(givenUser), Scheme: "Basic", Roles: user.roles}, nil
+}
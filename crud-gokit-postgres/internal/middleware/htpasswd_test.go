@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func writeHtpasswd(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func basic(user, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	hash := bcryptHash(t, "secret")
+	path := filepath.Join(t.TempDir(), "users.htpasswd")
+	writeHtpasswd(t, path, "# integrations\n\nbilling:"+hash+":admin\nhelpdesk:"+hash+":support\nops:"+hash+": admin , support\nguest:"+hash+"\n")
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", h.Len())
+	}
+
+	tests := []struct {
+		name        string
+		credentials string
+		wantRoles   []Role
+		wantErr     bool
+	}{
+		{"admin", basic("billing", "secret"), []Role{RoleAdmin}, false},
+		{"user with a role", basic("helpdesk", "secret"), []Role{RoleSupport}, false},
+		{"user without roles", basic("guest", "secret"), nil, false},
+		{"user with several roles", basic("ops", "secret"), []Role{RoleAdmin, RoleSupport}, false},
+		{"wrong password", basic("billing", "wrong"), nil, true},
+		{"unknown user", basic("nobody", "secret"), nil, true},
+		{"not base64", "billing:secret", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := h.Authenticate(context.Background(), tt.credentials)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.Scheme != "Basic" || !reflect.DeepEqual(p.Roles, tt.wantRoles) {
+				t.Errorf("Authenticate() = %+v, want roles %v", p, tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestLoadHtpasswdInvalid(t *testing.T) {
+	hash := bcryptHash(t, "secret")
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing hash", "billing\n"},
+		{"empty user", ":" + hash + "\n"},
+		{"too many fields", "billing:" + hash + ":support:extra\n"},
+		{"not bcrypt", "billing:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"},
+		{"duplicate user", "billing:" + hash + "\nbilling:" + hash + "\n"},
+		{"unknown role", "billing:" + hash + ":owner\n"},
+		{"self role", "billing:" + hash + ":self\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.htpasswd")
+			writeHtpasswd(t, path, tt.content)
+			if _, err := LoadHtpasswd(path); err == nil {
+				t.Error("LoadHtpasswd() accepted the file")
+			}
+		})
+	}
+	if _, err := LoadHtpasswd(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("LoadHtpasswd() of a missing file succeeded")
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	hash := bcryptHash(t, "secret")
+	path := filepath.Join(t.TempDir(), "users.htpasswd")
+	writeHtpasswd(t, path, "billing:"+hash+"\n")
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// touch sets a distinct modification time, since the file may be
+	// rewritten within the file system's timestamp granularity.
+	modTime := time.Now()
+	touch := func() {
+		t.Helper()
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changed := func() bool {
+		t.Helper()
+		c, err := h.Changed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	if changed() {
+		t.Error("Changed() right after loading = true")
+	}
+
+	writeHtpasswd(t, path, "billing:"+hash+"\nhelpdesk:"+hash+":support\n")
+	touch()
+	if !changed() {
+		t.Error("Changed() after a write = false")
+	}
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Len() != 2 || changed() {
+		t.Errorf("after Reload(): Len() = %d, Changed() = %v", h.Len(), changed())
+	}
+	if _, err := h.Authenticate(context.Background(), basic("helpdesk", "secret")); err != nil {
+		t.Errorf("added user: Authenticate() error = %v", err)
+	}
+
+	writeHtpasswd(t, path, "broken\n")
+	touch()
+	if err := h.Reload(); err == nil {
+		t.Error("Reload() of a broken file succeeded")
+	}
+	if h.Len() != 2 {
+		t.Errorf("Len() after a failed Reload() = %d, want the previous 2", h.Len())
+	}
+	if changed() {
+		t.Error("Changed() reports the broken file again")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Changed(); err == nil {
+		t.Error("Changed() of a removed file succeeded")
+	}
+	if err := h.Reload(); err == nil {
+		t.Error("Reload() of a removed file succeeded")
+	}
+	if _, err := h.Authenticate(context.Background(), basic("billing", "secret")); err != nil {
+		t.Errorf("Authenticate() after the file was removed error = %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// jwksRefreshInterval is how often keys loaded from a URL are fetched
+	// again, so rotated keys are picked up.
+	jwksRefreshInterval = 5 * time.Minute
+	// jwksMinRefreshInterval limits refetches caused by tokens signed with
+	// an unknown key.
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksFetchTimeout       = 10 * time.Second
+	jwksMaxSize            = 1 << 20
+)
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// errKeysUnavailable is returned for tokens signed with an unknown key while
+// the key set can not be fetched. AuthMiddleware passes it on as 503 Service
+// Unavailable instead of rejecting the token.
+var errKeysUnavailable = status.Error(codes.Unavailable, "signing keys are unavailable")
+
+// jwk is a JSON Web Key (RFC 7517). Only the members of public signing keys
+// are decoded.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type publicKey struct {
+	key crypto.PublicKey
+	// alg is the only algorithm the key may be used with.
+	alg string
+}
+
+// KeySet holds the public keys that verify access tokens, read from a JSON
+// Web Key Set such as the one printed by "grpc-server jwks". Key sets
+// loaded from a URL are fetched again every few minutes and when a token
+// names an unknown key.
+type KeySet struct {
+	source string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]publicKey
+	fetched time.Time
+	// refreshing is closed when the running fetch, if any, is done.
+	refreshing chan struct{}
+	// refreshErr is why the last fetch failed, or nil.
+	refreshErr error
+}
+
+// LoadKeySet reads a JSON Web Key Set from an http(s) URL or a file.
+func LoadKeySet(ctx context.Context, source string) (*KeySet, error) {
+	s := &KeySet{source: source}
+	if s.remote() {
+		s.client = &http.Client{Timeout: jwksFetchTimeout}
+	}
+	keys, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.keys, s.fetched = keys, time.Now()
+	return s, nil
+}
+
+func (s *KeySet) remote() bool {
+	return strings.HasPrefix(s.source, "http://") || strings.HasPrefix(s.source, "https://")
+}
+
+// Key returns the key with id kid for verifying a token signed with alg. A
+// token without a kid is accepted when the set holds a single key. Only
+// tokens naming an unknown key wait for the set to be fetched again, and get
+// errKeysUnavailable if that fails.
+func (s *KeySet) Key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	k := s.lookup(kid)
+	if s.remote() {
+		since := time.Since(s.fetched)
+		if since >= jwksRefreshInterval || (k == nil && since >= jwksMinRefreshInterval) {
+			s.refresh(ctx)
+		}
+	}
+	refreshing := s.refreshing
+	s.mu.Unlock()
+
+	if k == nil && refreshing != nil {
+		select {
+		case <-refreshing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if k == nil {
+		s.mu.Lock()
+		k = s.lookup(kid)
+		failed := s.refreshErr != nil
+		s.mu.Unlock()
+		if k == nil && failed {
+			// The key may be one we failed to fetch.
+			return nil, errKeysUnavailable
+		}
+		if k == nil {
+			return nil, errUnknownKey
+		}
+	}
+	if k.alg != alg {
+		return nil, fmt.Errorf("key %q is for %s, not %s", kid, k.alg, alg)
+	}
+	return k.key, nil
+}
+
+// lookup returns the key with id kid, or nil. The caller holds s.mu.
+func (s *KeySet) lookup(kid string) *publicKey {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return &k
+		}
+	}
+	if k, ok := s.keys[kid]; ok {
+		return &k
+	}
+	return nil
+}
+
+// refresh starts fetching the keys again in the background, unless a fetch
+// is already running, and swaps them in when done. The old keys are kept if
+// that fails. The caller holds s.mu, which is not held while fetching.
+func (s *KeySet) refresh(ctx context.Context) {
+	if s.refreshing != nil {
+		return
+	}
+	done := make(chan struct{})
+	s.refreshing, s.fetched = done, time.Now()
+	go func() {
+		defer close(done)
+		keys, err := s.load(context.WithoutCancel(ctx))
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.refreshing, s.refreshErr = nil, err
+		if err != nil {
+			log.Printf("Failed to refresh JWKS: %v", err)
+			return
+		}
+		s.keys = keys
+	}()
+}
+
+func (s *KeySet) load(ctx context.Context) (map[string]publicKey, error) {
+	var data []byte
+	var err error
+	if s.remote() {
+		data, err = s.fetch(ctx)
+	} else {
+		data, err = os.ReadFile(s.source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %s: %v", s.source, err)
+	}
+	keys := make(map[string]publicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: %s: key %d: %v", s.source, i, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks: %s: no signing keys", s.source)
+	}
+	return keys, nil
+}
+
+func (s *KeySet) fetch(ctx context.Context) ([]byte, error) {
+	// Refreshes are triggered by requests but must not fail with them.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", s.source, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+}
+
+// publicKey decodes an Ed25519, P-256 or RSA key. A key without "alg" is
+// used with the algorithm the gRPC server signs such keys with.
+func (k jwk) publicKey() (publicKey, error) {
+	var pk publicKey
+	switch k.Kty {
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return pk, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeKeyParam(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return pk, errors.New(`invalid "x"`)
+		}
+		pk = publicKey{key: ed25519.PublicKey(x), alg: "EdDSA"}
+	case "EC":
+		if k.Crv != "P-256" {
+			return pk, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := decodeKeyParam(k.X)
+		y, errY := decodeKeyParam(k.Y)
+		if errX != nil || errY != nil {
+			return pk, errors.New(`invalid "x" or "y"`)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return pk, errors.New("point is not on P-256")
+		}
+		pk = publicKey{key: key, alg: "ES256"}
+	case "RSA":
+		n, errN := decodeKeyParam(k.N)
+		e, errE := decodeKeyParam(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return pk, errors.New(`invalid "n" or "e"`)
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return pk, errors.New("RSA keys must have at least 2048 bits")
+		}
+		pk = publicKey{key: key, alg: "RS256"}
+	default:
+		return pk, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	if k.Alg != "" && k.Alg != pk.alg {
+		return pk, fmt.Errorf("unsupported algorithm %q for %s key", k.Alg, k.Kty)
+	}
+	return pk, nil
+}
+
+func decodeKeyParam(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
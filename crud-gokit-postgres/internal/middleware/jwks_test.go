@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// toJWK encodes the public half of an Ed25519, P-256 or RSA private key.
+func toJWK(t *testing.T, kid string, priv interface{}) jwk {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := priv.(type) {
+	case ed25519.PrivateKey:
+		return jwk{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: b64(k.Public().(ed25519.PublicKey))}
+	case *ecdsa.PrivateKey:
+		size := (k.Params().BitSize + 7) / 8
+		return jwk{Kty: "EC", Kid: kid, Crv: k.Params().Name, X: b64(k.X.FillBytes(make([]byte, size))), Y: b64(k.Y.FillBytes(make([]byte, size)))}
+	case *rsa.PrivateKey:
+		return jwk{Kty: "RSA", Kid: kid, N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+	}
+	t.Fatalf("unsupported key %T", priv)
+	return jwk{}
+}
+
+func jwksJSON(t *testing.T, keys ...jwk) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string][]jwk{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeJWKS(t *testing.T, keys ...jwk) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksJSON(t, keys...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newEd25519(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestKeySetKey(t *testing.T) {
+	ed := newEd25519(t)
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rs, _ := rsa.GenerateKey(rand.Reader, 2048)
+	s, err := LoadKeySet(context.Background(), writeJWKS(t, toJWK(t, "ed", ed), toJWK(t, "ec", ec), toJWK(t, "rsa", rs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		kid, alg string
+		wantErr  bool
+	}{
+		{"ed", "EdDSA", false},
+		{"ec", "ES256", false},
+		{"rsa", "RS256", false},
+		{"rsa", "RS512", true},
+		{"ed", "ES256", true},
+		{"other", "EdDSA", true},
+		{"", "EdDSA", true},
+	}
+	for _, tt := range tests {
+		_, err := s.Key(context.Background(), tt.kid, tt.alg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Key(%q, %q) error = %v, want error %v", tt.kid, tt.alg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestKeySetSingleKeyWithoutKid(t *testing.T) {
+	ed := newEd25519(t)
+	s, err := LoadKeySet(context.Background(), writeJWKS(t, toJWK(t, "ed", ed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.Key(context.Background(), "", "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed.Public().(ed25519.PublicKey).Equal(key) {
+		t.Errorf("Key() = %v, want the only key", key)
+	}
+}
+
+func TestLoadKeySetInvalid(t *testing.T) {
+	ec384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rs1024, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ed := toJWK(t, "ed", newEd25519(t))
+	p384 := toJWK(t, "ec", ec384)
+	wrongAlg := ed
+	wrongAlg.Alg = "ES256"
+	shortX := ed
+	shortX.X = "AAAA"
+	encryption := ed
+	encryption.Use = "enc"
+
+	tests := []struct {
+		name string
+		keys []jwk
+	}{
+		{"no keys", nil},
+		{"only an encryption key", []jwk{encryption}},
+		{"unsupported curve", []jwk{p384}},
+		{"short RSA key", []jwk{toJWK(t, "rsa", rs1024)}},
+		{"algorithm not matching the key", []jwk{wrongAlg}},
+		{"truncated Ed25519 key", []jwk{shortX}},
+		{"symmetric key", []jwk{{Kty: "oct", Kid: "hs"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadKeySet(context.Background(), writeJWKS(t, tt.keys...)); err == nil {
+				t.Error("LoadKeySet() accepted the key set")
+			}
+		})
+	}
+}
+
+// jwksServer serves keys as a JWKS, counting requests. Requests wait
+// while hold is locked.
+type jwksServer struct {
+	t        *testing.T
+	mu       sync.Mutex
+	keys     []jwk
+	requests atomic.Int32
+	hold     sync.RWMutex
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.hold.RLock()
+	defer s.hold.RUnlock()
+	s.requests.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Write(jwksJSON(s.t, s.keys...))
+}
+
+func (s *jwksServer) setKeys(keys ...jwk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func TestKeySetRefetchesUnknownKeys(t *testing.T) {
+	old, rotated := toJWK(t, "old", newEd25519(t)), toJWK(t, "new", newEd25519(t))
+	js := &jwksServer{t: t, keys: []jwk{old}}
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+	ctx := context.Background()
+	s, err := LoadKeySet(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js.setKeys(old, rotated)
+	if _, err := s.Key(ctx, "new", "EdDSA"); !errors.Is(err, errUnknownKey) {
+		t.Errorf("Key() right after loading error = %v, want errUnknownKey", err)
+	}
+	if n := js.requests.Load(); n != 1 {
+		t.Errorf("unknown key refetched within %v: %d requests", jwksMinRefreshInterval, n)
+	}
+
+	s.mu.Lock()
+	s.fetched = time.Now().Add(-jwksMinRefreshInterval)
+	s.mu.Unlock()
+	if _, err := s.Key(ctx, "new", "EdDSA"); err != nil {
+		t.Errorf("Key() of a rotated key error = %v", err)
+	}
+	if n := js.requests.Load(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
+
+func TestKeySetSharesRefetches(t *testing.T) {
+	js := &jwksServer{t: t, keys: []jwk{toJWK(t, "old", newEd25519(t))}}
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+	ctx := context.Background()
+	s, err := LoadKeySet(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js.setKeys(toJWK(t, "old", newEd25519(t)), toJWK(t, "new", newEd25519(t)))
+	s.mu.Lock()
+	s.fetched = time.Now().Add(-jwksRefreshInterval)
+	s.mu.Unlock()
+
+	// Hold the fetch so that every caller asks while it is running.
+	js.hold.Lock()
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = s.Key(ctx, "new", "EdDSA")
+		}(i)
+	}
+	// Known keys are served from the old set without waiting.
+	if _, err := s.Key(ctx, "old", "EdDSA"); err != nil {
+		t.Errorf("Key() of a known key during a fetch error = %v", err)
+	}
+	js.hold.Unlock()
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d: error = %v", i, err)
+		}
+	}
+	if n := js.requests.Load(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
+
+func TestKeySetKeepsKeysWhenRefreshFails(t *testing.T) {
+	js := &jwksServer{t: t, keys: []jwk{toJWK(t, "old", newEd25519(t))}}
+	srv := httptest.NewServer(js)
+	ctx := context.Background()
+	s, err := LoadKeySet(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	s.mu.Lock()
+	s.fetched = time.Now().Add(-jwksRefreshInterval)
+	s.mu.Unlock()
+
+	if _, err := s.Key(ctx, "other", "EdDSA"); !errors.Is(err, errKeysUnavailable) {
+		t.Errorf("Key() of an unknown key error = %v, want errKeysUnavailable", err)
+	}
+	if _, err := s.Key(ctx, "old", "EdDSA"); err != nil {
+		t.Errorf("Key() after a failed refresh error = %v", err)
+	}
+}
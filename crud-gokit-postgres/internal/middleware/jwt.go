@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtLeeway is the clock skew allowed when checking expiry.
+const jwtLeeway = 30 * time.Second
+
+// Claims are the claims of an access token issued by the gRPC server's
+// Authenticate RPC. The subject is the user id.
+type Claims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+type jwtAuthenticator struct {
+	keys   *KeySet
+	roles  map[int64][]Role
+	parser *jwt.Parser
+}
+
+// JWTAuthenticator returns an Authenticator accepting Bearer access tokens
+// signed by a key in keys, issued by issuer for audience and not expired.
+// Callers have RoleSelf and the roles granted to their user id in roles.
+func JWTAuthenticator(keys *KeySet, issuer, audience string, roles map[int64][]Role) Authenticator {
+	return jwtAuthenticator{
+		keys:  keys,
+		roles: roles,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"EdDSA", "ES256", "RS256"}),
+			jwt.WithIssuer(issuer),
+			jwt.WithAudience(audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(jwtLeeway),
+		),
+	}
+}
+
+func (jwtAuthenticator) Scheme() string {
+	return "Bearer"
+}
+
+func (a jwtAuthenticator) Authenticate(ctx context.Context, credentials string) (*Principal, error) {
+	claims := &Claims{}
+	_, err := a.parser.ParseWithClaims(credentials, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.keys.Key(ctx, kid, token.Method.Alg())
+	})
+	if err != nil {
+		return nil, err
+	}
+	userId, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userId <= 0 {
+		return nil, fmt.Errorf("invalid subject %q", claims.Subject)
+	}
+	return &Principal{
+		Actor:  "user:" + claims.Subject,
+		Scheme: "Bearer",
+		UserId: userId,
+		Roles:  append([]Role{RoleSelf}, a.roles[userId]...),
+		Claims: claims,
+	}, nil
+}
+
+// ClaimsFromContext returns the claims of the access token the caller was
+// authenticated with. It returns false for other credentials.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || principal.Claims == nil {
+		return nil, false
+	}
+	return principal.Claims, true
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, other := newEd25519(t), newEd25519(t)
+	keys, err := LoadKeySet(context.Background(), writeJWKS(t, toJWK(t, "k1", key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := JWTAuthenticator(keys, "grpc-server", "users-api", map[int64][]Role{7: {RoleSupport}})
+
+	valid := func() *Claims {
+		now := time.Now()
+		return &Claims{
+			Email: "john@example.com",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "grpc-server",
+				Subject:   "7",
+				Audience:  jwt.ClaimStrings{"users-api"},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+		}
+	}
+	sign := func(claims *Claims, kid string, priv ed25519.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	with := func(change func(c *Claims)) string {
+		c := valid()
+		change(c)
+		return sign(c, "k1", key)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", sign(valid(), "k1", key), false},
+		{"without kid", sign(valid(), "", key), false},
+		{"within leeway", with(func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-jwtLeeway / 2)) }), false},
+		{"expired", with(func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) }), true},
+		{"no expiry", with(func(c *Claims) { c.ExpiresAt = nil }), true},
+		{"other issuer", with(func(c *Claims) { c.Issuer = "someone" }), true},
+		{"other audience", with(func(c *Claims) { c.Audience = jwt.ClaimStrings{"other-api"} }), true},
+		{"non-numeric subject", with(func(c *Claims) { c.Subject = "john" }), true},
+		{"zero subject", with(func(c *Claims) { c.Subject = "0" }), true},
+		{"signed by another key", sign(valid(), "k1", other), true},
+		{"unknown kid", sign(valid(), "k2", key), true},
+		{"unsigned", unsigned, true},
+		{"garbage", "not.a.token", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			want := []Role{RoleSelf, RoleSupport}
+			if p.Actor != "user:7" || p.UserId != 7 || p.Scheme != "Bearer" || !reflect.DeepEqual(p.Roles, want) {
+				t.Errorf("Authenticate() = %+v", p)
+			}
+			if p.Claims == nil || p.Claims.Email != "john@example.com" {
+				t.Errorf("Authenticate() claims = %+v", p.Claims)
+			}
+		})
+	}
+}
@@ -6,16 +6,25 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // AuthError represents an authorization error.
 type AuthError struct {
 	Realm string
+	// Schemes are the authentication schemes the client may use, as
+	// returned by Authenticator.Scheme. Basic is assumed when empty.
+	Schemes []string
 }
 
 // StatusCode is an implementation of the StatusCoder interface in go-kit/http.
@@ -30,20 +39,51 @@ func (AuthError) Error() string {
 
 // Headers is an implementation of the Headerer interface in go-kit/http.
 func (e AuthError) Headers() http.Header {
+	schemes := e.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"Basic"}
+	}
+	challenges := make([]string, len(schemes))
+	for i, scheme := range schemes {
+		challenges[i] = fmt.Sprintf(`%s realm=%q`, scheme, e.Realm)
+	}
 	return http.Header{
 		"Content-Type":           []string{"text/plain; charset=utf-8"},
 		"X-Content-Type-Options": []string{"nosniff"},
-		"WWW-Authenticate":       []string{fmt.Sprintf(`Basic realm=%q`, e.Realm)},
+		"WWW-Authenticate":       challenges,
 	}
 }
 
+// Principal is an authenticated caller.
+type Principal struct {
+	// Actor names the caller in the audit log: the user name for Basic
+	// credentials and "user:<id>" for access tokens.
+	Actor string
+	// Scheme is the authentication scheme the caller used.
+	Scheme string
+	// UserId is the user an access token was issued to, or 0 for Basic
+	// credentials.
+	UserId int64
+	// Roles and Scopes decide what the caller may do, see Authorize. API
+	// keys have scopes instead of roles.
+	Roles  []Role
+	Scopes []Permission
+	// Claims are the verified claims of an access token, or nil.
+	Claims *Claims
+}
+
+// Authenticator checks the credentials of one HTTP authentication scheme.
+type Authenticator interface {
+	// Scheme is the scheme name, such as "Basic" or "Bearer".
+	Scheme() string
+	// Authenticate checks the credentials following the scheme name in the
+	// Authorization header.
+	Authenticate(ctx context.Context, credentials string) (*Principal, error)
+}
+
 // parseBasicAuth parses an HTTP Basic Authentication string.
-// "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==" returns ([]byte("Aladdin"), []byte("open sesame"), true).
+// "QWxhZGRpbjpvcGVuIHNlc2FtZQ==" returns ([]byte("Aladdin"), []byte("open sesame"), true).
 func parseBasicAuth(auth string) (username, password []byte, ok bool) {
-	// const prefix = "Basic "
-	// if !strings.HasPrefix(auth, prefix) {
-	// 	return
-	// }
 	c, err := base64.StdEncoding.DecodeString(auth)
 	if err != nil {
 		return
@@ -61,31 +101,139 @@ func toHashSlice(s []byte) []byte {
 	return hash[:]
 }
 
-// AuthMiddleware returns a Basic Authentication middleware for a particular user and password.
-func AuthMiddleware(requiredUser, requiredPassword, realm string) endpoint.Middleware {
-	requiredUserBytes := toHashSlice([]byte(requiredUser))
-	requiredPasswordBytes := toHashSlice([]byte(requiredPassword))
+type basicAuthenticator struct {
+	user, password []byte
+}
+
+// BasicAuthenticator returns an Authenticator accepting Basic credentials
+// for a particular user and password. The user has RoleAdmin.
+func BasicAuthenticator(requiredUser, requiredPassword string) Authenticator {
+	return basicAuthenticator{
+		user:     toHashSlice([]byte(requiredUser)),
+		password: toHashSlice([]byte(requiredPassword)),
+	}
+}
+
+func (basicAuthenticator) Scheme() string {
+	return "Basic"
+}
+
+func (a basicAuthenticator) Authenticate(_ context.Context, credentials string) (*Principal, error) {
+	givenUser, givenPassword, ok := parseBasicAuth(credentials)
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	if subtle.ConstantTimeCompare(toHashSlice(givenUser), a.user) == 0 ||
+		subtle.ConstantTimeCompare(toHashSlice(givenPassword), a.password) == 0 {
+		return nil, errInvalidCredentials
+	}
+	return &Principal{Actor: string(givenUser), Scheme: "Basic", Roles: []Role{RoleAdmin}}, nil
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// AuthMiddleware returns a middleware requiring the Authorization header to
+// hold credentials accepted by the authenticator for its scheme. Schemes
+// are matched case-insensitively. The caller is put into the context, see
+// PrincipalFromContext. Invalid credentials get an AuthError, while failures
+// to check them, see unavailableError, are returned as they are.
+func AuthMiddleware(realm string, authenticators ...Authenticator) endpoint.Middleware {
+	schemes := make([]string, len(authenticators))
+	for i, a := range authenticators {
+		schemes[i] = a.Scheme()
+	}
+	authErr := AuthError{Realm: realm, Schemes: schemes}
 
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (interface{}, error) {
-			auth, ok := ctx.Value(httptransport.ContextKeyRequestAuthorization).(string)
+			scheme, credentials, ok := credentialsFromContext(ctx)
 			if !ok {
-				return nil, AuthError{realm}
+				return nil, authErr
 			}
-
-			givenUser, givenPassword, ok := parseBasicAuth(auth)
-			if !ok {
-				return nil, AuthError{realm}
+			for _, a := range authenticators {
+				if !strings.EqualFold(scheme, a.Scheme()) {
+					continue
+				}
+				principal, err := a.Authenticate(ctx, strings.TrimSpace(credentials))
+				if err != nil {
+					if unavailable, ok := unavailableError(err); ok {
+						return nil, unavailable
+					}
+					return nil, authErr
+				}
+				ctx = context.WithValue(ctx, principalKey{}, principal)
+				return next(context.WithValue(ctx, actorKey{}, principal.Actor), request)
 			}
+			return nil, authErr
+		}
+	}
+}
 
-			givenUserBytes := toHashSlice(givenUser)
-			givenPasswordBytes := toHashSlice(givenPassword)
+// unavailableError returns the gRPC status error within err if it tells
+// that credentials could not be checked, such as Unavailable from the gRPC
+// server or from a key set that can not be fetched. Such errors are passed
+// on, so clients are not told to drop credentials that may well be valid.
+// Any other error means the credentials are invalid.
+func unavailableError(err error) (error, bool) {
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return nil, false
+	}
+	switch se.GRPCStatus().Code() {
+	case codes.Unauthenticated, codes.InvalidArgument, codes.NotFound, codes.PermissionDenied:
+		return nil, false
+	}
+	return se.(error), true
+}
 
-			if subtle.ConstantTimeCompare(givenUserBytes, requiredUserBytes) == 0 ||
-				subtle.ConstantTimeCompare(givenPasswordBytes, requiredPasswordBytes) == 0 {
-				return nil, AuthError{realm}
-			}
+// credentialsFromContext returns the scheme and credentials of the
+// Authorization header or, without one, of the X-API-Key header.
+func credentialsFromContext(ctx context.Context) (scheme, credentials string, ok bool) {
+	if auth, ok := ctx.Value(httptransport.ContextKeyRequestAuthorization).(string); ok {
+		scheme, credentials, ok = strings.Cut(strings.TrimSpace(auth), " ")
+		return scheme, credentials, ok
+	}
+	if key, ok := ctx.Value(ContextKeyAPIKey).(string); ok && key != "" {
+		return apiKeyScheme, key, true
+	}
+	return "", "", false
+}
+
+type principalKey struct{}
 
+// PrincipalFromContext returns the caller authenticated by AuthMiddleware.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+type actorKey struct{}
+
+// ActorFromContext returns the user authenticated by AuthMiddleware.
+func ActorFromContext(ctx context.Context) (string, bool) {
+	actor, ok := ctx.Value(actorKey{}).(string)
+	return actor, ok
+}
+
+// AuditMetadataMiddleware forwards the authenticated actor and the request id
+// to the gRPC server as "x-actor" and "x-request-id" metadata, which it
+// records in the audit log. The client address is forwarded as
+// "x-forwarded-for" for rate limiting.
+func AuditMetadataMiddleware() endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if actor, ok := ActorFromContext(ctx); ok {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-actor", actor)
+			}
+			if id, ok := ctx.Value(httptransport.ContextKeyRequestXRequestID).(string); ok && id != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", id)
+			}
+			if addr, ok := ctx.Value(httptransport.ContextKeyRequestRemoteAddr).(string); ok && addr != "" {
+				if host, _, err := net.SplitHostPort(addr); err == nil {
+					addr = host
+				}
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", addr)
+			}
 			return next(ctx, request)
 		}
 	}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeAuthenticator accepts the credentials "valid" and fails others with
+// err.
+type fakeAuthenticator struct {
+	err error
+}
+
+func (fakeAuthenticator) Scheme() string {
+	return "Fake"
+}
+
+func (a fakeAuthenticator) Authenticate(_ context.Context, credentials string) (*Principal, error) {
+	if credentials == "valid" {
+		return &Principal{Actor: "fake", Scheme: "Fake", Roles: []Role{RoleAdmin}}, nil
+	}
+	return nil, a.err
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		err           error
+		// wantCode is the code of the gRPC status passed on, or OK to
+		// expect an AuthError.
+		wantCode  codes.Code
+		wantActor string
+	}{
+		{"valid credentials", "Fake valid", nil, codes.OK, "fake"},
+		{"scheme in another case", "fake valid", nil, codes.OK, "fake"},
+		{"invalid credentials", "Fake wrong", errInvalidCredentials, codes.OK, ""},
+		{"unknown scheme", "Other valid", nil, codes.OK, ""},
+		{"no credentials", "", nil, codes.OK, ""},
+		{"rejected by the gRPC server", "Fake wrong", status.Error(codes.Unauthenticated, "invalid API key"), codes.OK, ""},
+		{"gRPC server down", "Fake wrong", status.Error(codes.Unavailable, "connection refused"), codes.Unavailable, ""},
+		{"gRPC server timed out", "Fake wrong", status.Error(codes.DeadlineExceeded, "deadline exceeded"), codes.DeadlineExceeded, ""},
+		{"wrapped outage", "Fake wrong", fmt.Errorf("token is unverifiable: %w", errKeysUnavailable), codes.Unavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actor string
+			e := AuthMiddleware("test", fakeAuthenticator{err: tt.err})(func(ctx context.Context, _ interface{}) (interface{}, error) {
+				actor, _ = ActorFromContext(ctx)
+				return nil, nil
+			})
+			ctx := context.Background()
+			if tt.authorization != "" {
+				ctx = context.WithValue(ctx, httptransport.ContextKeyRequestAuthorization, tt.authorization)
+			}
+			_, err := e(ctx, nil)
+			if actor != tt.wantActor {
+				t.Errorf("actor = %q, want %q", actor, tt.wantActor)
+			}
+			switch {
+			case tt.wantActor != "":
+				if err != nil {
+					t.Errorf("error = %v", err)
+				}
+			case tt.wantCode == codes.OK:
+				if !errors.As(err, &AuthError{}) {
+					t.Errorf("error = %v, want AuthError", err)
+				}
+			default:
+				if s, ok := status.FromError(err); !ok || s.Code() != tt.wantCode {
+					t.Errorf("error = %v, want status %v", err, tt.wantCode)
+				}
+			}
+		})
+	}
+}
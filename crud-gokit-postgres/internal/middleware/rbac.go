@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// Role is a set of permissions granted to a caller.
+type Role string
+
+const (
+	// RoleAdmin may do anything.
+	RoleAdmin Role = "admin"
+	// RoleSupport may read and update any user.
+	RoleSupport Role = "support"
+	// RoleSelf may read and update only the user the caller is logged in
+	// as. Every caller with an access token has it.
+	RoleSelf Role = "self"
+)
+
+// Permission allows calling a group of endpoints.
+type Permission string
+
+const (
+	PermReadUsers   Permission = "users:read"
+	PermCreateUsers Permission = "users:create"
+	PermUpdateUsers Permission = "users:update"
+	PermDeleteUsers Permission = "users:delete"
+	PermPurgeUsers  Permission = "users:purge"
+	PermImportUsers Permission = "users:import"
+	PermExportUsers Permission = "users:export"
+
+	PermManageAPIKeys Permission = "keys:manage"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin: {
+		PermReadUsers, PermCreateUsers, PermUpdateUsers,
+		PermDeleteUsers, PermPurgeUsers, PermImportUsers, PermExportUsers,
+		PermManageAPIKeys,
+	},
+	RoleSupport: {PermReadUsers, PermUpdateUsers},
+	RoleSelf:    {PermReadUsers, PermUpdateUsers},
+}
+
+// deniedFields are the user fields a role granting PermUpdateUsers may not
+// change. Support staff cannot take over accounts, admins' included, by
+// changing their email or password, and users cannot re-enable themselves.
+var deniedFields = map[Role][]string{
+	RoleSupport: {"email", "password"},
+	RoleSelf:    {"status"},
+}
+
+// UserRequest is implemented by requests concerning a single user, so that
+// RoleSelf can be limited to the caller's own user.
+type UserRequest interface {
+	UserId() int64
+}
+
+// ForbiddenError is returned when the caller is authenticated but not
+// allowed to call an endpoint.
+type ForbiddenError struct{}
+
+// StatusCode is an implementation of the StatusCoder interface in go-kit/http.
+func (ForbiddenError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+// Error is an implementation of the Error interface.
+func (ForbiddenError) Error() string {
+	return http.StatusText(http.StatusForbidden)
+}
+
+// Headers is an implementation of the Headerer interface in go-kit/http.
+func (ForbiddenError) Headers() http.Header {
+	return http.Header{
+		"Content-Type":           []string{"text/plain; charset=utf-8"},
+		"X-Content-Type-Options": []string{"nosniff"},
+	}
+}
+
+// Authorize returns a middleware allowing only callers with a role or scope
+// granting perm. RoleSelf grants it only for a UserRequest about the
+// caller's own user. It must run after AuthMiddleware.
+func Authorize(perm Permission) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			principal, ok := PrincipalFromContext(ctx)
+			if !ok || !principal.allowed(perm, request) {
+				return nil, ForbiddenError{}
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// AuthorizeChange returns ForbiddenError unless the caller may change fields
+// of the user with id userId. It must run after Authorize(PermUpdateUsers).
+// Admins and API keys with the users:update scope may change any field;
+// other roles may not change their deniedFields, and RoleSelf only changes
+// the password when the current one is sent along.
+func AuthorizeChange(ctx context.Context, userId int64, fields []string, hasCurrentPassword bool) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return ForbiddenError{}
+	}
+	if slices.Contains(principal.Scopes, PermUpdateUsers) {
+		return nil
+	}
+	for _, role := range principal.Roles {
+		if !role.grants(PermUpdateUsers) {
+			continue
+		}
+		if role == RoleSelf && (principal.UserId == 0 || principal.UserId != userId) {
+			continue
+		}
+		if role.mayChange(fields, hasCurrentPassword) {
+			return nil
+		}
+	}
+	return ForbiddenError{}
+}
+
+func (r Role) mayChange(fields []string, hasCurrentPassword bool) bool {
+	for _, field := range fields {
+		if slices.Contains(deniedFields[r], field) {
+			return false
+		}
+		if r == RoleSelf && field == "password" && !hasCurrentPassword {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Principal) allowed(perm Permission, request interface{}) bool {
+	for _, scope := range p.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	for _, role := range p.Roles {
+		if !role.grants(perm) {
+			continue
+		}
+		if role != RoleSelf {
+			return true
+		}
+		if r, ok := request.(UserRequest); ok && p.UserId != 0 && r.UserId() == p.UserId {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Role) grants(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
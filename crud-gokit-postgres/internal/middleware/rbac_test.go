@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type userRequest int64
+
+func (r userRequest) UserId() int64 {
+	return int64(r)
+}
+
+var (
+	admin   = &Principal{Actor: "IOT", Scheme: "Basic", Roles: []Role{RoleAdmin}}
+	support = &Principal{Actor: "user:2", Scheme: "Bearer", UserId: 2, Roles: []Role{RoleSelf, RoleSupport}}
+	self    = &Principal{Actor: "user:3", Scheme: "Bearer", UserId: 3, Roles: []Role{RoleSelf}}
+	reader  = &Principal{Actor: "apikey:abc", Scheme: "ApiKey", Scopes: []Permission{PermReadUsers}}
+	updater = &Principal{Actor: "apikey:def", Scheme: "ApiKey", Scopes: []Permission{PermUpdateUsers}}
+)
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *Principal
+		perm      Permission
+		request   interface{}
+		want      bool
+	}{
+		{"admin deletes", admin, PermDeleteUsers, userRequest(3), true},
+		{"admin purges", admin, PermPurgeUsers, userRequest(3), true},
+		{"admin manages keys", admin, PermManageAPIKeys, nil, true},
+		{"support reads anyone", support, PermReadUsers, userRequest(3), true},
+		{"support updates anyone", support, PermUpdateUsers, userRequest(3), true},
+		{"support lists", support, PermReadUsers, nil, true},
+		{"support deletes", support, PermDeleteUsers, userRequest(3), false},
+		{"support creates", support, PermCreateUsers, nil, false},
+		{"self reads itself", self, PermReadUsers, userRequest(3), true},
+		{"self updates itself", self, PermUpdateUsers, userRequest(3), true},
+		{"self reads another user", self, PermReadUsers, userRequest(4), false},
+		{"self lists", self, PermReadUsers, nil, false},
+		{"self deletes itself", self, PermDeleteUsers, userRequest(3), false},
+		{"scope grants its permission", reader, PermReadUsers, userRequest(4), true},
+		{"scope grants nothing else", reader, PermUpdateUsers, userRequest(4), false},
+		{"no principal", nil, PermReadUsers, userRequest(3), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = context.WithValue(ctx, principalKey{}, tt.principal)
+			}
+			called := false
+			e := Authorize(tt.perm)(func(context.Context, interface{}) (interface{}, error) {
+				called = true
+				return nil, nil
+			})
+			_, err := e(ctx, tt.request)
+			if called != tt.want {
+				t.Errorf("endpoint called = %v, want %v", called, tt.want)
+			}
+			if !tt.want && !errors.As(err, &ForbiddenError{}) {
+				t.Errorf("error = %v, want ForbiddenError", err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeChange(t *testing.T) {
+	tests := []struct {
+		name            string
+		principal       *Principal
+		userId          int64
+		fields          []string
+		currentPassword bool
+		want            bool
+	}{
+		{"admin changes anything", admin, 3, []string{"name", "email", "password", "status"}, false, true},
+		{"API key changes anything", updater, 3, []string{"email", "password", "status"}, false, true},
+		{"support changes a name", support, 3, []string{"name"}, false, true},
+		{"support disables a user", support, 3, []string{"status"}, false, true},
+		{"support changes an email", support, 3, []string{"name", "email"}, false, false},
+		{"support changes a password", support, 3, []string{"password"}, true, false},
+		{"support changes its own email", support, 2, []string{"email"}, false, true},
+		{"support changes its own password", support, 2, []string{"password"}, true, true},
+		{"self changes its name and email", self, 3, []string{"name", "email"}, false, true},
+		{"self changes its password", self, 3, []string{"password"}, true, true},
+		{"self changes its password without the current one", self, 3, []string{"password"}, false, false},
+		{"self changes its status", self, 3, []string{"status"}, false, false},
+		{"self changes another user", self, 4, []string{"name"}, false, false},
+		{"read-only API key", reader, 3, []string{"name"}, false, false},
+		{"no principal", nil, 3, []string{"name"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = context.WithValue(ctx, principalKey{}, tt.principal)
+			}
+			err := AuthorizeChange(ctx, tt.userId, tt.fields, tt.currentPassword)
+			if (err == nil) != tt.want {
+				t.Errorf("AuthorizeChange() error = %v, want allowed %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// APIKey describes an API key. The key itself is only returned when it is
+// created.
+type APIKey struct {
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`   // null if the key does not expire
+	LastUsedAt *time.Time `json:"last_used_at"` // null until first used
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at"` // null unless revoked
+}
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+type AuditEvent struct {
+	Id        int64                  `json:"id"`
+	Actor     string                 `json:"actor"`
+	Operation string                 `json:"operation"`
+	Changes   map[string]FieldChange `json:"changes"`
+	RequestId string                 `json:"request_id"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// FieldChange holds a field's value before and after a change. A nil value
+// means the field was unset.
+type FieldChange struct {
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
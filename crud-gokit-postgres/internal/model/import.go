@@ -0,0 +1,24 @@
+package model
+
+import "fmt"
+
+// ImportRow is one user in an import file.
+type ImportRow struct {
+	Row          int64  `json:"-"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	PasswordHash string `json:"password_hash"`
+	Status       string `json:"status"`
+}
+
+// ImportRowError explains why a row was not imported.
+type ImportRowError struct {
+	Row     int64  `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Message)
+}
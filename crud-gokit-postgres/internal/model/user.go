@@ -1,8 +1,29 @@
 package model
 
+import "time"
+
 type User struct {
-	Id       int64  `json:"id" db:"id"`
-	Name     string `json:"name" db:"name"`
-	Email    string `json:"email" db:"email"`
-	Password string `json:"password" db:"password"`
+	Id      int64  `json:"id" db:"id"`
+	Name    string `json:"name" db:"name"`
+	Email   string `json:"email" db:"email"`
+	Status  string `json:"status" db:"status"`
+	Version int64  `json:"version" db:"version"`
+	// Timestamps are set by the server and ignored in requests.
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+	LastLoginAt     *time.Time `json:"last_login_at" db:"last_login_at"`         // null until the first login
+	EmailVerifiedAt *time.Time `json:"email_verified_at" db:"email_verified_at"` // null until verified, and again once the email changes
+}
+
+// BatchResult is the outcome of one item of a batch request: Error is set
+// if it failed, and otherwise User is set, except for deletes.
+type BatchResult struct {
+	User  *User       `json:"user,omitempty"`
+	Error *BatchError `json:"error,omitempty"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Reason  string `json:"reason,omitempty"`
 }
@@ -0,0 +1,197 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Error is returned when a patch cannot be applied.
+type Error struct {
+	Status int
+	Msg    string
+}
+
+// StatusCode is an implementation of the StatusCoder interface in go-kit/http.
+func (e Error) StatusCode() int {
+	return e.Status
+}
+
+// Error is an implementation of the Error interface.
+func (e Error) Error() string {
+	return e.Msg
+}
+
+func malformed(format string, a ...interface{}) error {
+	return Error{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+func unprocessable(format string, a ...interface{}) error {
+	return Error{http.StatusUnprocessableEntity, fmt.Sprintf(format, a...)}
+}
+
+// Document is a flat JSON object, such as a user, that patches apply to.
+// Values are in their encoding/json decoded form.
+type Document map[string]interface{}
+
+// NewDocument converts v to a Document by round-tripping it through JSON.
+func NewDocument(v interface{}) (Document, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (d Document) clone() Document {
+	c := make(Document, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
+
+// Changed returns the members that differ between d and other, including
+// members present in only one of them.
+func (d Document) Changed(other Document) []string {
+	var keys []string
+	for k, v := range other {
+		if old, ok := d[k]; !ok || !reflect.DeepEqual(old, v) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range d {
+		if _, ok := other[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7386) to doc and returns the
+// result; doc is not modified. Because documents are flat, object values
+// replace members instead of being merged into them.
+func MergePatch(doc Document, patch []byte) (Document, error) {
+	var members map[string]interface{}
+	if err := json.Unmarshal(patch, &members); err != nil || members == nil {
+		return nil, malformed("merge patch must be a JSON object")
+	}
+	result := doc.clone()
+	for k, v := range members {
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+// Operation is one JSON Patch operation.
+type Operation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// JSONPatch applies a JSON Patch (RFC 6902) to doc and returns the result;
+// doc is not modified. The whole patch fails if any operation fails. Paths
+// must name top-level members, as documents are flat.
+func JSONPatch(doc Document, patch []byte) (Document, error) {
+	var ops []Operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, malformed("JSON patch must be an array of operations")
+	}
+	result := doc.clone()
+	for i, op := range ops {
+		if err := apply(result, op); err != nil {
+			e := err.(Error)
+			e.Msg = fmt.Sprintf("operation %d: %s", i, e.Msg)
+			return nil, e
+		}
+	}
+	return result, nil
+}
+
+func apply(doc Document, op Operation) error {
+	key, err := member(op.Path)
+	if err != nil {
+		return err
+	}
+	switch op.Op {
+	case "add":
+		value, err := op.value()
+		if err != nil {
+			return err
+		}
+		doc[key] = value
+	case "remove":
+		if _, ok := doc[key]; !ok {
+			return unprocessable("path %q does not exist", op.Path)
+		}
+		delete(doc, key)
+	case "replace":
+		if _, ok := doc[key]; !ok {
+			return unprocessable("path %q does not exist", op.Path)
+		}
+		value, err := op.value()
+		if err != nil {
+			return err
+		}
+		doc[key] = value
+	case "move", "copy":
+		from, err := member(op.From)
+		if err != nil {
+			return err
+		}
+		value, ok := doc[from]
+		if !ok {
+			return unprocessable("from %q does not exist", op.From)
+		}
+		if op.Op == "move" {
+			delete(doc, from)
+		}
+		doc[key] = value
+	case "test":
+		value, err := op.value()
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(doc[key], value) {
+			return Error{http.StatusConflict, fmt.Sprintf("test failed for path %q", op.Path)}
+		}
+	default:
+		return malformed("unknown op %q", op.Op)
+	}
+	return nil
+}
+
+func (op Operation) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, malformed("%s operation requires a value", op.Op)
+	}
+	var v interface{}
+	if err := json.Unmarshal(*op.Value, &v); err != nil {
+		return nil, malformed("invalid value: %v", err)
+	}
+	return v, nil
+}
+
+// member turns a JSON Pointer such as "/name" into the member name.
+func member(pointer string) (string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return "", malformed("invalid JSON pointer %q", pointer)
+	}
+	key := pointer[1:]
+	if strings.Contains(key, "/") {
+		return "", unprocessable("path %q does not exist", pointer)
+	}
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(key), nil
+}
@@ -0,0 +1,122 @@
+package patch
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func user() Document {
+	return Document{"id": float64(1), "name": "John", "email": "john@example.com", "status": "active"}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		patch      string
+		want       Document
+		wantStatus int
+	}{
+		{"replace a member", `{"name":"Johnny"}`, Document{"id": float64(1), "name": "Johnny", "email": "john@example.com", "status": "active"}, 0},
+		{"add a member", `{"password":"secret"}`, Document{"id": float64(1), "name": "John", "email": "john@example.com", "status": "active", "password": "secret"}, 0},
+		{"null removes a member", `{"status":null}`, Document{"id": float64(1), "name": "John", "email": "john@example.com"}, 0},
+		{"empty patch", `{}`, user(), 0},
+		{"not an object", `["name"]`, nil, http.StatusBadRequest},
+		{"null document", `null`, nil, http.StatusBadRequest},
+		{"invalid JSON", `{"name":`, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := user()
+			got, err := MergePatch(doc, []byte(tt.patch))
+			checkResult(t, got, err, tt.want, tt.wantStatus)
+			if !reflect.DeepEqual(doc, user()) {
+				t.Errorf("MergePatch() modified its input: %v", doc)
+			}
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		patch      string
+		want       Document
+		wantStatus int
+	}{
+		{"replace", `[{"op":"replace","path":"/name","value":"Johnny"}]`, Document{"id": float64(1), "name": "Johnny", "email": "john@example.com", "status": "active"}, 0},
+		{"add", `[{"op":"add","path":"/password","value":"secret"}]`, Document{"id": float64(1), "name": "John", "email": "john@example.com", "status": "active", "password": "secret"}, 0},
+		{"remove", `[{"op":"remove","path":"/status"}]`, Document{"id": float64(1), "name": "John", "email": "john@example.com"}, 0},
+		{"move", `[{"op":"move","from":"/email","path":"/name"}]`, Document{"id": float64(1), "name": "john@example.com", "status": "active"}, 0},
+		{"copy", `[{"op":"copy","from":"/email","path":"/name"}]`, Document{"id": float64(1), "name": "john@example.com", "email": "john@example.com", "status": "active"}, 0},
+		{"passing test", `[{"op":"test","path":"/name","value":"John"},{"op":"replace","path":"/name","value":"Johnny"}]`, Document{"id": float64(1), "name": "Johnny", "email": "john@example.com", "status": "active"}, 0},
+		{"escaped pointer", `[{"op":"add","path":"/a~1b~0c","value":1}]`, Document{"id": float64(1), "name": "John", "email": "john@example.com", "status": "active", "a/b~c": float64(1)}, 0},
+		{"failing test", `[{"op":"test","path":"/name","value":"Jane"}]`, nil, http.StatusConflict},
+		{"failure undoes earlier operations", `[{"op":"replace","path":"/name","value":"Johnny"},{"op":"remove","path":"/missing"}]`, nil, http.StatusUnprocessableEntity},
+		{"replace a missing member", `[{"op":"replace","path":"/missing","value":1}]`, nil, http.StatusUnprocessableEntity},
+		{"move from a missing member", `[{"op":"move","from":"/missing","path":"/name"}]`, nil, http.StatusUnprocessableEntity},
+		{"nested path", `[{"op":"add","path":"/name/first","value":"John"}]`, nil, http.StatusUnprocessableEntity},
+		{"missing value", `[{"op":"add","path":"/name"}]`, nil, http.StatusBadRequest},
+		{"pointer without slash", `[{"op":"add","path":"name","value":"John"}]`, nil, http.StatusBadRequest},
+		{"unknown op", `[{"op":"merge","path":"/name","value":"John"}]`, nil, http.StatusBadRequest},
+		{"not an array", `{"op":"add","path":"/name","value":"John"}`, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := user()
+			got, err := JSONPatch(doc, []byte(tt.patch))
+			checkResult(t, got, err, tt.want, tt.wantStatus)
+			if !reflect.DeepEqual(doc, user()) {
+				t.Errorf("JSONPatch() modified its input: %v", doc)
+			}
+		})
+	}
+}
+
+func checkResult(t *testing.T, got Document, err error, want Document, wantStatus int) {
+	t.Helper()
+	if wantStatus != 0 {
+		var e Error
+		if !errors.As(err, &e) || e.StatusCode() != wantStatus {
+			t.Fatalf("error = %v, want status %d", err, wantStatus)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result = %v, want %v", got, want)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	patched := user()
+	patched["name"] = "Johnny"
+	patched["password"] = "secret"
+	delete(patched, "status")
+
+	got := user().Changed(patched)
+	sort.Strings(got)
+	if want := []string{"name", "password", "status"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Changed() = %v, want %v", got, want)
+	}
+	if got := user().Changed(user()); len(got) != 0 {
+		t.Errorf("Changed() of equal documents = %v, want none", got)
+	}
+}
+
+func TestNewDocument(t *testing.T) {
+	doc, err := NewDocument(struct {
+		Id   int64  `json:"id"`
+		Name string `json:"name"`
+	}{1, "John"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Document{"id": float64(1), "name": "John"}); !reflect.DeepEqual(doc, want) {
+		t.Errorf("NewDocument() = %v, want %v", doc, want)
+	}
+}
@@ -0,0 +1,106 @@
+package httptransport
+
+import (
+	myEndpoint "crud-gokit-postgres/internal/endpoint"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorResponse is the JSON body written for gRPC errors.
+type errorResponse struct {
+	Error           string           `json:"error"`
+	Code            string           `json:"code"`
+	Reason          string           `json:"reason,omitempty"`
+	FieldViolations []fieldViolation `json:"field_violations,omitempty"`
+	RetryAfter      string           `json:"retry_after,omitempty"`
+}
+
+type fieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// encodeError writes err to w. Errors that know their own HTTP status (such
+// as middleware.AuthError) are written as before; gRPC status errors are
+// mapped to the matching HTTP status with a JSON body built from their
+// error details.
+func encodeError(w http.ResponseWriter, err error) int {
+	if sc, ok := err.(httptransport.StatusCoder); ok {
+		if h, ok := err.(httptransport.Headerer); ok {
+			for k, values := range h.Headers() {
+				for _, v := range values {
+					w.Header().Add(k, v)
+				}
+			}
+		}
+		w.WriteHeader(sc.StatusCode())
+		w.Write([]byte(err.Error()))
+		return sc.StatusCode()
+	}
+
+	s := status.Convert(err)
+	body := errorResponse{
+		Error: s.Message(),
+		Code:  myEndpoint.CodeName(s.Code()),
+	}
+	for _, detail := range s.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			body.Reason = d.Reason
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				body.FieldViolations = append(body.FieldViolations, fieldViolation{Field: v.Field, Description: v.Description})
+			}
+		case *errdetails.RetryInfo:
+			body.RetryAfter = d.RetryDelay.AsDuration().String()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.RetryDelay.AsDuration().Seconds()))))
+		}
+	}
+
+	code := httpStatusFromCode(s.Code())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+	return code
+}
+
+// httpStatusFromCode follows the mapping used by grpc-gateway, except that
+// FailedPrecondition, which the server returns for stale versions, becomes
+// 412 Precondition Failed to answer If-Match.
+func httpStatusFromCode(c codes.Code) int {
+	switch c {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
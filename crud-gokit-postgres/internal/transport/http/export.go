@@ -0,0 +1,97 @@
+package httptransport
+
+import (
+	"bufio"
+	myEndpoint "crud-gokit-postgres/internal/endpoint"
+	"crud-gokit-postgres/internal/model"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func decodeExportUsersRequest(r *http.Request) (interface{}, error) {
+	req := myEndpoint.ExportUsersRequest{Format: r.URL.Query().Get("format")}
+	switch req.Format {
+	case "":
+		req.Format = "ndjson"
+	case "ndjson", "csv":
+	default:
+		return nil, fmt.Errorf("format must be ndjson or csv")
+	}
+	return req, nil
+}
+
+// exportColumns is the CSV header of an export.
+var exportColumns = []string{"id", "name", "email", "status", "version", "created_at", "updated_at", "last_login_at", "email_verified_at"}
+
+// exportFlushEvery is the number of users written between flushes.
+const exportFlushEvery = 500
+
+// writeExport streams the users of resp to w as NDJSON or CSV.
+func writeExport(w http.ResponseWriter, resp myEndpoint.ExportUsersResponse) {
+	var write func(model.User) error
+	var flush func() error
+	switch resp.Format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		write = func(u model.User) error {
+			var lastLogin, emailVerified string
+			if u.LastLoginAt != nil {
+				lastLogin = u.LastLoginAt.Format(time.RFC3339Nano)
+			}
+			if u.EmailVerifiedAt != nil {
+				emailVerified = u.EmailVerifiedAt.Format(time.RFC3339Nano)
+			}
+			return cw.Write([]string{
+				strconv.FormatInt(u.Id, 10), u.Name, u.Email, u.Status, strconv.FormatInt(u.Version, 10),
+				u.CreatedAt.Format(time.RFC3339Nano), u.UpdatedAt.Format(time.RFC3339Nano), lastLogin, emailVerified,
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="users.ndjson"`)
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		write = func(u model.User) error { return enc.Encode(u) }
+		flush = bw.Flush
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for n := 1; ; n++ {
+		user, err := resp.Users.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The status line is already sent. Abort the response, so the
+			// client sees it end early instead of a truncated but
+			// complete-looking file.
+			log.Printf("Failed to export users: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+		if err := write(user); err != nil {
+			return // the client went away
+		}
+		if n%exportFlushEvery == 0 {
+			if flush() != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	flush()
+}
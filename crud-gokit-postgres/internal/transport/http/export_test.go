@@ -0,0 +1,152 @@
+package httptransport
+
+import (
+	"bufio"
+	"context"
+	myEndpoint "crud-gokit-postgres/internal/endpoint"
+	"crud-gokit-postgres/internal/model"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sliceSource yields users, then err, or io.EOF if err is nil.
+type sliceSource struct {
+	users []model.User
+	err   error
+}
+
+func (s *sliceSource) Next() (model.User, error) {
+	if len(s.users) == 0 {
+		if s.err != nil {
+			return model.User{}, s.err
+		}
+		return model.User{}, io.EOF
+	}
+	u := s.users[0]
+	s.users = s.users[1:]
+	return u, nil
+}
+
+func exportUsers(n int) []model.User {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	users := make([]model.User, n)
+	for i := range users {
+		users[i] = model.User{Id: int64(i + 1), Name: fmt.Sprintf("User %d", i+1), Email: fmt.Sprintf("user%d@example.com", i+1),
+			Status: "active", Version: 1, CreatedAt: created, UpdatedAt: created}
+	}
+	users[0].LastLoginAt = &created
+	return users
+}
+
+// newExportServer serves the export of source, or fails it with err.
+func newExportServer(t *testing.T, source *sliceSource, err error) *httptest.Server {
+	t.Helper()
+	e := func(_ context.Context, request interface{}) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		req := request.(myEndpoint.ExportUsersRequest)
+		return myEndpoint.ExportUsersResponse{Format: req.Format, Users: source}, nil
+	}
+	srv := httptest.NewServer(httpHandler(e, decodeExportUsersRequest))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestExportNDJSON(t *testing.T) {
+	users := exportUsers(2*exportFlushEvery + 1)
+	srv := newExportServer(t, &sliceSource{users: append([]model.User(nil), users...)}, nil)
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var got []model.User
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var u model.User
+		if err := json.Unmarshal(scanner.Bytes(), &u); err != nil {
+			t.Fatalf("line %d: %v", len(got)+1, err)
+		}
+		got = append(got, u)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, users) {
+		t.Errorf("got %d users, want the %d exported", len(got), len(users))
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	users := exportUsers(2)
+	srv := newExportServer(t, &sliceSource{users: users}, nil)
+	resp, err := http.Get(srv.URL + "?format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		exportColumns,
+		{"1", "User 1", "user1@example.com", "active", "1", "2024-05-01T12:00:00Z", "2024-05-01T12:00:00Z", "2024-05-01T12:00:00Z", ""},
+		{"2", "User 2", "user2@example.com", "active", "1", "2024-05-01T12:00:00Z", "2024-05-01T12:00:00Z", "", ""},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	srv := newExportServer(t, &sliceSource{}, nil)
+	resp, err := http.Get(srv.URL + "?format=xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d, want 400", resp.StatusCode)
+	}
+
+	// Errors before the first user get a status.
+	srv = newExportServer(t, nil, status.Error(codes.Unavailable, "connection refused"))
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("server unavailable: status %d, want 503", resp.StatusCode)
+	}
+
+	// Later errors abort the response rather than end it cleanly.
+	srv = newExportServer(t, &sliceSource{users: exportUsers(exportFlushEvery + 1), err: errors.New("stream broken")}, nil)
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("aborted export was read completely: %d bytes", len(body))
+	}
+}
@@ -3,10 +3,18 @@ package httptransport
 import (
 	"context"
 	myEndpoint "crud-gokit-postgres/internal/endpoint"
+	"crud-gokit-postgres/internal/middleware"
+	"crud-gokit-postgres/internal/patch"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
@@ -20,10 +28,30 @@ import (
 func NewHTTPHandler(endpoints myEndpoint.Endpoints) http.Handler {
 	r := mux.NewRouter()
 
+	r.Methods("POST").Path("/api/auth/login").Handler(httpHandler(endpoints.LoginEndpoint, decodeLoginRequest))
+	r.Methods("POST").Path("/api/auth/refresh").Handler(httpHandler(endpoints.RefreshTokenEndpoint, decodeRefreshTokenRequest))
+
+	r.Methods("GET").Path("/api/users").Handler(httpHandler(endpoints.ListUsersEndpoint, decodeListUsersRequest))
 	r.Methods("POST").Path("/api/users").Handler(httpHandler(endpoints.CreateUserEndpoint, decodeCreateUserRequest))
+	r.Methods("POST").Path("/api/users:batchCreate").Handler(httpHandler(endpoints.BatchCreateUsersEndpoint, decodeBatchCreateUsersRequest))
+	r.Methods("GET").Path("/api/users:batchGet").Handler(httpHandler(endpoints.BatchGetUsersEndpoint, decodeBatchGetUsersRequest))
+	r.Methods("GET").Path("/api/users:export").Handler(httpHandler(endpoints.ExportUsersEndpoint, decodeExportUsersRequest))
+	r.Methods("POST").Path("/api/users:import").Handler(httpHandler(endpoints.ImportUsersEndpoint, decodeImportUsersRequest))
+	r.Methods("POST").Path("/api/users/verify-email").Handler(httpHandler(endpoints.VerifyEmailEndpoint, decodeVerifyEmailRequest))
+	r.Methods("POST").Path("/api/users/request-password-reset").Handler(httpHandler(endpoints.RequestPasswordResetEndpoint, decodeRequestPasswordResetRequest))
+	r.Methods("POST").Path("/api/users/reset-password").Handler(httpHandler(endpoints.ResetPasswordEndpoint, decodeResetPasswordRequest))
+	r.Methods("POST").Path("/api/users:batchDelete").Handler(httpHandler(endpoints.BatchDeleteUsersEndpoint, decodeBatchDeleteUsersRequest))
 	r.Methods("GET").Path("/api/users/{id}").Handler(httpHandler(endpoints.GetUserEndpoint, decodeGetUserRequest))
 	r.Methods("PUT").Path("/api/users/{id}").Handler(httpHandler(endpoints.UpdateUserEndpoint, decodeUpdateUserRequest))
+	r.Methods("PATCH").Path("/api/users/{id}").Handler(httpHandler(endpoints.PatchUserEndpoint, decodePatchUserRequest))
 	r.Methods("DELETE").Path("/api/users/{id}").Handler(httpHandler(endpoints.DeleteUserEndpoint, decodeDeleteUserRequest))
+	r.Methods("GET").Path("/api/users/{id}/history").Handler(httpHandler(endpoints.HistoryEndpoint, decodeHistoryRequest))
+	r.Methods("POST").Path("/api/users/{id}:restore").Handler(httpHandler(endpoints.RestoreUserEndpoint, decodeRestoreUserRequest))
+	r.Methods("POST").Path("/api/users/{id}:purge").Handler(httpHandler(endpoints.PurgeUserEndpoint, decodePurgeUserRequest))
+
+	r.Methods("POST").Path("/api/keys").Handler(httpHandler(endpoints.CreateAPIKeyEndpoint, decodeCreateAPIKeyRequest))
+	r.Methods("GET").Path("/api/keys").Handler(httpHandler(endpoints.ListAPIKeysEndpoint, decodeListAPIKeysRequest))
+	r.Methods("DELETE").Path("/api/keys/{id}").Handler(httpHandler(endpoints.RevokeAPIKeyEndpoint, decodeRevokeAPIKeyRequest))
 
 	return r
 }
@@ -33,42 +61,63 @@ func httpHandler(e endpoint.Endpoint, decodeRequest func(r *http.Request) (inter
 	tracer := otel.Tracer("crud-gokit-postgres")
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract token from Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization token missing", http.StatusUnauthorized)
-			return
+		ctx := r.Context()
+		// The Authorization header is checked by the endpoint's
+		// middleware.AuthMiddleware, which knows the accepted schemes.
+		if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+			ctx = context.WithValue(ctx, httptransport.ContextKeyRequestAuthorization, authHeader)
 		}
-
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "basic" {
-			http.Error(w, "Invalid Authorization token format", http.StatusUnauthorized)
-			return
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			ctx = context.WithValue(ctx, middleware.ContextKeyAPIKey, apiKey)
 		}
 
-		authToken := parts[1]
-
-		// Create a new context with the token
-		ctx := context.WithValue(r.Context(), httptransport.ContextKeyRequestAuthorization, authToken)
+		// Propagate the caller's request id, or assign one, so the request
+		// can be found in the audit log.
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" {
+			requestId = newRequestId()
+		}
+		ctx = context.WithValue(ctx, httptransport.ContextKeyRequestXRequestID, requestId)
+		w.Header().Set("X-Request-Id", requestId)
+		ctx = context.WithValue(ctx, httptransport.ContextKeyRequestRemoteAddr, r.RemoteAddr)
 		ctx, span := tracer.Start(ctx, r.URL.Path)
 		defer span.End()
 
 		request, err := decodeRequest(r)
 		if err != nil {
+			if _, ok := err.(httptransport.StatusCoder); ok {
+				encodeError(w, err)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		response, err := e(ctx, request)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			statusCode := encodeError(w, err)
 			// Record the status in the span
 			span.SetStatus(codes.Error, err.Error())
-			span.SetAttributes(attribute.Int("http.status_code", http.StatusInternalServerError))
+			span.SetAttributes(attribute.Int("http.status_code", statusCode))
 			return
 		}
 
+		if export, ok := response.(myEndpoint.ExportUsersResponse); ok {
+			writeExport(w, export)
+			return
+		}
+
+		if h, ok := response.(httptransport.Headerer); ok {
+			for k, values := range h.Headers() {
+				for _, v := range values {
+					w.Header().Add(k, v)
+				}
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
+		if sc, ok := response.(httptransport.StatusCoder); ok {
+			w.WriteHeader(sc.StatusCode())
+		}
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -76,8 +125,30 @@ func httpHandler(e endpoint.Endpoint, decodeRequest func(r *http.Request) (inter
 	})
 }
 
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // Decode functions for each request type.
 
+func decodeLoginRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeRefreshTokenRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
 func decodeCreateUserRequest(r *http.Request) (interface{}, error) {
 	var req myEndpoint.CreateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -86,6 +157,46 @@ func decodeCreateUserRequest(r *http.Request) (interface{}, error) {
 	return req, nil
 }
 
+func decodeBatchCreateUsersRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.BatchCreateUsersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeBatchGetUsersRequest reads ids from repeated or comma-separated
+// "ids" query parameters, e.g. ?ids=1,2&ids=3.
+func decodeBatchGetUsersRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.BatchGetUsersRequest
+	query := r.URL.Query()
+	for _, v := range query["ids"] {
+		for _, s := range strings.Split(v, ",") {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id %q", s)
+			}
+			req.Ids = append(req.Ids, id)
+		}
+	}
+	if v := query.Get("atomic"); v != "" {
+		atomic, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("atomic must be true or false")
+		}
+		req.Atomic = atomic
+	}
+	return req, nil
+}
+
+func decodeBatchDeleteUsersRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.BatchDeleteUsersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
 func decodeGetUserRequest(r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
@@ -106,9 +217,58 @@ func decodeUpdateUserRequest(r *http.Request) (interface{}, error) {
 		return nil, err
 	}
 	req.Id = int64(id)
+	req.Version = parseIfMatch(r.Header.Get("If-Match"))
+	return req, nil
+}
+
+// maxPatchSize bounds PATCH request bodies.
+const maxPatchSize = 1 << 20
+
+func decodePatchUserRequest(r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	req := myEndpoint.PatchUserRequest{
+		Id:      int64(id),
+		Version: parseIfMatch(r.Header.Get("If-Match")),
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/merge-patch+json", "application/json":
+	case "application/json-patch+json":
+		req.JSONPatch = true
+	default:
+		return nil, patch.Error{
+			Status: http.StatusUnsupportedMediaType,
+			Msg:    "Content-Type must be application/merge-patch+json or application/json-patch+json",
+		}
+	}
+	if req.Patch, err = io.ReadAll(io.LimitReader(r.Body, maxPatchSize)); err != nil {
+		return nil, err
+	}
 	return req, nil
 }
 
+// parseIfMatch returns the user version named by an If-Match header, or 0
+// when the header is absent or "*". Weak or malformed tags return -1, which
+// never matches a stored version, as If-Match requires strong comparison.
+func parseIfMatch(header string) int64 {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return -1
+	}
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return -1
+	}
+	return version
+}
+
 func decodeDeleteUserRequest(r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
@@ -117,3 +277,135 @@ func decodeDeleteUserRequest(r *http.Request) (interface{}, error) {
 	}
 	return myEndpoint.DeleteUserRequest{Id: int64(id)}, nil
 }
+
+func decodeCreateAPIKeyRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeListAPIKeysRequest(r *http.Request) (interface{}, error) {
+	return myEndpoint.ListAPIKeysRequest{}, nil
+}
+
+func decodeRevokeAPIKeyRequest(r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return myEndpoint.RevokeAPIKeyRequest{Id: id}, nil
+}
+
+func decodeVerifyEmailRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeRequestPasswordResetRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.RequestPasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeResetPasswordRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeRestoreUserRequest(r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	return myEndpoint.RestoreUserRequest{Id: int64(id)}, nil
+}
+
+func decodePurgeUserRequest(r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	return myEndpoint.PurgeUserRequest{Id: int64(id)}, nil
+}
+
+// listUsersParams are the query parameters accepted by GET /api/users.
+var listUsersParams = map[string]bool{
+	"page_size":      true,
+	"page_token":     true,
+	"order_by":       true,
+	"email_domain":   true,
+	"name_prefix":    true,
+	"created_after":  true,
+	"created_before": true,
+	"status":         true,
+}
+
+func decodeListUsersRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.ListUsersRequest
+	query := r.URL.Query()
+	for key, values := range query {
+		if !listUsersParams[key] {
+			return nil, fmt.Errorf("unknown query parameter %q", key)
+		}
+		if len(values) > 1 {
+			return nil, fmt.Errorf("query parameter %q given more than once", key)
+		}
+	}
+	if v := query.Get("page_size"); v != "" {
+		pageSize, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		req.PageSize = int32(pageSize)
+	}
+	req.PageToken = query.Get("page_token")
+	req.OrderBy = query.Get("order_by")
+	req.EmailDomain = query.Get("email_domain")
+	req.NamePrefix = query.Get("name_prefix")
+	req.Status = query.Get("status")
+	for key, dst := range map[string]**time.Time{
+		"created_after":  &req.CreatedAfter,
+		"created_before": &req.CreatedBefore,
+	} {
+		if v := query.Get(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", key)
+			}
+			*dst = &t
+		}
+	}
+	return req, nil
+}
+
+func decodeHistoryRequest(r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	req := myEndpoint.HistoryRequest{Id: int64(id)}
+	query := r.URL.Query()
+	if v := query.Get("page_size"); v != "" {
+		pageSize, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		req.PageSize = int32(pageSize)
+	}
+	req.PageToken = query.Get("page_token")
+	return req, nil
+}
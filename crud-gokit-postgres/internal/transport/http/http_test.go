@@ -0,0 +1,151 @@
+package httptransport
+
+import (
+	"context"
+	myEndpoint "crud-gokit-postgres/internal/endpoint"
+	"crud-gokit-postgres/internal/model"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64
+	}{
+		{"", 0},
+		{"*", 0},
+		{` * `, 0},
+		{`"3"`, 3},
+		{` "3" `, 3},
+		{`W/"3"`, -1},
+		{`3`, -1},
+		{`"3`, -1},
+		{`3"`, -1},
+		{`""3""`, -1},
+		{`"`, -1},
+		{`"abc"`, -1},
+		{`"0"`, -1},
+		{`"-2"`, -1},
+		{`"3", "4"`, -1},
+	}
+	for _, tt := range tests {
+		if got := parseIfMatch(tt.header); got != tt.want {
+			t.Errorf("parseIfMatch(%q) = %d, want %d", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	var gotVersions []int64
+	stale := status.Error(codes.FailedPrecondition, "user was modified by someone else")
+	h := NewHTTPHandler(myEndpoint.Endpoints{
+		GetUserEndpoint: func(_ context.Context, request interface{}) (interface{}, error) {
+			return myEndpoint.GetUserResponse{User: model.User{Id: 7, Version: 3}}, nil
+		},
+		UpdateUserEndpoint: func(_ context.Context, request interface{}) (interface{}, error) {
+			req := request.(myEndpoint.UpdateUserRequest)
+			gotVersions = append(gotVersions, req.Version)
+			if req.Version != 0 && req.Version != 3 {
+				return nil, stale
+			}
+			return myEndpoint.UpdateUserResponse{Success: true, Version: 4}, nil
+		},
+		PatchUserEndpoint: func(_ context.Context, request interface{}) (interface{}, error) {
+			req := request.(myEndpoint.PatchUserRequest)
+			gotVersions = append(gotVersions, req.Version)
+			if req.Version != 0 && req.Version != 3 {
+				return nil, stale
+			}
+			return myEndpoint.PatchUserResponse{User: model.User{Id: 7, Version: 4}}, nil
+		},
+	})
+	tests := []struct {
+		method      string
+		ifMatch     string
+		wantStatus  int
+		wantETag    string
+		wantVersion int64
+	}{
+		{"GET", "", http.StatusOK, `"3"`, 0},
+		{"PUT", `"3"`, http.StatusOK, `"4"`, 3},
+		{"PUT", "", http.StatusOK, `"4"`, 0},
+		{"PUT", `"2"`, http.StatusPreconditionFailed, "", 2},
+		{"PATCH", `"3"`, http.StatusOK, `"4"`, 3},
+		{"PATCH", `*`, http.StatusOK, `"4"`, 0},
+		{"PATCH", `W/"3"`, http.StatusPreconditionFailed, "", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.ifMatch, func(t *testing.T) {
+			gotVersions = nil
+			r := httptest.NewRequest(tt.method, "/api/users/7", strings.NewReader(`{"name":"John"}`))
+			r.Header.Set("Content-Type", "application/merge-patch+json")
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus || w.Header().Get("ETag") != tt.wantETag {
+				t.Errorf("status %d, ETag %q; want %d, %q", w.Code, w.Header().Get("ETag"), tt.wantStatus, tt.wantETag)
+			}
+			if tt.method != "GET" && !reflect.DeepEqual(gotVersions, []int64{tt.wantVersion}) {
+				t.Errorf("endpoint got versions %v, want %d", gotVersions, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestEncodeError(t *testing.T) {
+	rateLimited, _ := status.New(codes.ResourceExhausted, "too many requests").WithDetails(
+		&errdetails.ErrorInfo{Reason: "RATE_LIMITED"},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(1500 * time.Millisecond)})
+	invalid, _ := status.New(codes.InvalidArgument, "invalid name: must not be empty").WithDetails(
+		&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "name", Description: "must not be empty"}}})
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantBody       errorResponse
+		wantRetryAfter string
+	}{
+		{"stale version", status.Error(codes.FailedPrecondition, "user was modified by someone else"), http.StatusPreconditionFailed,
+			errorResponse{Error: "user was modified by someone else", Code: "FAILED_PRECONDITION"}, ""},
+		{"not found", status.Error(codes.NotFound, "user not found"), http.StatusNotFound,
+			errorResponse{Error: "user not found", Code: "NOT_FOUND"}, ""},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), http.StatusServiceUnavailable,
+			errorResponse{Error: "connection refused", Code: "UNAVAILABLE"}, ""},
+		{"rate limited", rateLimited.Err(), http.StatusTooManyRequests,
+			errorResponse{Error: "too many requests", Code: "RESOURCE_EXHAUSTED", Reason: "RATE_LIMITED", RetryAfter: "1.5s"}, "2"},
+		{"invalid argument", invalid.Err(), http.StatusBadRequest,
+			errorResponse{Error: "invalid name: must not be empty", Code: "INVALID_ARGUMENT",
+				FieldViolations: []fieldViolation{{Field: "name", Description: "must not be empty"}}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if code := encodeError(w, tt.err); code != tt.wantStatus || w.Code != tt.wantStatus {
+				t.Errorf("encodeError() = %d, wrote %d, want %d", code, w.Code, tt.wantStatus)
+			}
+			var body errorResponse
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body, tt.wantBody) {
+				t.Errorf("body = %+v, want %+v", body, tt.wantBody)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package httptransport
+
+import (
+	"bufio"
+	"bytes"
+	myEndpoint "crud-gokit-postgres/internal/endpoint"
+	"crud-gokit-postgres/internal/model"
+	"crud-gokit-postgres/internal/patch"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func decodeImportUsersRequest(r *http.Request) (interface{}, error) {
+	var req myEndpoint.ImportUsersRequest
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("dry_run must be true or false")
+		}
+		req.DryRun = dryRun
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		rows, err := newCSVRows(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Rows = rows
+	case "application/x-ndjson", "application/jsonl":
+		req.Rows = newNDJSONRows(r.Body)
+	default:
+		return nil, patch.Error{
+			Status: http.StatusUnsupportedMediaType,
+			Msg:    "Content-Type must be text/csv or application/x-ndjson",
+		}
+	}
+	return req, nil
+}
+
+// importColumns are the fields of an import row.
+var importColumns = map[string]bool{
+	"name":          true,
+	"email":         true,
+	"password":      true,
+	"password_hash": true,
+	"status":        true,
+}
+
+// csvRows reads import rows from CSV with a header naming the columns, in
+// any order. Rows are numbered from 1, not counting the header.
+type csvRows struct {
+	r       *csv.Reader
+	columns map[string]int
+	width   int
+	row     int64
+}
+
+func newCSVRows(r io.Reader) (*csvRows, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %v", err)
+	}
+	c := &csvRows{r: cr, columns: make(map[string]int), width: len(header)}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !importColumns[name] {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		if _, ok := c.columns[name]; ok {
+			return nil, fmt.Errorf("CSV column %q given more than once", name)
+		}
+		c.columns[name] = i
+	}
+	for _, name := range []string{"name", "email"} {
+		if _, ok := c.columns[name]; !ok {
+			return nil, fmt.Errorf("CSV column %q is missing", name)
+		}
+	}
+	return c, nil
+}
+
+func (c *csvRows) Next() (model.ImportRow, error) {
+	record, err := c.r.Read()
+	if err == io.EOF {
+		return model.ImportRow{}, err
+	}
+	c.row++
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return model.ImportRow{}, &model.ImportRowError{Row: c.row, Message: parseErr.Err.Error()}
+	}
+	if err != nil {
+		return model.ImportRow{}, err
+	}
+	if len(record) != c.width {
+		return model.ImportRow{}, &model.ImportRowError{
+			Row:     c.row,
+			Message: fmt.Sprintf("has %d fields, the header has %d", len(record), c.width),
+		}
+	}
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+	return model.ImportRow{
+		Row:          c.row,
+		Name:         field("name"),
+		Email:        field("email"),
+		Password:     field("password"),
+		PasswordHash: field("password_hash"),
+		Status:       field("status"),
+	}, nil
+}
+
+// maxNDJSONLine bounds a single NDJSON line.
+const maxNDJSONLine = 1 << 20
+
+// ndjsonRows reads import rows from newline-delimited JSON objects. Rows
+// are numbered by line; blank lines are skipped.
+type ndjsonRows struct {
+	s    *bufio.Scanner
+	line int64
+}
+
+func newNDJSONRows(r io.Reader) *ndjsonRows {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+	return &ndjsonRows{s: s}
+}
+
+func (n *ndjsonRows) Next() (model.ImportRow, error) {
+	for n.s.Scan() {
+		n.line++
+		line := bytes.TrimSpace(n.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var row model.ImportRow
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row); err != nil {
+			return model.ImportRow{}, &model.ImportRowError{Row: n.line, Message: "invalid JSON: " + err.Error()}
+		}
+		row.Row = n.line
+		return row, nil
+	}
+	if err := n.s.Err(); err != nil {
+		return model.ImportRow{}, err
+	}
+	return model.ImportRow{}, io.EOF
+}
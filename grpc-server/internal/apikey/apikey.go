@@ -0,0 +1,101 @@
+// Package apikey issues the API keys machine clients authenticate with and
+// checks them.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"grpc-server/internal/model"
+	"grpc-server/internal/repository"
+)
+
+// ErrInvalidKey is returned for keys that were never issued, were revoked
+// or have expired.
+var ErrInvalidKey = errors.New("apikey: invalid API key")
+
+// Scopes are the permissions a key may be granted. They match the
+// permissions the HTTP gateway checks.
+var Scopes = []string{
+	"users:read",
+	"users:create",
+	"users:update",
+	"users:delete",
+	"users:import",
+	"users:export",
+	"keys:manage",
+}
+
+// Keys look like "uk_<prefix>_<secret>": prefixSize random bytes in hex,
+// which are stored in the clear to identify the key, and secretSize random
+// bytes in base64url.
+const (
+	keyPrefix  = "uk_"
+	prefixSize = 6
+	secretSize = 32
+)
+
+// ValidScope reports whether scope is one of Scopes.
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Issuer creates API keys and authenticates clients with them.
+type Issuer struct {
+	repo repository.UserRepository
+}
+
+// New returns an Issuer storing keys in repo.
+func New(repo repository.UserRepository) *Issuer {
+	return &Issuer{repo: repo}
+}
+
+// Create issues a key with the given name, scopes and optional expiry. It
+// returns the stored key and the secret key, which is not stored.
+func (i *Issuer) Create(ctx context.Context, name string, scopes []string, expiresAt *time.Time) (*model.APIKey, string, error) {
+	raw := make([]byte, prefixSize+secretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	prefix := keyPrefix + hex.EncodeToString(raw[:prefixSize])
+	secret := prefix + "_" + base64.RawURLEncoding.EncodeToString(raw[prefixSize:])
+	key := &model.APIKey{
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   hash(secret),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if err := i.repo.CreateAPIKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// Authenticate returns the key matching secret and records its use.
+func (i *Issuer) Authenticate(ctx context.Context, secret string) (*model.APIKey, error) {
+	if !strings.HasPrefix(secret, keyPrefix) {
+		return nil, ErrInvalidKey
+	}
+	key, err := i.repo.UseAPIKey(ctx, hash(secret))
+	if errors.Is(err, repository.ErrAPIKeyNotFound) {
+		return nil, ErrInvalidKey
+	}
+	return key, err
+}
+
+func hash(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
@@ -0,0 +1,109 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"grpc-server/internal/repository"
+)
+
+var keyFormat = regexp.MustCompile(`^uk_[0-9a-f]{12}_[A-Za-z0-9_-]{43}$`)
+
+func TestCreate(t *testing.T) {
+	i := New(repository.NewMemoryUserRepository())
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+	key, secret, err := i.Create(ctx, "billing", []string{"users:read"}, &expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyFormat.MatchString(secret) {
+		t.Errorf("Create() secret = %q, want uk_<prefix>_<secret>", secret)
+	}
+	if !strings.HasPrefix(secret, key.Prefix+"_") {
+		t.Errorf("secret %q does not start with the prefix %q", secret, key.Prefix)
+	}
+	if key.Id == 0 || key.CreatedAt.IsZero() || key.Name != "billing" || !reflect.DeepEqual(key.Scopes, []string{"users:read"}) {
+		t.Errorf("Create() key = %+v", key)
+	}
+	if string(key.KeyHash) == secret || strings.Contains(string(key.KeyHash), secret) {
+		t.Error("the secret is stored in the clear")
+	}
+
+	_, other, err := i.Create(ctx, "billing", []string{"users:read"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == secret {
+		t.Error("Create() issued the same secret twice")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	i := New(repo)
+	ctx := context.Background()
+	create := func(expiresAt *time.Time) (int64, string) {
+		t.Helper()
+		key, secret, err := i.Create(ctx, "billing", []string{"users:read"}, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key.Id, secret
+	}
+	_, valid := create(nil)
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	_, expiring := create(&future)
+	_, expired := create(&past)
+	revokedId, revoked := create(nil)
+	if _, err := repo.RevokeAPIKey(ctx, revokedId); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(valid)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"not yet expired", expiring, nil},
+		{"expired", expired, ErrInvalidKey},
+		{"revoked", revoked, ErrInvalidKey},
+		{"tampered", string(tampered), ErrInvalidKey},
+		{"never issued", "uk_000000000000_" + strings.Repeat("A", 43), ErrInvalidKey},
+		{"without the prefix", strings.TrimPrefix(valid, keyPrefix), ErrInvalidKey},
+		{"empty", "", ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := i.Authenticate(ctx, tt.secret)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && key.LastUsedAt == nil {
+				t.Error("Authenticate() did not record the use")
+			}
+		})
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	for _, scope := range Scopes {
+		if !ValidScope(scope) {
+			t.Errorf("ValidScope(%q) = false", scope)
+		}
+	}
+	for _, scope := range []string{"", "users", "users:purge", "USERS:READ", "users:read "} {
+		if ValidScope(scope) {
+			t.Errorf("ValidScope(%q) = true", scope)
+		}
+	}
+}
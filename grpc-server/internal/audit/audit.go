@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"grpc-server/internal/model"
+)
+
+// SystemActor is recorded for mutations that no caller asked for, such as
+// the background purge.
+const SystemActor = "system"
+
+// Redacted replaces secret values in diffs.
+const Redacted = "[REDACTED]"
+
+// Metadata identifies who caused a mutation.
+type Metadata struct {
+	Actor     string
+	RequestId string
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying md.
+func NewContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, contextKey{}, md)
+}
+
+// FromContext returns the Metadata stored in ctx. Without any, the actor is
+// SystemActor.
+func FromContext(ctx context.Context) Metadata {
+	md, ok := ctx.Value(contextKey{}).(Metadata)
+	if !ok || md.Actor == "" {
+		md.Actor = SystemActor
+	}
+	return md
+}
+
+// NewEvent builds the audit event for a mutation of a user from before to
+// after; either may be nil for creates and purges.
+func NewEvent(ctx context.Context, op string, before, after *model.User) model.AuditEvent {
+	md := FromContext(ctx)
+	event := model.AuditEvent{
+		Actor:     md.Actor,
+		Operation: op,
+		Changes:   Diff(before, after),
+		RequestId: md.RequestId,
+	}
+	if after != nil {
+		event.UserId = after.Id
+	} else if before != nil {
+		event.UserId = before.Id
+	}
+	return event
+}
+
+// Diff returns the fields that differ between before and after. Password
+// hashes are never included, only the fact that they changed.
+func Diff(before, after *model.User) map[string]model.FieldChange {
+	b, a := fields(before), fields(after)
+	changes := make(map[string]model.FieldChange)
+	for name := range union(b, a) {
+		bv, bok := b[name]
+		av, aok := a[name]
+		if bok == aok && bv == av {
+			continue
+		}
+		var change model.FieldChange
+		if bok {
+			change.Before = &bv
+		}
+		if aok {
+			change.After = &av
+		}
+		if name == "password" {
+			redact(change.Before)
+			redact(change.After)
+		}
+		changes[name] = change
+	}
+	return changes
+}
+
+// fields flattens the audited fields of a user.
+func fields(user *model.User) map[string]string {
+	if user == nil {
+		return nil
+	}
+	f := map[string]string{
+		"name":     user.Name,
+		"email":    user.Email,
+		"password": user.Password,
+		"status":   user.Status,
+	}
+	if user.EmailVerifiedAt != nil {
+		f["email_verified_at"] = user.EmailVerifiedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if user.DeletedAt != nil {
+		f["deleted_at"] = user.DeletedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if user.Id != 0 {
+		f["id"] = strconv.FormatInt(user.Id, 10)
+	}
+	return f
+}
+
+func union(a, b map[string]string) map[string]struct{} {
+	keys := make(map[string]struct{}, len(a)+len(b))
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+	return keys
+}
+
+func redact(v *string) {
+	if v != nil {
+		*v = Redacted
+	}
+}
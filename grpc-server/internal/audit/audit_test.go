@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"grpc-server/internal/model"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestDiffRedactsPasswords(t *testing.T) {
+	const oldHash, newHash = "$argon2id$v=19$m=65536,t=3,p=2$b2xk$b2xk", "$argon2id$v=19$m=65536,t=3,p=2$bmV3$bmV3"
+	user := func(password string) *model.User {
+		return &model.User{Id: 1, Name: "John", Email: "john@example.com", Password: password, Status: model.StatusActive}
+	}
+	tests := []struct {
+		name          string
+		before, after *model.User
+		wantPassword  *model.FieldChange
+	}{
+		{"create", nil, user(newHash), &model.FieldChange{After: ptr(Redacted)}},
+		{"password change", user(oldHash), user(newHash), &model.FieldChange{Before: ptr(Redacted), After: ptr(Redacted)}},
+		{"purge", user(oldHash), nil, &model.FieldChange{Before: ptr(Redacted)}},
+		{"other change", user(oldHash), &model.User{Id: 1, Name: "Johnny", Email: "john@example.com", Password: oldHash, Status: model.StatusActive}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := Diff(tt.before, tt.after)
+			got, ok := changes["password"]
+			switch {
+			case tt.wantPassword == nil && ok:
+				t.Errorf("unchanged password is in the diff: %+v", got)
+			case tt.wantPassword != nil && !reflect.DeepEqual(got, *tt.wantPassword):
+				t.Errorf("password change = %+v, want %+v", got, *tt.wantPassword)
+			}
+			stored, err := json.Marshal(NewEvent(context.Background(), model.OpUpdate, tt.before, tt.after))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(stored), "argon2id") {
+				t.Errorf("stored event holds a password hash: %s", stored)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestInterceptorTrust(t *testing.T) {
+	md := metadata.Pairs(ActorKey, "user:7", RequestIdKey, "req-1")
+	tests := []struct {
+		name          string
+		trusted       bool
+		md            metadata.MD
+		wantActor     string
+		wantRequestId string
+	}{
+		{"trusted caller", true, md, "user:7", "req-1"},
+		{"untrusted caller", false, md, "unknown", ""},
+		{"trusted caller without metadata", true, nil, "unknown", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+			var got Metadata
+			trusted := func(context.Context) bool { return tt.trusted }
+			_, err := UnaryServerInterceptor(trusted)(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+				got = FromContext(ctx)
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Actor != tt.wantActor {
+				t.Errorf("actor = %q, want %q", got.Actor, tt.wantActor)
+			}
+			if tt.wantRequestId != "" {
+				if got.RequestId != tt.wantRequestId {
+					t.Errorf("request id = %q, want %q", got.RequestId, tt.wantRequestId)
+				}
+			} else if got.RequestId == "" || got.RequestId == "req-1" {
+				t.Errorf("request id = %q, want a generated one", got.RequestId)
+			}
+		})
+	}
+}
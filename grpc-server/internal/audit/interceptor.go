@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys read from incoming calls.
+const (
+	ActorKey     = "x-actor"
+	RequestIdKey = "x-request-id"
+)
+
+// UnaryServerInterceptor stores the caller's "x-actor" and "x-request-id"
+// metadata in the context for NewEvent. The metadata is only believed from
+// callers for which trusted returns true, such as the HTTP gateway, which
+// authenticates users before naming them; other calls are recorded with the
+// actor "unknown". Calls without a request id get a generated one.
+func UnaryServerInterceptor(trusted func(ctx context.Context) bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(contextFromMetadata(ctx, trusted(ctx)), req)
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of
+// UnaryServerInterceptor.
+func StreamServerInterceptor(trusted func(ctx context.Context) bool) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		return handler(srv, &serverStream{ServerStream: ss, ctx: contextFromMetadata(ctx, trusted(ctx))})
+	}
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func contextFromMetadata(ctx context.Context, trusted bool) context.Context {
+	var m Metadata
+	if md, ok := metadata.FromIncomingContext(ctx); ok && trusted {
+		m.Actor = first(md.Get(ActorKey))
+		m.RequestId = first(md.Get(RequestIdKey))
+	}
+	if m.Actor == "" {
+		m.Actor = "unknown"
+	}
+	if m.RequestId == "" {
+		m.RequestId = newRequestId()
+	}
+	return NewContext(ctx, m)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
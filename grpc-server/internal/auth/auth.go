@@ -0,0 +1,190 @@
+// Package auth authenticates users by email and password and issues the
+// tokens that prove it.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+
+	"grpc-server/internal/model"
+	"grpc-server/internal/password"
+	"grpc-server/internal/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults for Config.
+const (
+	DefaultIssuer     = "grpc-server"
+	DefaultAudience   = "users-api"
+	DefaultAccessTTL  = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// ErrInvalidCredentials is returned when the email and password do not
+// match an active user. It does not tell which of them was wrong.
+var ErrInvalidCredentials = errors.New("auth: invalid email or password")
+
+// ErrInvalidRefreshToken is returned for refresh tokens that were never
+// issued, have expired, were already used or belong to a user who can no
+// longer log in.
+var ErrInvalidRefreshToken = errors.New("auth: invalid refresh token")
+
+// refreshTokenSize is the number of random bytes in a refresh token.
+const refreshTokenSize = 32
+
+// Config configures an Authenticator.
+type Config struct {
+	Issuer     string
+	Audience   string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// Claims are the claims of an access token. The subject is the user id.
+type Claims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// Tokens are issued on login and refresh.
+type Tokens struct {
+	// AccessToken is a JWT signed with the SigningKey, valid for
+	// Config.AccessTTL.
+	AccessToken string
+	ExpiresIn   time.Duration
+	// RefreshToken is an opaque token that can be exchanged once for new
+	// Tokens within Config.RefreshTTL. Only its SHA-256 hash is stored.
+	RefreshToken string
+}
+
+// Authenticator logs users in.
+type Authenticator struct {
+	repo   repository.UserRepository
+	hasher *password.Hasher
+	key    *SigningKey
+	cfg    Config
+	// dummy is verified against when no user has the email, so unknown
+	// emails take as long to reject as wrong passwords.
+	dummy string
+}
+
+// New returns an Authenticator signing access tokens with key.
+func New(repo repository.UserRepository, hasher *password.Hasher, key *SigningKey, cfg Config) (*Authenticator, error) {
+	dummy, err := hasher.Hash("dummy password")
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{repo: repo, hasher: hasher, key: key, cfg: cfg, dummy: dummy}, nil
+}
+
+// Login checks email and password, records the login and returns the user
+// with new tokens. Hashes made with other parameters are upgraded on the way.
+func (a *Authenticator) Login(ctx context.Context, email, plain string) (*model.User, Tokens, error) {
+	user, err := a.repo.GetByEmail(ctx, email)
+	if errors.Is(err, repository.ErrNotFound) {
+		a.hasher.Verify(plain, a.dummy)
+		return nil, Tokens{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, Tokens{}, err
+	}
+	ok, err := a.hasher.Verify(plain, user.Password)
+	if err != nil && !errors.Is(err, password.ErrUnknownFormat) {
+		return nil, Tokens{}, err
+	}
+	if !ok || user.Status != model.StatusActive {
+		return nil, Tokens{}, ErrInvalidCredentials
+	}
+
+	var rehashed string
+	if a.hasher.NeedsRehash(user.Password) {
+		if rehashed, err = a.hasher.Hash(plain); err != nil {
+			return nil, Tokens{}, err
+		}
+	}
+	if user, err = a.repo.RecordLogin(ctx, user.Id, rehashed); err != nil {
+		return nil, Tokens{}, err
+	}
+	tokens, err := a.issue(ctx, user)
+	if err != nil {
+		return nil, Tokens{}, err
+	}
+	return user, tokens, nil
+}
+
+// Refresh exchanges a refresh token for new tokens. The old refresh token
+// can not be used again.
+func (a *Authenticator) Refresh(ctx context.Context, refreshToken string) (*model.User, Tokens, error) {
+	userId, err := a.repo.UseRefreshToken(ctx, hash(refreshToken))
+	if errors.Is(err, repository.ErrRefreshTokenNotFound) {
+		return nil, Tokens{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, Tokens{}, err
+	}
+	user, err := a.repo.Get(ctx, userId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, Tokens{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, Tokens{}, err
+	}
+	if user.Status != model.StatusActive {
+		return nil, Tokens{}, ErrInvalidRefreshToken
+	}
+	tokens, err := a.issue(ctx, user)
+	if err != nil {
+		return nil, Tokens{}, err
+	}
+	return user, tokens, nil
+}
+
+func (a *Authenticator) issue(ctx context.Context, user *model.User) (Tokens, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return Tokens{}, err
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(a.key.Method, Claims{
+		Email: user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    a.cfg.Issuer,
+			Subject:   strconv.FormatInt(user.Id, 10),
+			Audience:  jwt.ClaimStrings{a.cfg.Audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(a.cfg.AccessTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        base64.RawURLEncoding.EncodeToString(jti),
+		},
+	})
+	token.Header["kid"] = a.key.Id
+	access, err := token.SignedString(a.key.Key)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	raw := make([]byte, refreshTokenSize)
+	if _, err := rand.Read(raw); err != nil {
+		return Tokens{}, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(raw)
+	err = a.repo.SaveRefreshToken(ctx, model.RefreshToken{
+		UserId:    user.Id,
+		TokenHash: hash(refresh),
+		ExpiresAt: now.Add(a.cfg.RefreshTTL),
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{AccessToken: access, ExpiresIn: a.cfg.AccessTTL, RefreshToken: refresh}, nil
+}
+
+func hash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"grpc-server/internal/model"
+	"grpc-server/internal/password"
+	"grpc-server/internal/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testConfig = Config{
+	Issuer:     DefaultIssuer,
+	Audience:   DefaultAudience,
+	AccessTTL:  DefaultAccessTTL,
+	RefreshTTL: DefaultRefreshTTL,
+}
+
+// newTestAuthenticator returns an Authenticator over a memory repository
+// holding an active user john@example.com and a disabled user
+// jane@example.com, both with the password "secret".
+func newTestAuthenticator(t *testing.T) (*Authenticator, repository.UserRepository) {
+	t.Helper()
+	repo := repository.NewMemoryUserRepository()
+	hasher := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	hash, err := hasher.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*model.User{
+		{Name: "John", Email: "john@example.com", Password: hash, Status: model.StatusActive},
+		{Name: "Jane", Email: "jane@example.com", Password: hash, Status: model.StatusDisabled},
+	} {
+		if err := repo.Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := New(repo, hasher, writeKey(t, "PRIVATE KEY", ed25519Key(t)), testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, repo
+}
+
+func ed25519Key(t *testing.T) []byte {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// writeKey writes a PEM block to a temporary file and loads it.
+func writeKey(t *testing.T, blockType string, der []byte) *SigningKey {
+	t.Helper()
+	key, err := LoadSigningKey(writePEM(t, blockType, der))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}{
+		{"valid credentials", "john@example.com", "secret", nil},
+		{"email in another case", "JOHN@example.com", "secret", nil},
+		{"wrong password", "john@example.com", "wrong", ErrInvalidCredentials},
+		{"unknown email", "nobody@example.com", "secret", ErrInvalidCredentials},
+		{"disabled user", "jane@example.com", "secret", ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAuthenticator(t)
+			user, tokens, err := a.Login(context.Background(), tt.email, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if user.LastLoginAt == nil {
+				t.Error("Login() did not record the login")
+			}
+			claims := parse(t, a.key, tokens.AccessToken)
+			if claims.Subject != "1" || claims.Email != "john@example.com" {
+				t.Errorf("access token claims = %+v", claims)
+			}
+			if tokens.RefreshToken == "" || tokens.ExpiresIn != DefaultAccessTTL {
+				t.Errorf("Login() tokens = %+v", tokens)
+			}
+		})
+	}
+}
+
+// parse verifies an access token with the public half of key, the way the
+// gateway does, and returns its claims.
+func parse(t *testing.T, key *SigningKey, token string) *Claims {
+	t.Helper()
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != key.Id {
+			t.Errorf("kid = %v, want %s", token.Header["kid"], key.Id)
+		}
+		return key.Key.Public(), nil
+	},
+		jwt.WithValidMethods([]string{key.Method.Alg()}),
+		jwt.WithIssuer(DefaultIssuer),
+		jwt.WithAudience(DefaultAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		t.Fatalf("access token does not verify: %v", err)
+	}
+	return claims
+}
+
+func TestLoginUpgradesBcrypt(t *testing.T) {
+	a, repo := newTestAuthenticator(t)
+	ctx := context.Background()
+	old, _ := bcrypt.GenerateFromPassword([]byte("legacy"), bcrypt.MinCost)
+	if _, err := repo.RecordLogin(ctx, 1, string(old)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Login(ctx, "john@example.com", "legacy"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := repo.Get(ctx, 1)
+	if a.hasher.NeedsRehash(stored.Password) {
+		t.Errorf("password was not rehashed: %s", stored.Password)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	a, repo := newTestAuthenticator(t)
+	ctx := context.Background()
+	_, tokens, err := a.Login(ctx, "john@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, refreshed, err := a.Refresh(ctx, tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Id != 1 || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Errorf("Refresh() = %+v, %+v", user, refreshed)
+	}
+	parse(t, a.key, refreshed.AccessToken)
+
+	if _, _, err := a.Refresh(ctx, tokens.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("reusing a refresh token: error = %v, want ErrInvalidRefreshToken", err)
+	}
+	if _, _, err := a.Refresh(ctx, "never issued"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("unknown refresh token: error = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	disabled := model.StatusDisabled
+	if _, err := repo.Patch(ctx, 1, 0, repository.UserPatch{Status: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Refresh(ctx, refreshed.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("refresh for a disabled user: error = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p256DER, _ := x509.MarshalECPrivateKey(p256)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p384DER, _ := x509.MarshalECPrivateKey(p384)
+	rsa2048, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsa1024, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	tests := []struct {
+		name      string
+		blockType string
+		der       []byte
+		wantAlg   string
+	}{
+		{"Ed25519", "PRIVATE KEY", ed25519Key(t), "EdDSA"},
+		{"P-256", "EC PRIVATE KEY", p256DER, "ES256"},
+		{"RSA 2048", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsa2048), "RS256"},
+		{"P-384", "EC PRIVATE KEY", p384DER, ""},
+		{"RSA 1024", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsa1024), ""},
+		{"public key", "PUBLIC KEY", []byte("irrelevant"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := LoadSigningKey(writePEM(t, tt.blockType, tt.der))
+			if tt.wantAlg == "" {
+				if err == nil {
+					t.Error("LoadSigningKey() accepted the key")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Method.Alg() != tt.wantAlg {
+				t.Errorf("LoadSigningKey() method = %s, want %s", key.Method.Alg(), tt.wantAlg)
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p256DER, _ := x509.MarshalECPrivateKey(p256)
+	rsa2048, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys := []*SigningKey{
+		writeKey(t, "PRIVATE KEY", ed25519Key(t)),
+		writeKey(t, "EC PRIVATE KEY", p256DER),
+		writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsa2048)),
+	}
+	data, err := JWKS(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != len(keys) {
+		t.Fatalf("JWKS() has %d keys, want %d", len(set.Keys), len(keys))
+	}
+	for i, jwk := range set.Keys {
+		if jwk.Kid != keys[i].Id || jwk.Alg != keys[i].Method.Alg() || jwk.Use != "sig" {
+			t.Errorf("key %d = %+v", i, jwk)
+		}
+		if pub := publicKey(t, jwk); !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(keys[i].Key.Public()) {
+			t.Errorf("key %d does not hold the public key", i)
+		}
+	}
+}
+
+// publicKey decodes a JWK produced by JWKS.
+func publicKey(t *testing.T, jwk JWK) crypto.PublicKey {
+	t.Helper()
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	switch jwk.Kty {
+	case "OKP":
+		return ed25519.PublicKey(decode(jwk.X))
+	case "EC":
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(decode(jwk.X)), Y: new(big.Int).SetBytes(decode(jwk.Y))}
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode(jwk.N)), E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64())}
+	}
+	t.Fatalf("unexpected key type %q", jwk.Kty)
+	return nil
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS returns the JSON Web Key Set holding the public halves of keys, for
+// services that verify access tokens.
+func JWKS(keys ...*SigningKey) ([]byte, error) {
+	set := struct {
+		Keys []JWK `json:"keys"`
+	}{Keys: []JWK{}}
+	for _, k := range keys {
+		jwk := JWK{Kid: k.Id, Alg: k.Method.Alg(), Use: "sig"}
+		switch pub := k.Key.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", b64(pub)
+		case *ecdsa.PublicKey:
+			jwk.Kty, jwk.Crv = "EC", "P-256"
+			jwk.X, jwk.Y = b64(pub.X.FillBytes(make([]byte, 32))), b64(pub.Y.FillBytes(make([]byte, 32)))
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N, jwk.E = b64(pub.N.Bytes()), b64(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			return nil, fmt.Errorf("auth: unsupported public key type %T", pub)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return json.MarshalIndent(set, "", "  ")
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is a private key that signs access tokens.
+type SigningKey struct {
+	// Id is sent as the "kid" header of tokens: a hash of the public key,
+	// so verifiers holding several public keys can pick the right one.
+	Id     string
+	Method jwt.SigningMethod
+	Key    crypto.Signer
+}
+
+// LoadSigningKey reads a PEM encoded private key from path. Ed25519 keys
+// sign with EdDSA, P-256 keys with ES256 and RSA keys of at least 2048 bits
+// with RS256.
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("auth: %s: no PEM data", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("auth: %s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: %s: %v", path, err)
+	}
+
+	sk := &SigningKey{}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sk.Method, sk.Key = jwt.SigningMethodEdDSA, k
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("auth: %s: only P-256 ECDSA keys are supported", path)
+		}
+		sk.Method, sk.Key = jwt.SigningMethodES256, k
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("auth: %s: RSA keys must have at least 2048 bits", path)
+		}
+		sk.Method, sk.Key = jwt.SigningMethodRS256, k
+	default:
+		return nil, fmt.Errorf("auth: %s: unsupported key type %T", path, key)
+	}
+	if sk.Id, err = KeyId(sk.Key.Public()); err != nil {
+		return nil, fmt.Errorf("auth: %s: %v", path, err)
+	}
+	return sk, nil
+}
+
+// KeyId returns the id of a public key: the first 16 bytes of the SHA-256
+// of its PKIX encoding, in unpadded base64url.
+func KeyId(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
@@ -0,0 +1,252 @@
+package grpcerr
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"grpc-server/internal/apikey"
+	"grpc-server/internal/auth"
+	"grpc-server/internal/password"
+	"grpc-server/internal/passwordreset"
+	"grpc-server/internal/repository"
+	"grpc-server/internal/verification"
+
+	"github.com/lib/pq"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Domain is reported in every ErrorInfo detail.
+const Domain = "users.grpc-server"
+
+// Reasons reported in ErrorInfo details. Clients can switch on these
+// instead of parsing messages.
+const (
+	ReasonUserNotFound        = "USER_NOT_FOUND"
+	ReasonAlreadyExists       = "ALREADY_EXISTS"
+	ReasonEmailExists         = "EMAIL_ALREADY_EXISTS"
+	ReasonVersionMismatch     = "VERSION_MISMATCH"
+	ReasonInvalidArgument     = "INVALID_ARGUMENT"
+	ReasonRateLimited         = "RATE_LIMITED"
+	ReasonInvalidCredentials  = "INVALID_CREDENTIALS"
+	ReasonInvalidRefreshToken = "INVALID_REFRESH_TOKEN"
+	ReasonAPIKeyNotFound      = "API_KEY_NOT_FOUND"
+	ReasonInvalidAPIKey       = "INVALID_API_KEY"
+	ReasonDatabaseUnavailable = "DATABASE_UNAVAILABLE"
+	ReasonDeadlineExceeded    = "DEADLINE_EXCEEDED"
+	ReasonCanceled            = "CANCELED"
+	ReasonInternal            = "INTERNAL"
+)
+
+// retryDelay is suggested to clients when the database is unavailable.
+const retryDelay = time.Second
+
+// InvalidArgument returns an InvalidArgument error for a single bad field.
+func InvalidArgument(field, description string) error {
+	return newStatus(codes.InvalidArgument, "invalid "+field+": "+description, ReasonInvalidArgument, nil,
+		&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: field, Description: description},
+		}})
+}
+
+// RateLimited returns a ResourceExhausted error suggesting to retry after
+// the given delay.
+func RateLimited(retryAfter time.Duration) error {
+	return newStatus(codes.ResourceExhausted, "too many requests", ReasonRateLimited, nil,
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter.Round(time.Second))})
+}
+
+// UnaryServerInterceptor translates errors returned by unary handlers with
+// FromError.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return nil, FromError(err)
+		}
+		return resp, nil
+	}
+}
+
+// StreamServerInterceptor translates errors returned by streaming handlers
+// with FromError.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return FromError(handler(srv, ss))
+	}
+}
+
+// FromError converts repository and database errors into gRPC status errors
+// carrying google.rpc error details. Errors that already carry a status are
+// returned unchanged; anything unrecognised becomes Internal and is logged,
+// so database internals never reach clients.
+func FromError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		return err
+	}
+
+	var batchErr *repository.BatchError
+	if errors.As(err, &batchErr) {
+		s := status.Convert(FromError(batchErr.Err)).Proto()
+		s.Message = fmt.Sprintf("item %d: %s", batchErr.Index, s.Message)
+		return status.FromProto(s).Err()
+	}
+
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return newStatus(codes.NotFound, "user not found", ReasonUserNotFound, nil,
+			&errdetails.ResourceInfo{ResourceType: "user"})
+	case errors.Is(err, repository.ErrEmailExists):
+		return newStatus(codes.AlreadyExists, "email is already used by another user", ReasonEmailExists,
+			map[string]string{"field": "email"},
+			&errdetails.ResourceInfo{ResourceType: "user", Description: "emails are unique regardless of case"})
+	case errors.Is(err, repository.ErrVersionMismatch):
+		return newStatus(codes.FailedPrecondition, "user was modified by someone else", ReasonVersionMismatch, nil,
+			&errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{
+				{Type: "VERSION", Subject: "user", Description: "version does not match the stored user"},
+			}})
+	case errors.Is(err, repository.ErrInvalidCursor):
+		return InvalidArgument("page_token", "was not issued for this listing")
+	case errors.Is(err, repository.ErrInvalidOrderBy):
+		return InvalidArgument("order_by", "must be id, name, email or created_at, optionally followed by asc or desc")
+	case errors.Is(err, verification.ErrInvalidToken):
+		return InvalidArgument("token", "is invalid, was already used or was replaced by a newer token")
+	case errors.Is(err, verification.ErrExpiredToken):
+		return InvalidArgument("token", "has expired")
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		return newStatus(codes.Unauthenticated, "invalid email or password", ReasonInvalidCredentials, nil)
+	case errors.Is(err, auth.ErrInvalidRefreshToken):
+		return newStatus(codes.Unauthenticated, "invalid refresh token", ReasonInvalidRefreshToken, nil)
+	case errors.Is(err, repository.ErrAPIKeyNotFound):
+		return newStatus(codes.NotFound, "API key not found", ReasonAPIKeyNotFound, nil,
+			&errdetails.ResourceInfo{ResourceType: "api_key"})
+	case errors.Is(err, apikey.ErrInvalidKey):
+		return newStatus(codes.Unauthenticated, "invalid API key", ReasonInvalidAPIKey, nil)
+	case errors.Is(err, passwordreset.ErrInvalidToken):
+		return InvalidArgument("token", "is invalid, has expired or was already used")
+	case errors.Is(err, password.ErrEmpty):
+		return InvalidArgument("password", "must not be empty")
+	case errors.Is(err, context.DeadlineExceeded):
+		return newStatus(codes.DeadlineExceeded, "deadline exceeded", ReasonDeadlineExceeded, nil)
+	case errors.Is(err, context.Canceled):
+		return newStatus(codes.Canceled, "request canceled", ReasonCanceled, nil)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return fromPQError(pqErr)
+	}
+	if isConnectionError(err) {
+		return unavailable(err)
+	}
+
+	log.Printf("Internal error: %v", err)
+	return newStatus(codes.Internal, "internal error", ReasonInternal, nil)
+}
+
+// Reason returns the ErrorInfo reason carried by s, or "" if it has none.
+func Reason(s *status.Status) string {
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+// constraintResource returns the resource type and a readable name for the
+// table a constraint belongs to, which Postgres puts in front of the names it
+// generates.
+func constraintResource(constraint string) (resource, name string) {
+	switch {
+	case strings.HasPrefix(constraint, "users_"):
+		return "user", "user"
+	case strings.HasPrefix(constraint, "api_keys_"):
+		return "api_key", "API key"
+	}
+	return "", "resource"
+}
+
+func fromPQError(err *pq.Error) error {
+	metadata := map[string]string{"sqlstate": string(err.Code)}
+	if err.Constraint != "" {
+		metadata["constraint"] = err.Constraint
+	}
+	if err.Column != "" {
+		metadata["column"] = err.Column
+	}
+
+	switch {
+	case err.Code == "23505": // unique_violation
+		resource, name := constraintResource(err.Constraint)
+		return newStatus(codes.AlreadyExists, name+" already exists", ReasonAlreadyExists, metadata,
+			&errdetails.ResourceInfo{ResourceType: resource, Description: err.Detail})
+	case err.Code == "23502" || err.Code == "23514" || err.Code.Class() == "22":
+		// not_null_violation, check_violation and data exceptions such as
+		// over-long strings are all caused by bad input.
+		field := err.Column
+		if field == "" {
+			field = err.Constraint
+		}
+		return newStatus(codes.InvalidArgument, "invalid user: "+err.Message, ReasonInvalidArgument, metadata,
+			&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: field, Description: err.Message},
+			}})
+	case err.Code == "57014": // query_canceled, raised by statement_timeout
+		return newStatus(codes.DeadlineExceeded, "database query timed out", ReasonDeadlineExceeded, metadata)
+	case err.Code.Class() == "08" || // connection_exception
+		err.Code.Class() == "53" || // insufficient_resources
+		err.Code.Class() == "57": // operator_intervention, e.g. admin_shutdown
+		return unavailable(err)
+	}
+
+	log.Printf("Internal database error: %v", err)
+	return newStatus(codes.Internal, "internal error", ReasonInternal, metadata)
+}
+
+func unavailable(err error) error {
+	log.Printf("Database unavailable: %v", err)
+	return newStatus(codes.Unavailable, "database unavailable", ReasonDatabaseUnavailable, nil,
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)})
+}
+
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// database/sql reports a closed pool as a plain error.
+	return strings.Contains(err.Error(), "sql: database is closed")
+}
+
+// newStatus builds a status error with an ErrorInfo detail followed by extra
+// details.
+func newStatus(code codes.Code, msg, reason string, metadata map[string]string, details ...protoadapt.MessageV1) error {
+	s := status.New(code, msg)
+	all := append([]protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   Domain,
+		Metadata: metadata,
+	}}, details...)
+	withDetails, err := s.WithDetails(all...)
+	if err != nil {
+		return s.Err()
+	}
+	return withDetails.Err()
+}
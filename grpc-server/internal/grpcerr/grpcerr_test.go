@@ -0,0 +1,137 @@
+package grpcerr
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"grpc-server/internal/apikey"
+	"grpc-server/internal/auth"
+	"grpc-server/internal/password"
+	"grpc-server/internal/passwordreset"
+	"grpc-server/internal/repository"
+	"grpc-server/internal/verification"
+
+	"github.com/lib/pq"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFromPQErrorUniqueViolation(t *testing.T) {
+	tests := []struct {
+		constraint   string
+		wantMessage  string
+		wantResource string
+	}{
+		{"users_email_lower_key", "user already exists", "user"},
+		{"users_pkey", "user already exists", "user"},
+		{"api_keys_prefix_key", "API key already exists", "api_key"},
+		{"api_keys_key_hash_key", "API key already exists", "api_key"},
+		{"user_password_resets_token_hash_key", "resource already exists", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			s := status.Convert(FromError(&pq.Error{Code: "23505", Constraint: tt.constraint}))
+			if s.Code() != codes.AlreadyExists || s.Message() != tt.wantMessage || Reason(s) != ReasonAlreadyExists {
+				t.Errorf("FromError() = %v %q %s, want AlreadyExists %q", s.Code(), s.Message(), Reason(s), tt.wantMessage)
+			}
+			for _, detail := range s.Details() {
+				if info, ok := detail.(*errdetails.ResourceInfo); ok && info.ResourceType != tt.wantResource {
+					t.Errorf("resource type = %q, want %q", info.ResourceType, tt.wantResource)
+				}
+			}
+		})
+	}
+}
+
+func TestFromError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   codes.Code
+		wantReason string
+		// wantField is the field of the BadRequest violation, if any.
+		wantField string
+		// wantRetry is the delay of the RetryInfo detail, if any.
+		wantRetry time.Duration
+	}{
+		{"user not found", repository.ErrNotFound, codes.NotFound, ReasonUserNotFound, "", 0},
+		{"wrapped", fmt.Errorf("get user: %w", repository.ErrNotFound), codes.NotFound, ReasonUserNotFound, "", 0},
+		{"email exists", repository.ErrEmailExists, codes.AlreadyExists, ReasonEmailExists, "", 0},
+		{"version mismatch", repository.ErrVersionMismatch, codes.FailedPrecondition, ReasonVersionMismatch, "", 0},
+		{"invalid cursor", repository.ErrInvalidCursor, codes.InvalidArgument, ReasonInvalidArgument, "page_token", 0},
+		{"invalid order", repository.ErrInvalidOrderBy, codes.InvalidArgument, ReasonInvalidArgument, "order_by", 0},
+		{"invalid verification token", verification.ErrInvalidToken, codes.InvalidArgument, ReasonInvalidArgument, "token", 0},
+		{"expired verification token", verification.ErrExpiredToken, codes.InvalidArgument, ReasonInvalidArgument, "token", 0},
+		{"invalid credentials", auth.ErrInvalidCredentials, codes.Unauthenticated, ReasonInvalidCredentials, "", 0},
+		{"invalid refresh token", auth.ErrInvalidRefreshToken, codes.Unauthenticated, ReasonInvalidRefreshToken, "", 0},
+		{"API key not found", repository.ErrAPIKeyNotFound, codes.NotFound, ReasonAPIKeyNotFound, "", 0},
+		{"invalid API key", apikey.ErrInvalidKey, codes.Unauthenticated, ReasonInvalidAPIKey, "", 0},
+		{"invalid reset token", passwordreset.ErrInvalidToken, codes.InvalidArgument, ReasonInvalidArgument, "token", 0},
+		{"empty password", password.ErrEmpty, codes.InvalidArgument, ReasonInvalidArgument, "password", 0},
+		{"deadline exceeded", context.DeadlineExceeded, codes.DeadlineExceeded, ReasonDeadlineExceeded, "", 0},
+		{"canceled", context.Canceled, codes.Canceled, ReasonCanceled, "", 0},
+		{"not null violation", &pq.Error{Code: "23502", Column: "name"}, codes.InvalidArgument, ReasonInvalidArgument, "name", 0},
+		{"check violation", &pq.Error{Code: "23514", Constraint: "users_status_check"}, codes.InvalidArgument, ReasonInvalidArgument, "users_status_check", 0},
+		{"statement timeout", &pq.Error{Code: "57014"}, codes.DeadlineExceeded, ReasonDeadlineExceeded, "", 0},
+		{"connection failure", &pq.Error{Code: "08006"}, codes.Unavailable, ReasonDatabaseUnavailable, "", time.Second},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, codes.Unavailable, ReasonDatabaseUnavailable, "", time.Second},
+		{"bad connection", driver.ErrBadConn, codes.Unavailable, ReasonDatabaseUnavailable, "", time.Second},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, codes.Unavailable, ReasonDatabaseUnavailable, "", time.Second},
+		{"other database error", &pq.Error{Code: "42P01"}, codes.Internal, ReasonInternal, "", 0},
+		{"unknown", errors.New("boom"), codes.Internal, ReasonInternal, "", 0},
+		{"rate limited", RateLimited(1500 * time.Millisecond), codes.ResourceExhausted, ReasonRateLimited, "", 2 * time.Second},
+		{"invalid argument", InvalidArgument("name", "must not be empty"), codes.InvalidArgument, ReasonInvalidArgument, "name", 0},
+		{"status", status.Error(codes.PermissionDenied, "admins only"), codes.PermissionDenied, "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := status.Convert(FromError(tt.err))
+			if s.Code() != tt.wantCode || Reason(s) != tt.wantReason {
+				t.Errorf("FromError() = %v %s, want %v %s", s.Code(), Reason(s), tt.wantCode, tt.wantReason)
+			}
+			var field string
+			var retry time.Duration
+			for _, detail := range s.Details() {
+				switch d := detail.(type) {
+				case *errdetails.ErrorInfo:
+					if d.Domain != Domain {
+						t.Errorf("ErrorInfo domain = %q, want %q", d.Domain, Domain)
+					}
+				case *errdetails.BadRequest:
+					if len(d.FieldViolations) != 1 {
+						t.Fatalf("field violations = %v, want one", d.FieldViolations)
+					}
+					field = d.FieldViolations[0].Field
+				case *errdetails.RetryInfo:
+					retry = d.RetryDelay.AsDuration()
+				}
+			}
+			if field != tt.wantField {
+				t.Errorf("BadRequest field = %q, want %q", field, tt.wantField)
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("RetryInfo delay = %v, want %v", retry, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestFromErrorBatchError(t *testing.T) {
+	err := &repository.BatchError{Index: 3, Err: repository.ErrEmailExists}
+	s := status.Convert(FromError(fmt.Errorf("create users: %w", err)))
+	if s.Code() != codes.AlreadyExists || Reason(s) != ReasonEmailExists || s.Message() != "item 3: email is already used by another user" {
+		t.Errorf("FromError() = %v %s %q", s.Code(), Reason(s), s.Message())
+	}
+}
+
+func TestFromErrorNil(t *testing.T) {
+	if err := FromError(nil); err != nil {
+		t.Errorf("FromError(nil) = %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Package importer validates and creates users in bulk.
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"grpc-server/internal/model"
+	"grpc-server/internal/password"
+	"grpc-server/internal/repository"
+)
+
+// BatchSize is the number of valid rows written per transaction.
+const BatchSize = 1000
+
+// Row is one user to import.
+type Row struct {
+	Row          int64 // position in the source, used in errors
+	Name         string
+	Email        string
+	Password     string
+	PasswordHash string // an existing hash, used instead of Password
+	Status       string
+}
+
+// RowError explains why a row was not imported.
+type RowError struct {
+	Row     int64
+	Field   string
+	Message string
+}
+
+// Report summarizes an import.
+type Report struct {
+	Rows     int64 // rows added
+	Imported int64 // users created, or that would have been in a dry run
+	Errors   []RowError
+}
+
+// Importer validates rows and creates users from them in batches. Rows that
+// are invalid or repeat the email of an earlier row or of an existing user
+// are skipped and reported.
+type Importer struct {
+	repo   repository.UserRepository
+	hasher *password.Hasher
+	dryRun bool
+
+	seen    map[string]int64 // lower-cased email to the row first using it
+	pending []Row
+	report  Report
+}
+
+// New returns an Importer creating users in repo. With dryRun, rows are
+// validated but no users are created.
+func New(repo repository.UserRepository, hasher *password.Hasher, dryRun bool) *Importer {
+	return &Importer{
+		repo:   repo,
+		hasher: hasher,
+		dryRun: dryRun,
+		seen:   make(map[string]int64),
+	}
+}
+
+// Add validates row and queues it, writing a batch once BatchSize rows are
+// queued. A zero row.Row is replaced by the row's position, starting at 1.
+func (im *Importer) Add(ctx context.Context, row Row) error {
+	im.report.Rows++
+	if row.Row == 0 {
+		row.Row = im.report.Rows
+	}
+	row.Email = model.NormalizeEmail(row.Email)
+	if field, msg := validate(row); field != "" {
+		im.fail(row, field, msg)
+		return nil
+	}
+	key := strings.ToLower(row.Email)
+	if first, ok := im.seen[key]; ok {
+		im.fail(row, "email", fmt.Sprintf("duplicates the email of row %d", first))
+		return nil
+	}
+	im.seen[key] = row.Row
+	im.pending = append(im.pending, row)
+	if len(im.pending) >= BatchSize {
+		return im.flush(ctx)
+	}
+	return nil
+}
+
+// Close writes the remaining rows and returns the report.
+func (im *Importer) Close(ctx context.Context) (Report, error) {
+	if err := im.flush(ctx); err != nil {
+		return im.report, err
+	}
+	return im.report, nil
+}
+
+func validate(row Row) (field, msg string) {
+	switch {
+	case strings.TrimSpace(row.Name) == "":
+		return "name", "must not be empty"
+	case row.Email == "":
+		return "email", "must not be empty"
+	case !validEmail(row.Email):
+		return "email", "is not a valid email address"
+	case row.Status != "" && !model.ValidStatus(row.Status):
+		return "status", "must be active or disabled"
+	case row.Password == "" && row.PasswordHash == "":
+		return "password", "either password or password_hash must be set"
+	case row.Password != "" && row.PasswordHash != "":
+		return "password", "only one of password and password_hash may be set"
+	case row.PasswordHash != "" && !password.IsHash(row.PasswordHash):
+		return "password_hash", "must be an argon2id or bcrypt hash"
+	}
+	return "", ""
+}
+
+// validEmail accepts a bare address such as "jane@example.com".
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+func (im *Importer) fail(row Row, field, msg string) {
+	im.report.Errors = append(im.report.Errors, RowError{Row: row.Row, Field: field, Message: msg})
+}
+
+// flush creates the users of the pending rows.
+func (im *Importer) flush(ctx context.Context) error {
+	if len(im.pending) == 0 {
+		return nil
+	}
+	users := make([]*model.User, len(im.pending))
+	for i, row := range im.pending {
+		users[i] = &model.User{Name: row.Name, Email: row.Email, Password: row.PasswordHash, Status: row.Status}
+		// A dry run writes nothing, so hashing would only waste time.
+		if row.Password != "" && !im.dryRun {
+			hash, err := im.hasher.Hash(row.Password)
+			if err != nil {
+				return err
+			}
+			users[i].Password = hash
+		} else if row.Password != "" {
+			users[i].Password = "dry-run"
+		}
+	}
+	errs, err := im.repo.Import(ctx, users, im.dryRun)
+	if err != nil {
+		return err
+	}
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			im.report.Imported++
+		case errors.Is(err, repository.ErrEmailExists):
+			im.fail(im.pending[i], "email", "is already used by another user")
+		default:
+			im.fail(im.pending[i], "", err.Error())
+		}
+	}
+	im.pending = im.pending[:0]
+	return nil
+}
@@ -0,0 +1,141 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"grpc-server/internal/model"
+	"grpc-server/internal/password"
+	"grpc-server/internal/repository"
+)
+
+// hash is a well-formed bcrypt hash.
+const hash = "$2a$04$4r9rFJcVBNsSp0Ug1H/DvOHjZN7NRvAGWTMGE3JBkq.iZQ2K3lhKa"
+
+// countingRepository records the size of each Import call.
+type countingRepository struct {
+	repository.UserRepository
+	batches []int
+	dryRuns []bool
+}
+
+func (r *countingRepository) Import(ctx context.Context, users []*model.User, dryRun bool) ([]error, error) {
+	r.batches = append(r.batches, len(users))
+	r.dryRuns = append(r.dryRuns, dryRun)
+	return r.UserRepository.Import(ctx, users, dryRun)
+}
+
+func newTestImporter(t *testing.T, dryRun bool) (*Importer, *countingRepository) {
+	t.Helper()
+	repo := &countingRepository{UserRepository: repository.NewMemoryUserRepository()}
+	err := repo.Create(context.Background(), &model.User{Name: "John", Email: "john@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	return New(repo, hasher, dryRun), repo
+}
+
+func importRows(t *testing.T, im *Importer, rows ...Row) Report {
+	t.Helper()
+	ctx := context.Background()
+	for _, row := range rows {
+		if err := im.Add(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := im.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestImportValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		row       Row
+		wantField string
+	}{
+		{"valid", Row{Name: "Jane", Email: "jane@example.com", Password: "secret"}, ""},
+		{"existing hash", Row{Name: "Jane", Email: "jane@example.com", PasswordHash: hash, Status: model.StatusDisabled}, ""},
+		{"empty name", Row{Name: " ", Email: "jane@example.com", Password: "secret"}, "name"},
+		{"empty email", Row{Name: "Jane", Password: "secret"}, "email"},
+		{"invalid email", Row{Name: "Jane", Email: "Jane <jane@example.com>", Password: "secret"}, "email"},
+		{"unknown status", Row{Name: "Jane", Email: "jane@example.com", Password: "secret", Status: "banned"}, "status"},
+		{"no password", Row{Name: "Jane", Email: "jane@example.com"}, "password"},
+		{"password and hash", Row{Name: "Jane", Email: "jane@example.com", Password: "secret", PasswordHash: hash}, "password"},
+		{"not a hash", Row{Name: "Jane", Email: "jane@example.com", PasswordHash: "secret"}, "password_hash"},
+		{"existing user", Row{Name: "John", Email: "JOHN@example.com", Password: "secret"}, "email"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, repo := newTestImporter(t, false)
+			report := importRows(t, im, tt.row)
+			if tt.wantField == "" {
+				if report.Imported != 1 || len(report.Errors) != 0 {
+					t.Errorf("report = %+v, want the row imported", report)
+				}
+				if _, err := repo.GetByEmail(context.Background(), tt.row.Email); err != nil {
+					t.Errorf("imported user: GetByEmail() error = %v", err)
+				}
+				return
+			}
+			if report.Imported != 0 || len(report.Errors) != 1 || report.Errors[0].Row != 1 || report.Errors[0].Field != tt.wantField {
+				t.Errorf("report = %+v, want an error for field %q of row 1", report, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestImportDuplicateRows(t *testing.T) {
+	im, _ := newTestImporter(t, false)
+	report := importRows(t, im,
+		Row{Name: "Jane", Email: "jane@example.com", Password: "secret"},
+		Row{Name: "Jane", Email: "jane@EXAMPLE.com", Password: "secret"},
+		Row{Row: 42, Name: "Bob", Email: "bob@example.com", Password: "secret"},
+	)
+	want := Report{Rows: 3, Imported: 2, Errors: []RowError{{Row: 2, Field: "email", Message: "duplicates the email of row 1"}}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+}
+
+func TestImportBatches(t *testing.T) {
+	im, repo := newTestImporter(t, false)
+	rows := make([]Row, 2*BatchSize+1)
+	for i := range rows {
+		// An existing hash spares hashing thousands of passwords.
+		rows[i] = Row{Name: "User", Email: fmt.Sprintf("user%d@example.com", i), PasswordHash: hash}
+	}
+	rows[BatchSize+5].Email = "invalid"
+	report := importRows(t, im, rows...)
+	if report.Rows != int64(len(rows)) || report.Imported != int64(len(rows)-1) || len(report.Errors) != 1 {
+		t.Errorf("report = %+v", report)
+	}
+	// Invalid rows do not count towards a batch.
+	if want := []int{BatchSize, BatchSize}; !reflect.DeepEqual(repo.batches, want) {
+		t.Errorf("batches = %v, want %v", repo.batches, want)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	im, repo := newTestImporter(t, true)
+	report := importRows(t, im,
+		Row{Name: "Jane", Email: "jane@example.com", Password: "secret"},
+		Row{Name: "John", Email: "john@example.com", Password: "secret"},
+		Row{Name: "", Email: "bob@example.com", Password: "secret"},
+	)
+	if report.Imported != 1 || len(report.Errors) != 2 {
+		t.Errorf("report = %+v, want one row importable", report)
+	}
+	if !reflect.DeepEqual(repo.dryRuns, []bool{true}) {
+		t.Errorf("Import() dry runs = %v, want [true]", repo.dryRuns)
+	}
+	if _, err := repo.GetByEmail(context.Background(), "jane@example.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetByEmail() after a dry run error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Package mailer sends emails to users.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// WriterMailer writes each message to w instead of sending it. It is meant
+// for local development.
+type WriterMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterMailer returns a Mailer writing to w.
+func NewWriterMailer(w io.Writer) *WriterMailer {
+	return &WriterMailer{w: w}
+}
+
+// NewFileMailer returns a Mailer appending to the file at path, which is
+// created if needed.
+func NewFileMailer(path string) (*WriterMailer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterMailer(f), nil
+}
+
+func (m *WriterMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "To: %s\nSubject: %s\n\n%s\n\n", msg.To, msg.Subject, msg.Body)
+	return err
+}
+
+// SMTPMailer sends messages through an SMTP server, using STARTTLS when the
+// server offers it.
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth // nil to send without authenticating
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", m.From)
+	fmt.Fprintf(&body, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&body, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	// smtp.SendMail takes no context; dialing by hand lets ctx bound the
+	// whole exchange.
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(m.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.Auth != nil {
+		if err := c.Auth(m.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// New returns the Mailer named by spec: "stdout", "file:<path>" or
+// "smtp://[user:password@]host:port?from=<address>".
+func New(spec string) (Mailer, error) {
+	switch {
+	case spec == "stdout":
+		return NewWriterMailer(os.Stdout), nil
+	case strings.HasPrefix(spec, "file:"):
+		return NewFileMailer(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "smtp://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("mailer: %v", err)
+		}
+		m := &SMTPMailer{Addr: u.Host, From: u.Query().Get("from")}
+		if m.From == "" {
+			return nil, fmt.Errorf("mailer: %q has no from address", spec)
+		}
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			m.Auth = smtp.PlainAuth("", u.User.Username(), pass, u.Hostname())
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown mailer %q", spec)
+	}
+}
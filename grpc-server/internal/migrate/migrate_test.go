@@ -0,0 +1,295 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0010_add_b.up.sql":      {Data: []byte("up 10")},
+		"migrations/0002_add_a.up.sql":      {Data: []byte("up 2")},
+		"migrations/0002_add_a.down.sql":    {Data: []byte("down 2")},
+		"migrations/0001_create_x.up.sql":   {Data: []byte("up 1")},
+		"migrations/0010_add_b.down.sql":    {Data: []byte("down 10")},
+		"migrations/0001_create_x.down.sql": {Data: []byte("down 1")},
+	}
+	got, err := load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Migration{
+		{Version: 1, Name: "create_x", Up: "up 1", Down: "down 1"},
+		{Version: 2, Name: "add_a", Up: "up 2", Down: "down 2"},
+		{Version: 10, Name: "add_b", Up: "up 10", Down: "down 10"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("load() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"not SQL", "migrations/0001_create_x.txt"},
+		{"no direction", "migrations/0001_create_x.sql"},
+		{"bad version", "migrations/first_create_x.up.sql"},
+		{"down only", "migrations/0001_create_x.down.sql"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := load(fstest.MapFS{tt.file: {Data: []byte("SELECT 1")}}); err == nil {
+				t.Errorf("load() accepted %s", tt.file)
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration %d_%s, want version %d", m.Version, m.Name, i+1)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %d_%s has no down migration", m.Version, m.Name)
+		}
+	}
+}
+
+// fakeDB is a database/sql driver that records the statements run on it.
+// It answers queries of schema_migrations from applied and fails the
+// statement fail.
+type fakeDB struct {
+	mu      sync.Mutex
+	log     []string
+	applied map[int64]time.Time
+	fail    string
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db}, nil
+}
+
+func (db *fakeDB) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakeDB: Prepare is not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN")
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.record("COMMIT")
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.record("ROLLBACK")
+	return nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query = c.db.record(query)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	switch {
+	case query == c.db.fail:
+		return nil, errors.New("syntax error")
+	case strings.HasPrefix(query, "INSERT INTO schema_migrations"):
+		c.db.applied[args[0].Value.(int64)] = time.Now()
+	case strings.HasPrefix(query, "DELETE FROM schema_migrations"):
+		delete(c.db.applied, args[0].Value.(int64))
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	rows := &fakeRows{}
+	for version, at := range c.db.applied {
+		rows.values = append(rows.values, []driver.Value{version, at})
+	}
+	return rows, nil
+}
+
+// record logs query with its whitespace collapsed and returns it.
+func (db *fakeDB) record(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS schema_migrations") {
+		db.log = append(db.log, "CREATE schema_migrations")
+	} else {
+		db.log = append(db.log, query)
+	}
+	return query
+}
+
+type fakeRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"version", "applied_at"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "create_x", Up: "CREATE x", Down: "DROP x"},
+	{Version: 2, Name: "add_a", Up: "ADD a", Down: "DROP a"},
+	{Version: 3, Name: "add_b", Up: "ADD b"},
+}
+
+func newTestMigrator(applied ...int64) (*Migrator, *fakeDB) {
+	db := &fakeDB{applied: make(map[int64]time.Time)}
+	for _, v := range applied {
+		db.applied[v] = time.Now()
+	}
+	return &Migrator{db: sqlx.NewDb(sql.OpenDB(db), "postgres"), migrations: testMigrations}, db
+}
+
+func (db *fakeDB) versions() []int64 {
+	var versions []int64
+	for v := range db.applied {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+const (
+	lock   = "SELECT pg_advisory_lock($1)"
+	unlock = "SELECT pg_advisory_unlock($1)"
+	create = "CREATE schema_migrations"
+	query  = "SELECT version, applied_at FROM schema_migrations"
+	insert = "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+	remove = "DELETE FROM schema_migrations WHERE version=$1"
+)
+
+func TestUp(t *testing.T) {
+	m, db := newTestMigrator(1)
+	applied, err := m.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Version != 2 || applied[1].Version != 3 {
+		t.Errorf("Up() applied %+v, want versions 2 and 3", applied)
+	}
+	// Everything happens under the lock, each migration in its own
+	// transaction, and applied ones are skipped.
+	want := []string{lock, create, query,
+		"BEGIN", "ADD a", insert, "COMMIT",
+		"BEGIN", "ADD b", insert, "COMMIT",
+		unlock}
+	if !reflect.DeepEqual(db.log, want) {
+		t.Errorf("statements:\n%q\nwant\n%q", db.log, want)
+	}
+
+	db.log = nil
+	if applied, err := m.Up(context.Background()); err != nil || len(applied) != 0 {
+		t.Errorf("second Up() = %+v, %v; want nothing applied", applied, err)
+	}
+	if want := []string{lock, create, query, unlock}; !reflect.DeepEqual(db.log, want) {
+		t.Errorf("second Up() statements = %q, want %q", db.log, want)
+	}
+}
+
+func TestUpFailure(t *testing.T) {
+	m, db := newTestMigrator()
+	db.fail = "ADD a"
+	applied, err := m.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "applying 2_add_a") {
+		t.Errorf("Up() error = %v, want the failure of 2_add_a", err)
+	}
+	if len(applied) != 1 || !reflect.DeepEqual(db.versions(), []int64{1}) {
+		t.Errorf("Up() applied %+v, recorded %v; want version 1 only", applied, db.versions())
+	}
+	want := []string{lock, create, query,
+		"BEGIN", "CREATE x", insert, "COMMIT",
+		"BEGIN", "ADD a", "ROLLBACK",
+		unlock}
+	if !reflect.DeepEqual(db.log, want) {
+		t.Errorf("statements:\n%q\nwant\n%q", db.log, want)
+	}
+}
+
+func TestDown(t *testing.T) {
+	m, db := newTestMigrator(1, 2)
+	rolledBack, err := m.Down(context.Background())
+	if err != nil || rolledBack == nil || rolledBack.Version != 2 {
+		t.Fatalf("Down() = %+v, %v; want version 2", rolledBack, err)
+	}
+	want := []string{lock, create, query, "BEGIN", "DROP a", remove, "COMMIT", unlock}
+	if !reflect.DeepEqual(db.log, want) {
+		t.Errorf("statements:\n%q\nwant\n%q", db.log, want)
+	}
+
+	m, _ = newTestMigrator(1, 2, 3)
+	if _, err := m.Down(context.Background()); err == nil {
+		t.Error("Down() rolled back a migration without a down migration")
+	}
+	m, _ = newTestMigrator()
+	if rolledBack, err := m.Down(context.Background()); rolledBack != nil || err != nil {
+		t.Errorf("Down() of an empty database = %+v, %v", rolledBack, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m, _ := newTestMigrator(2)
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []bool
+	for _, s := range statuses {
+		applied = append(applied, s.AppliedAt != nil)
+	}
+	if want := []bool{false, true, false}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied = %v, want %v", applied, want)
+	}
+}
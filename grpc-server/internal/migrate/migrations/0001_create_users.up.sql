@@ -0,0 +1,7 @@
+-- IF NOT EXISTS adopts databases that were set up by hand before migrations.
+CREATE TABLE IF NOT EXISTS users (
+    id       BIGSERIAL PRIMARY KEY,
+    name     TEXT NOT NULL,
+    email    TEXT NOT NULL,
+    password TEXT NOT NULL
+);
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS users_status_idx;
+DROP INDEX IF EXISTS users_email_domain_idx;
+DROP INDEX IF EXISTS users_name_prefix_idx;
+DROP INDEX IF EXISTS users_created_at_id_idx;
+DROP INDEX IF EXISTS users_email_id_idx;
+DROP INDEX IF EXISTS users_name_id_idx;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS status;
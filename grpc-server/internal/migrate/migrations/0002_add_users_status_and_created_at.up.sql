@@ -0,0 +1,15 @@
+-- IF NOT EXISTS, like 0001, adopts databases that already have the columns.
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+        CONSTRAINT users_status_check CHECK (status IN ('active', 'disabled')),
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Every sortable column is indexed together with id, the keyset tie-breaker.
+CREATE INDEX IF NOT EXISTS users_name_id_idx ON users (name, id);
+CREATE INDEX IF NOT EXISTS users_email_id_idx ON users (email, id);
+CREATE INDEX IF NOT EXISTS users_created_at_id_idx ON users (created_at, id);
+
+-- Filters.
+CREATE INDEX IF NOT EXISTS users_name_prefix_idx ON users (name text_pattern_ops);
+CREATE INDEX IF NOT EXISTS users_email_domain_idx ON users (lower(split_part(email, '@', 2)));
+CREATE INDEX IF NOT EXISTS users_status_idx ON users (status);
@@ -0,0 +1,4 @@
+-- Soft-deleted rows would become visible again, so remove them first.
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS users_deleted_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- Used by the background purge; live rows are not indexed.
+CREATE INDEX users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
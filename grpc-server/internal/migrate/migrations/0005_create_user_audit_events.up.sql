@@ -0,0 +1,12 @@
+-- user_id has no foreign key so history outlives purged users.
+CREATE TABLE user_audit_events (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    BIGINT NOT NULL,
+    actor      TEXT NOT NULL,
+    operation  TEXT NOT NULL,
+    changes    JSONB NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX user_audit_events_user_id_idx ON user_audit_events (user_id, id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_outbox_dead_letters;
+DROP TABLE IF EXISTS user_outbox;
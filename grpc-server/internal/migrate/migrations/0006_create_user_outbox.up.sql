@@ -0,0 +1,21 @@
+CREATE TABLE user_outbox (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         BIGINT NOT NULL,
+    payload         JSONB NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    last_error      TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX user_outbox_user_id_idx ON user_outbox (user_id, id);
+
+CREATE TABLE user_outbox_dead_letters (
+    id         BIGINT PRIMARY KEY,
+    user_id    BIGINT NOT NULL,
+    payload    JSONB NOT NULL,
+    attempts   INT NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    failed_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1 @@
+ALTER TABLE user_audit_events DROP COLUMN IF EXISTS payload;
@@ -0,0 +1,3 @@
+-- The published event, kept so WatchUsers can replay changes. Events
+-- recorded before this migration have none and are not replayed.
+ALTER TABLE user_audit_events ADD COLUMN payload JSONB;
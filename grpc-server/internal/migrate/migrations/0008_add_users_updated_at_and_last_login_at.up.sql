@@ -0,0 +1,10 @@
+ALTER TABLE users
+    ADD COLUMN updated_at TIMESTAMPTZ,
+    ADD COLUMN last_login_at TIMESTAMPTZ;
+
+-- Existing users have not changed as far as we know.
+UPDATE users SET updated_at = created_at;
+
+ALTER TABLE users
+    ALTER COLUMN updated_at SET DEFAULT now(),
+    ALTER COLUMN updated_at SET NOT NULL;
@@ -0,0 +1,28 @@
+-- Normalize stored emails the way the server now does: no surrounding
+-- whitespace and a lower-case domain.
+UPDATE users
+SET email = substring(btrim(email) from '^(.*@)') || lower(substring(btrim(email) from '@([^@]*)$'))
+WHERE btrim(email) LIKE '%@%'
+  AND email <> substring(btrim(email) from '^(.*@)') || lower(substring(btrim(email) from '@([^@]*)$'));
+UPDATE users SET email = btrim(email) WHERE email <> btrim(email);
+
+-- Live users that share an email must be merged or deleted by hand first.
+DO $$
+DECLARE
+    duplicates TEXT;
+BEGIN
+    SELECT string_agg(email, ', ') INTO duplicates
+    FROM (
+        SELECT min(email) AS email FROM users
+        WHERE deleted_at IS NULL
+        GROUP BY lower(email)
+        HAVING count(*) > 1
+    ) d;
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'emails used by more than one user: %', duplicates;
+    END IF;
+END $$;
+
+-- Soft-deleted users keep their email, so a user can reuse the email of a
+-- deleted one; restoring the deleted user then fails.
+CREATE UNIQUE INDEX users_email_lower_key ON users (lower(email)) WHERE deleted_at IS NULL;
@@ -0,0 +1,7 @@
+-- At most one pending reset per user; its row is deleted once used.
+CREATE TABLE user_password_resets (
+    user_id    BIGINT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    token_hash BYTEA NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
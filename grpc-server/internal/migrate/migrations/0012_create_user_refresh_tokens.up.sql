@@ -0,0 +1,9 @@
+-- Unused refresh tokens; a row is deleted when its token is exchanged.
+CREATE TABLE user_refresh_tokens (
+    token_hash BYTEA PRIMARY KEY,
+    user_id    BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX user_refresh_tokens_user_id_idx ON user_refresh_tokens (user_id);
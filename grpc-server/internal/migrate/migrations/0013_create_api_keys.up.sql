@@ -0,0 +1,13 @@
+-- API keys of machine clients. Only a SHA-256 hash of each key is stored;
+-- the prefix identifies a key without revealing it.
+CREATE TABLE api_keys (
+    id           BIGSERIAL PRIMARY KEY,
+    name         TEXT NOT NULL,
+    prefix       TEXT NOT NULL UNIQUE,
+    key_hash     BYTEA NOT NULL UNIQUE,
+    scopes       TEXT[] NOT NULL,
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at   TIMESTAMPTZ
+);
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// APIKey is a key machine clients authenticate with. Only a hash of the key
+// is stored; Prefix, the start of the key, identifies it.
+type APIKey struct {
+	Id         int64      `db:"id"`
+	Name       string     `db:"name"`
+	Prefix     string     `db:"prefix"`
+	KeyHash    []byte     `db:"key_hash"`
+	Scopes     []string   `db:"-"`
+	ExpiresAt  *time.Time `db:"expires_at"`   // nil if the key does not expire
+	LastUsedAt *time.Time `db:"last_used_at"` // nil until first used
+	CreatedAt  time.Time  `db:"created_at"`
+	RevokedAt  *time.Time `db:"revoked_at"` // set once revoked
+}
@@ -0,0 +1,30 @@
+package model
+
+import "time"
+
+// Audited operations.
+const (
+	OpCreate  = "create"
+	OpUpdate  = "update"
+	OpDelete  = "delete"
+	OpRestore = "restore"
+	OpPurge   = "purge"
+)
+
+// AuditEvent records one mutation of a user.
+type AuditEvent struct {
+	Id        int64                  `db:"id"`
+	UserId    int64                  `db:"user_id"`
+	Actor     string                 `db:"actor"`
+	Operation string                 `db:"operation"`
+	Changes   map[string]FieldChange `db:"-"`
+	RequestId string                 `db:"request_id"`
+	CreatedAt time.Time              `db:"created_at"`
+}
+
+// FieldChange holds a field's value before and after a mutation. Nil means
+// the field was absent, e.g. before a create.
+type FieldChange struct {
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// Account statuses.
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// User represents a user model. The timestamps are managed by the
+// repository.
+type User struct {
+	Id              int64      `db:"id"`
+	Name            string     `db:"name"`
+	Email           string     `db:"email"`
+	Password        string     `db:"password"` // encoded hash, never the plaintext
+	Status          string     `db:"status"`
+	Version         int64      `db:"version"` // incremented on every change
+	CreatedAt       time.Time  `db:"created_at"`
+	UpdatedAt       time.Time  `db:"updated_at"`        // set on every change
+	LastLoginAt     *time.Time `db:"last_login_at"`     // nil until the first login
+	EmailVerifiedAt *time.Time `db:"email_verified_at"` // nil until verified, and again once the email changes
+	DeletedAt       *time.Time `db:"deleted_at"`        // set while soft-deleted
+}
+
+// ValidStatus reports whether s is a known account status.
+func ValidStatus(s string) bool {
+	return s == StatusActive || s == StatusDisabled
+}
+
+// NormalizeEmail trims surrounding whitespace from email and lower-cases its
+// domain, which is case-insensitive. The local part is kept as given; emails
+// are nevertheless unique regardless of case.
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	if at := strings.LastIndexByte(email, '@'); at >= 0 {
+		email = email[:at] + strings.ToLower(email[at:])
+	}
+	return email
+}
+
+// EmailVerification is a pending verification of a user's email. Tokens
+// carry the nonce, so only the latest verification issued for a user can be
+// completed.
+type EmailVerification struct {
+	UserId    int64     `db:"user_id"`
+	Email     string    `db:"email"`
+	Nonce     string    `db:"nonce"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// PasswordReset is a pending password reset. Only a hash of its token is
+// stored, so a leaked database does not allow resetting passwords.
+type PasswordReset struct {
+	UserId    int64     `db:"user_id"`
+	TokenHash []byte    `db:"token_hash"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// RefreshToken is an unused refresh token. Only a hash of the token is
+// stored.
+type RefreshToken struct {
+	UserId    int64     `db:"user_id"`
+	TokenHash []byte    `db:"token_hash"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
@@ -0,0 +1,118 @@
+// Package outbox delivers user change events to other services.
+//
+// Repositories write an event to the outbox in the same transaction as the
+// change it describes, so an event is stored if and only if the change is
+// committed. A Relay then hands stored events to a Publisher, retrying until
+// they are delivered, so delivery is at-least-once: consumers should use the
+// event id to ignore duplicates.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"grpc-server/internal/model"
+)
+
+// Event types, one per audited operation.
+const (
+	TypeCreated  = "user.created"
+	TypeUpdated  = "user.updated"
+	TypeDeleted  = "user.deleted"
+	TypeRestored = "user.restored"
+	TypePurged   = "user.purged"
+)
+
+var eventTypes = map[string]string{
+	model.OpCreate:  TypeCreated,
+	model.OpUpdate:  TypeUpdated,
+	model.OpDelete:  TypeDeleted,
+	model.OpRestore: TypeRestored,
+	model.OpPurge:   TypePurged,
+}
+
+// Event is the payload published for a user change.
+type Event struct {
+	// Id is the id of the change's audit event. It increases with every
+	// change and is unique, so consumers can use it to drop duplicates.
+	Id         int64     `json:"id"`
+	Type       string    `json:"type"`
+	UserId     int64     `json:"user_id"`
+	User       *User     `json:"user,omitempty"` // state after the change; unset for purges
+	Actor      string    `json:"actor"`
+	RequestId  string    `json:"request_id,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// User is the published view of a user. It never includes the password.
+type User struct {
+	Id              int64      `json:"id"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	Status          string     `json:"status"`
+	Version         int64      `json:"version"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	LastLoginAt     *time.Time `json:"last_login_at,omitempty"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty"`
+}
+
+// NewEvent returns the event for a recorded audit event. after is the user
+// after the change, or nil if it was purged.
+func NewEvent(event model.AuditEvent, after *model.User) Event {
+	e := Event{
+		Id:         event.Id,
+		Type:       eventTypes[event.Operation],
+		UserId:     event.UserId,
+		Actor:      event.Actor,
+		RequestId:  event.RequestId,
+		OccurredAt: event.CreatedAt,
+	}
+	if after != nil {
+		e.User = &User{
+			Id:              after.Id,
+			Name:            after.Name,
+			Email:           after.Email,
+			Status:          after.Status,
+			Version:         after.Version,
+			CreatedAt:       after.CreatedAt,
+			UpdatedAt:       after.UpdatedAt,
+			LastLoginAt:     after.LastLoginAt,
+			EmailVerifiedAt: after.EmailVerifiedAt,
+			DeletedAt:       after.DeletedAt,
+		}
+	}
+	return e
+}
+
+// Message is an event waiting in the outbox.
+type Message struct {
+	Id       int64
+	UserId   int64
+	Payload  json.RawMessage // the encoded Event
+	Attempts int             // failed deliveries so far
+}
+
+// Store holds undelivered messages.
+type Store interface {
+	// Pending returns up to limit messages that are due for delivery,
+	// oldest first. A message is not returned while an older message for the
+	// same user is waiting to be retried.
+	Pending(ctx context.Context, limit int) ([]Message, error)
+	// Delivered removes a delivered message.
+	Delivered(ctx context.Context, id int64) error
+	// Failed records a failed delivery and schedules the next attempt.
+	Failed(ctx context.Context, id int64, cause string, next time.Time) error
+	// DeadLetter moves a message that cannot be delivered out of the outbox.
+	DeadLetter(ctx context.Context, id int64, cause string) error
+}
+
+// Locker is implemented by stores shared between processes. A Relay holds the
+// lock while it runs, so only one relay delivers messages at a time and
+// events for a user stay in order.
+type Locker interface {
+	// Lock blocks until the lock is acquired or ctx is done.
+	Lock(ctx context.Context) (unlock func(), err error)
+}
@@ -0,0 +1,104 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publisher delivers messages to consumers.
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// WriterPublisher writes each message as a line of newline-delimited JSON.
+type WriterPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterPublisher returns a Publisher writing to w.
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// NewFilePublisher returns a Publisher appending to the file at path, which is
+// created if needed.
+func NewFilePublisher(path string) (*WriterPublisher, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterPublisher(f), nil
+}
+
+func (p *WriterPublisher) Publish(ctx context.Context, msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	line := append(append([]byte{}, msg.Payload...), '\n')
+	if _, err := p.w.Write(line); err != nil {
+		return err
+	}
+	if f, ok := p.w.(*os.File); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// HTTPPublisher POSTs each message as JSON to a URL. Any response other than
+// 2xx is a failed delivery.
+type HTTPPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+// HTTPTimeout bounds each delivery of an HTTPPublisher created by
+// NewHTTPPublisher, so an unresponsive receiver cannot stall the relay.
+const HTTPTimeout = 10 * time.Second
+
+// NewHTTPPublisher returns a Publisher posting to url.
+func NewHTTPPublisher(url string) *HTTPPublisher {
+	return &HTTPPublisher{URL: url, Client: &http.Client{Timeout: HTTPTimeout}}
+}
+
+func (p *HTTPPublisher) Publish(ctx context.Context, msg Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Lets the receiver drop redeliveries.
+	req.Header.Set("Idempotency-Key", strconv.FormatInt(msg.Id, 10))
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("outbox: %s responded %s", p.URL, resp.Status)
+	}
+	return nil
+}
+
+// NewPublisher returns the Publisher named by spec: "stdout",
+// "file:<path>" or an http:// or https:// URL.
+func NewPublisher(spec string) (Publisher, error) {
+	switch {
+	case spec == "stdout":
+		return NewWriterPublisher(os.Stdout), nil
+	case strings.HasPrefix(spec, "file:"):
+		return NewFilePublisher(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewHTTPPublisher(spec), nil
+	default:
+		return nil, fmt.Errorf("outbox: unknown publisher %q", spec)
+	}
+}
@@ -0,0 +1,107 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RelayConfig controls how a Relay polls and retries.
+type RelayConfig struct {
+	Interval    time.Duration // time between polls of an empty outbox
+	BatchSize   int
+	MaxAttempts int           // deliveries tried before a message is dead-lettered
+	MinBackoff  time.Duration // delay after the first failure, doubled after each
+	MaxBackoff  time.Duration
+}
+
+// DefaultRelayConfig retries for roughly a day before giving up.
+var DefaultRelayConfig = RelayConfig{
+	Interval:    time.Second,
+	BatchSize:   100,
+	MaxAttempts: 20,
+	MinBackoff:  time.Second,
+	MaxBackoff:  2 * time.Hour,
+}
+
+// Relay moves messages from a Store to a Publisher.
+type Relay struct {
+	store     Store
+	publisher Publisher
+	config    RelayConfig
+}
+
+// NewRelay returns a Relay delivering messages from store to publisher.
+func NewRelay(store Store, publisher Publisher, config RelayConfig) *Relay {
+	return &Relay{store: store, publisher: publisher, config: config}
+}
+
+// Run delivers messages until ctx is done.
+func (r *Relay) Run(ctx context.Context) error {
+	if l, ok := r.store.(Locker); ok {
+		unlock, err := l.Lock(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := r.deliver(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to relay outbox messages: %v", err)
+			}
+			if err != nil || n < r.config.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliver publishes one batch of pending messages and returns its size.
+func (r *Relay) deliver(ctx context.Context) (int, error) {
+	msgs, err := r.store.Pending(ctx, r.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	// Once a message for a user fails, later ones for the same user wait
+	// for it, so each user's events are published in order.
+	blocked := make(map[int64]bool)
+	for _, msg := range msgs {
+		if blocked[msg.UserId] {
+			continue
+		}
+		pubErr := r.publisher.Publish(ctx, msg)
+		switch {
+		case pubErr == nil:
+			err = r.store.Delivered(ctx, msg.Id)
+		case msg.Attempts+1 >= r.config.MaxAttempts:
+			log.Printf("Dead-lettering outbox message %d after %d attempts: %v", msg.Id, msg.Attempts+1, pubErr)
+			err = r.store.DeadLetter(ctx, msg.Id, pubErr.Error())
+		default:
+			blocked[msg.UserId] = true
+			err = r.store.Failed(ctx, msg.Id, pubErr.Error(), time.Now().Add(r.backoff(msg.Attempts+1)))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// backoff returns the delay before retrying after the given number of
+// failed attempts.
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.config.MinBackoff
+	for i := 1; i < attempts && d < r.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, r.config.MaxBackoff)
+}
@@ -0,0 +1,249 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore is an in-memory Store recording what the relay did.
+type fakeStore struct {
+	mu       sync.Mutex
+	msgs     []*fakeMessage
+	dead     map[int64]string
+	locked   bool
+	unlocked bool
+}
+
+type fakeMessage struct {
+	Message
+	next  time.Time
+	cause string
+}
+
+func newFakeStore(msgs ...Message) *fakeStore {
+	s := &fakeStore{dead: make(map[int64]string)}
+	for _, m := range msgs {
+		s.msgs = append(s.msgs, &fakeMessage{Message: m})
+	}
+	return s
+}
+
+func (s *fakeStore) Pending(_ context.Context, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiting := make(map[int64]bool)
+	var msgs []Message
+	for _, m := range s.msgs {
+		if len(msgs) == limit {
+			break
+		}
+		if m.next.After(time.Now()) {
+			waiting[m.UserId] = true
+		}
+		if !waiting[m.UserId] {
+			msgs = append(msgs, m.Message)
+		}
+	}
+	return msgs, nil
+}
+
+func (s *fakeStore) remove(id int64) {
+	for i, m := range s.msgs {
+		if m.Id == id {
+			s.msgs = append(s.msgs[:i], s.msgs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *fakeStore) get(id int64) *fakeMessage {
+	for _, m := range s.msgs {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) Delivered(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	return nil
+}
+
+func (s *fakeStore) Failed(_ context.Context, id int64, cause string, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.get(id)
+	m.Attempts++
+	m.cause, m.next = cause, next
+	return nil
+}
+
+func (s *fakeStore) DeadLetter(_ context.Context, id int64, cause string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	s.dead[id] = cause
+	return nil
+}
+
+func (s *fakeStore) Lock(context.Context) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locked = true
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.unlocked = true
+	}, nil
+}
+
+// fakePublisher records published message ids and fails those in failing.
+type fakePublisher struct {
+	mu        sync.Mutex
+	failing   map[int64]bool
+	published []int64
+}
+
+func (p *fakePublisher) Publish(_ context.Context, msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failing[msg.Id] {
+		return fmt.Errorf("message %d refused", msg.Id)
+	}
+	p.published = append(p.published, msg.Id)
+	return nil
+}
+
+var testConfig = RelayConfig{
+	Interval:    time.Millisecond,
+	BatchSize:   10,
+	MaxAttempts: 3,
+	MinBackoff:  time.Minute,
+	MaxBackoff:  5 * time.Minute,
+}
+
+func TestRelayDeliversInOrder(t *testing.T) {
+	store := newFakeStore(Message{Id: 1, UserId: 1}, Message{Id: 2, UserId: 2}, Message{Id: 3, UserId: 1})
+	pub := &fakePublisher{}
+	n, err := NewRelay(store, pub, testConfig).deliver(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("deliver() = %d, %v", n, err)
+	}
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(pub.published, want) {
+		t.Errorf("published %v, want %v", pub.published, want)
+	}
+	if len(store.msgs) != 0 {
+		t.Errorf("%d messages left in the outbox", len(store.msgs))
+	}
+}
+
+func TestRelayRetriesFailures(t *testing.T) {
+	store := newFakeStore(Message{Id: 1, UserId: 1}, Message{Id: 2, UserId: 2}, Message{Id: 3, UserId: 1})
+	pub := &fakePublisher{failing: map[int64]bool{1: true}}
+	r := NewRelay(store, pub, testConfig)
+	start := time.Now()
+	if _, err := r.deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Message 3 waits for message 1 of the same user; user 2 is not held up.
+	if want := []int64{2}; !reflect.DeepEqual(pub.published, want) {
+		t.Errorf("published %v, want %v", pub.published, want)
+	}
+	failed := store.get(1)
+	if failed.Attempts != 1 || failed.cause != "message 1 refused" {
+		t.Errorf("failed message = %+v", failed)
+	}
+	if failed.next.Before(start.Add(testConfig.MinBackoff)) || failed.next.After(time.Now().Add(testConfig.MinBackoff)) {
+		t.Errorf("retry at %v, want %v after the failure", failed.next, testConfig.MinBackoff)
+	}
+
+	// Nothing of user 1 is due before the retry.
+	if _, err := r.deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.published) != 1 {
+		t.Errorf("published %v before the retry was due", pub.published)
+	}
+
+	failed.next = time.Time{}
+	delete(pub.failing, 1)
+	if _, err := r.deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{2, 1, 3}; !reflect.DeepEqual(pub.published, want) {
+		t.Errorf("published %v, want %v", pub.published, want)
+	}
+}
+
+func TestRelayDeadLetters(t *testing.T) {
+	store := newFakeStore(Message{Id: 1, UserId: 1, Attempts: testConfig.MaxAttempts - 1}, Message{Id: 2, UserId: 1})
+	pub := &fakePublisher{failing: map[int64]bool{1: true}}
+	if _, err := NewRelay(store, pub, testConfig).deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cause := store.dead[1]; cause != "message 1 refused" {
+		t.Errorf("dead letters = %v, want message 1", store.dead)
+	}
+	// A dead-lettered message no longer holds up the user's later ones.
+	if want := []int64{2}; !reflect.DeepEqual(pub.published, want) {
+		t.Errorf("published %v, want %v", pub.published, want)
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	r := NewRelay(nil, nil, testConfig)
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 5 * time.Minute},
+		{40, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := r.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRelayRun(t *testing.T) {
+	store := newFakeStore(Message{Id: 1, UserId: 1})
+	pub := &fakePublisher{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewRelay(store, pub, testConfig).Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.mu.Lock()
+		left := len(store.msgs)
+		store.mu.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message was not delivered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() error = %v, want context.Canceled", err)
+	}
+	if !store.locked || !store.unlocked {
+		t.Errorf("lock taken %v, released %v", store.locked, store.unlocked)
+	}
+}
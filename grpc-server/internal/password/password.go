@@ -0,0 +1,155 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrEmpty is returned when hashing an empty password.
+var ErrEmpty = errors.New("password: empty password")
+
+// ErrUnknownFormat is returned when a stored hash is in a format we cannot verify.
+var ErrUnknownFormat = errors.New("password: unknown hash format")
+
+// Params holds the argon2id cost parameters.
+type Params struct {
+	Memory      uint32 // memory in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams follows the second recommended option of RFC 9106.
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Hasher hashes and verifies passwords.
+//
+// Hashes are stored in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>", so the algorithm and its
+// cost travel with every stored value. Verify also accepts bcrypt hashes
+// ("$2a$", "$2b$", "$2y$") so existing credentials keep working while
+// NeedsRehash reports them for upgrade.
+type Hasher struct {
+	params Params
+}
+
+// NewHasher returns a Hasher using the given argon2id parameters.
+func NewHasher(params Params) *Hasher {
+	return &Hasher{params: params}
+}
+
+// Hash derives an encoded argon2id hash from a plaintext password.
+func (h *Hasher) Hash(plain string) (string, error) {
+	if plain == "" {
+		return "", ErrEmpty
+	}
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(plain), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether plain matches the encoded hash.
+func (h *Hasher) Verify(plain, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		p, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(plain), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(plain))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, ErrUnknownFormat
+	}
+}
+
+// NeedsRehash reports whether encoded was produced by another algorithm or
+// with parameters different from the Hasher's current ones.
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.Memory != h.params.Memory ||
+		p.Iterations != h.params.Iterations ||
+		p.Parallelism != h.params.Parallelism ||
+		uint32(len(salt)) != h.params.SaltLength ||
+		uint32(len(key)) != h.params.KeyLength
+}
+
+// IsHash reports whether encoded is a hash Verify can check, so it can be
+// stored as is, e.g. when importing users from another system.
+func IsHash(encoded string) bool {
+	if isBcrypt(encoded) {
+		_, err := bcrypt.Cost([]byte(encoded))
+		return err == nil
+	}
+	_, _, _, err := decodeArgon2id(encoded)
+	return err == nil
+}
+
+// IsLegacy reports whether stored is a plaintext password saved before
+// passwords were hashed: a non-empty value that is neither an argon2id nor a
+// bcrypt hash.
+func IsLegacy(stored string) bool {
+	return stored != "" && !strings.HasPrefix(stored, "$argon2id$") && !isBcrypt(stored)
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+// decodeArgon2id parses "$argon2id$v=19$m=...,t=...,p=...$salt$key".
+func decodeArgon2id(encoded string) (p Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("password: unsupported argon2 version %d", version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
@@ -0,0 +1,113 @@
+package password
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testParams keeps hashing fast.
+var testParams = Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashAndVerify(t *testing.T) {
+	h := NewHasher(testParams)
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		plain   string
+		encoded string
+		want    bool
+		wantErr error
+	}{
+		{"argon2id match", "correct horse", encoded, true, nil},
+		{"argon2id mismatch", "wrong horse", encoded, false, nil},
+		{"bcrypt match", "correct horse", string(bcryptHash), true, nil},
+		{"bcrypt mismatch", "wrong horse", string(bcryptHash), false, nil},
+		{"plaintext is not accepted", "correct horse", "correct horse", false, ErrUnknownFormat},
+		{"malformed argon2id", "correct horse", "$argon2id$v=19$m=1024$x$y", false, ErrUnknownFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.Verify(tt.plain, tt.encoded)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() = %v, %v; want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHashSaltsEveryPassword(t *testing.T) {
+	h := NewHasher(testParams)
+	a, _ := h.Hash("secret")
+	b, _ := h.Hash("secret")
+	if a == b {
+		t.Errorf("two hashes of the same password are equal: %s", a)
+	}
+}
+
+func TestHashEmpty(t *testing.T) {
+	if _, err := NewHasher(testParams).Hash(""); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Hash(\"\") error = %v, want ErrEmpty", err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	h := NewHasher(testParams)
+	current, _ := h.Hash("secret")
+	stronger := testParams
+	stronger.Iterations = 2
+	old, _ := NewHasher(stronger).Hash("secret")
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    bool
+	}{
+		{"current parameters", current, false},
+		{"other parameters", old, true},
+		{"bcrypt", string(bcryptHash), true},
+		{"plaintext", "secret", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.NeedsRehash(tt.encoded); got != tt.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHashAndIsLegacy(t *testing.T) {
+	argon, _ := NewHasher(testParams).Hash("secret")
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	tests := []struct {
+		stored     string
+		wantHash   bool
+		wantLegacy bool
+	}{
+		{argon, true, false},
+		{string(bcryptHash), true, false},
+		{"$2y$10$short", false, false},
+		{"hunter2", false, true},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		if got := IsHash(tt.stored); got != tt.wantHash {
+			t.Errorf("IsHash(%q) = %v, want %v", tt.stored, got, tt.wantHash)
+		}
+		if got := IsLegacy(tt.stored); got != tt.wantLegacy {
+			t.Errorf("IsLegacy(%q) = %v, want %v", tt.stored, got, tt.wantLegacy)
+		}
+	}
+}
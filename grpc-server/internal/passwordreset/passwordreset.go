@@ -0,0 +1,128 @@
+// Package passwordreset lets users who forgot their password choose a new
+// one by proving they control their email address.
+package passwordreset
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"grpc-server/internal/mailer"
+	"grpc-server/internal/model"
+	"grpc-server/internal/password"
+	"grpc-server/internal/repository"
+)
+
+// DefaultTTL is how long a reset token stays valid.
+const DefaultTTL = time.Hour
+
+// ErrInvalidToken is returned for tokens that were never issued, have been
+// used, were superseded by a newer token or have expired.
+var ErrInvalidToken = errors.New("passwordreset: invalid token")
+
+// tokenSize is the number of random bytes in a token.
+const tokenSize = 32
+
+// Config configures a Resetter.
+type Config struct {
+	TTL time.Duration
+	// URL is the page users are sent to, with the token added as the
+	// "token" query parameter. When empty, emails contain the bare token.
+	URL string
+}
+
+// Resetter mails users random, single-use reset tokens and sets new
+// passwords with them. Only SHA-256 hashes of tokens are stored; issuing a
+// token replaces any earlier one of the same user.
+type Resetter struct {
+	repo   repository.UserRepository
+	mailer mailer.Mailer
+	hasher *password.Hasher
+	cfg    Config
+}
+
+// New returns a Resetter. With a nil mailer no emails are sent, but tokens
+// issued earlier can still be used.
+func New(repo repository.UserRepository, m mailer.Mailer, hasher *password.Hasher, cfg Config) *Resetter {
+	return &Resetter{repo: repo, mailer: m, hasher: hasher, cfg: cfg}
+}
+
+// Request mails a reset token to the user with the given email. It does
+// nothing when no active user has that email; callers must not tell the
+// difference to the requester.
+func (r *Resetter) Request(ctx context.Context, email string) error {
+	if r.mailer == nil {
+		return nil
+	}
+	user, err := r.repo.GetByEmail(ctx, email)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Status != model.StatusActive {
+		return nil
+	}
+	raw := make([]byte, tokenSize)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	expiresAt := time.Now().Add(r.cfg.TTL).Truncate(time.Second)
+	err = r.repo.SavePasswordReset(ctx, model.PasswordReset{
+		UserId:    user.Id,
+		TokenHash: hash(token),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	return r.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body:    r.body(user, token, expiresAt),
+	})
+}
+
+func (r *Resetter) body(user *model.User, token string, expiresAt time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hello %s,\n\n", user.Name)
+	if r.cfg.URL != "" {
+		link, sep := r.cfg.URL, "?"
+		if strings.Contains(link, "?") {
+			sep = "&"
+		}
+		fmt.Fprintf(&b, "To choose a new password, open this link:\n\n%s%stoken=%s\n\n", link, sep, url.QueryEscape(token))
+	} else {
+		fmt.Fprintf(&b, "To choose a new password, use this token:\n\n%s\n\n", token)
+	}
+	fmt.Fprintf(&b, "It expires at %s. If you did not ask to reset your password, you can ignore this email.",
+		expiresAt.UTC().Format(time.RFC1123))
+	return b.String()
+}
+
+// Reset sets the password of the user token was issued to and returns the
+// user.
+func (r *Resetter) Reset(ctx context.Context, token, newPassword string) (*model.User, error) {
+	encoded, err := r.hasher.Hash(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.repo.ResetPassword(ctx, hash(token), encoded)
+	if errors.Is(err, repository.ErrPasswordResetNotFound) {
+		return nil, ErrInvalidToken
+	}
+	return user, err
+}
+
+func hash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -0,0 +1,158 @@
+package passwordreset
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"grpc-server/internal/mailer"
+	"grpc-server/internal/model"
+	"grpc-server/internal/password"
+	"grpc-server/internal/repository"
+)
+
+// recordingMailer keeps the messages it is asked to send.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *recordingMailer) Send(_ context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// token returns the token in the last message sent.
+func (m *recordingMailer) token(t *testing.T) string {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		t.Fatal("no email was sent")
+	}
+	_, rest, _ := strings.Cut(m.sent[len(m.sent)-1].Body, "use this token:\n\n")
+	token, _, _ := strings.Cut(rest, "\n")
+	if token == "" {
+		t.Fatalf("no token in %q", m.sent[len(m.sent)-1].Body)
+	}
+	return token
+}
+
+// newTestResetter returns a Resetter over a memory repository holding the
+// active user john@example.com and the disabled user jane@example.com.
+func newTestResetter(t *testing.T, ttl time.Duration) (*Resetter, *recordingMailer, repository.UserRepository) {
+	t.Helper()
+	repo := repository.NewMemoryUserRepository()
+	for _, u := range []*model.User{
+		{Name: "John", Email: "john@example.com", Password: "old", Status: model.StatusActive},
+		{Name: "Jane", Email: "jane@example.com", Password: "old", Status: model.StatusDisabled},
+	} {
+		if err := repo.Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &recordingMailer{}
+	hasher := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	return New(repo, m, hasher, Config{TTL: ttl}), m, repo
+}
+
+func TestReset(t *testing.T) {
+	r, m, repo := newTestResetter(t, DefaultTTL)
+	ctx := context.Background()
+	if err := r.Request(ctx, "john@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	token := m.token(t)
+
+	user, err := r.Reset(ctx, token, "new secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := repo.Get(ctx, user.Id)
+	if ok, _ := r.hasher.Verify("new secret", stored.Password); !ok {
+		t.Errorf("password was not changed: %q", stored.Password)
+	}
+	if _, err := r.Reset(ctx, token, "another secret"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second Reset() error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestResetInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// prepare runs between requesting the token and using it, and
+		// returns the token to use.
+		prepare func(t *testing.T, r *Resetter, m *recordingMailer, repo repository.UserRepository, token string) string
+	}{
+		{"expired", -time.Minute, nil},
+		{"never issued", DefaultTTL, func(*testing.T, *Resetter, *recordingMailer, repository.UserRepository, string) string {
+			return "bm90IGEgdG9rZW4"
+		}},
+		{"replaced by a newer token", DefaultTTL, func(t *testing.T, r *Resetter, _ *recordingMailer, _ repository.UserRepository, token string) string {
+			if err := r.Request(context.Background(), "john@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}},
+		{"password changed since", DefaultTTL, func(t *testing.T, _ *Resetter, _ *recordingMailer, repo repository.UserRepository, token string) string {
+			changed := "changed"
+			if _, err := repo.Patch(context.Background(), 1, 0, repository.UserPatch{Password: &changed}); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}},
+		{"user deleted since", DefaultTTL, func(t *testing.T, _ *Resetter, _ *recordingMailer, repo repository.UserRepository, token string) string {
+			if err := repo.Delete(context.Background(), 1); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, m, repo := newTestResetter(t, tt.ttl)
+			if err := r.Request(context.Background(), "john@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			token := m.token(t)
+			if tt.prepare != nil {
+				token = tt.prepare(t, r, m, repo, token)
+			}
+			if _, err := r.Reset(context.Background(), token, "new secret"); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Reset() error = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestRequestRevealsNothing(t *testing.T) {
+	for _, email := range []string{"nobody@example.com", "jane@example.com"} {
+		r, m, _ := newTestResetter(t, DefaultTTL)
+		if err := r.Request(context.Background(), email); err != nil {
+			t.Errorf("Request(%q) error = %v", email, err)
+		}
+		if len(m.sent) != 0 {
+			t.Errorf("Request(%q) sent %d emails", email, len(m.sent))
+		}
+	}
+}
+
+func TestRequestEmail(t *testing.T) {
+	r, m, _ := newTestResetter(t, DefaultTTL)
+	r.cfg.URL = "https://example.com/reset?lang=en"
+	if err := r.Request(context.Background(), "JOHN@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 || m.sent[0].To != "john@example.com" {
+		t.Fatalf("sent = %+v", m.sent)
+	}
+	if !strings.Contains(m.sent[0].Body, "https://example.com/reset?lang=en&token=") {
+		t.Errorf("body does not link to the reset page: %q", m.sent[0].Body)
+	}
+}
@@ -0,0 +1,68 @@
+// Package ratelimit limits how often something may happen per key.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows up to Limit events per key in any window of length Window.
+// It keeps the times of recent events in memory, so limits are per process.
+type Limiter struct {
+	limit  int
+	window time.Duration
+	// now returns the current time; tests replace it.
+	now func() time.Time
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+	swept  time.Time
+}
+
+// New returns a Limiter allowing limit events per key in every window.
+func New(limit int, window time.Duration) *Limiter {
+	return &Limiter{limit: limit, window: window, now: time.Now, events: make(map[string][]time.Time)}
+}
+
+// Allow records an event for key and reports whether it is within the
+// limit. If not, the event is not recorded and Allow also returns how long
+// to wait until the next event would be allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	recent := l.recent(key, now)
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false, recent[0].Add(l.window).Sub(now)
+	}
+	l.events[key] = append(recent, now)
+	return true, 0
+}
+
+// recent returns the events of key inside the window ending at now, oldest
+// first. The caller holds l.mu.
+func (l *Limiter) recent(key string, now time.Time) []time.Time {
+	events := l.events[key]
+	start := now.Add(-l.window)
+	i := 0
+	for i < len(events) && !events[i].After(start) {
+		i++
+	}
+	return events[i:]
+}
+
+// sweep forgets keys without recent events, at most once per window. The
+// caller holds l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+	for key := range l.events {
+		if len(l.recent(key, now)) == 0 {
+			delete(l.events, key)
+		}
+	}
+}
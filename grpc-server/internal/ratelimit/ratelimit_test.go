@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a fake time source for a Limiter.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestLimiter(limit int, window time.Duration) (*Limiter, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(limit, window)
+	l.now = c.now
+	return l, c
+}
+
+func TestAllow(t *testing.T) {
+	l, c := newTestLimiter(3, time.Minute)
+	tests := []struct {
+		advance   time.Duration
+		key       string
+		want      bool
+		wantRetry time.Duration
+	}{
+		{0, "a", true, 0},
+		{10 * time.Second, "a", true, 0},
+		{10 * time.Second, "a", true, 0},
+		// The first event was 20s ago, so it leaves the window in 40s.
+		{0, "a", false, 40 * time.Second},
+		// Refused events are not recorded and keys are independent.
+		{0, "b", true, 0},
+		{39 * time.Second, "a", false, time.Second},
+		// The first event has left the window.
+		{time.Second, "a", true, 0},
+		{0, "a", false, 10 * time.Second},
+		// A whole window later every slot is free again.
+		{time.Minute, "a", true, 0},
+		{0, "a", true, 0},
+		{0, "a", true, 0},
+		{0, "a", false, time.Minute},
+	}
+	for i, tt := range tests {
+		c.advance(tt.advance)
+		ok, retry := l.Allow(tt.key)
+		if ok != tt.want || retry != tt.wantRetry {
+			t.Errorf("step %d: Allow(%q) = %v, %v, want %v, %v", i, tt.key, ok, retry, tt.want, tt.wantRetry)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l, c := newTestLimiter(1, time.Minute)
+	l.Allow("a")
+	c.advance(30 * time.Second)
+	l.Allow("b")
+	if len(l.events) != 2 {
+		t.Fatalf("%d keys, want 2", len(l.events))
+	}
+
+	// "a" has left the window, "b" has not.
+	c.advance(40 * time.Second)
+	l.Allow("c")
+	if _, ok := l.events["a"]; ok || len(l.events) != 2 {
+		t.Errorf("keys after a sweep = %v, want b and c", l.events)
+	}
+
+	// Sweeps happen at most once per window.
+	c.advance(40 * time.Second)
+	l.Allow("d")
+	if len(l.events) != 3 {
+		t.Errorf("keys = %v, want b, c and d before the next sweep", l.events)
+	}
+	c.advance(30 * time.Second)
+	l.Allow("e")
+	if _, ok := l.events["b"]; ok {
+		t.Errorf("keys = %v, want b forgotten", l.events)
+	}
+}
@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"grpc-server/internal/model"
+)
+
+// ErrInvalidCursor is returned when a page token cannot be decoded or was
+// issued for a different filter or order.
+var ErrInvalidCursor = errors.New("repository: invalid page token")
+
+// Cursor marks the last row of a page, identified by its sort key and id.
+// It is handed to clients as an opaque page token.
+type Cursor struct {
+	// Key is the sort column value of the last row; unused when ordering by id.
+	Key string `json:"k,omitempty"`
+	Id  int64  `json:"id"`
+	// Query fingerprints the filter and order the cursor belongs to.
+	Query string `json:"q"`
+}
+
+// NewCursor returns the cursor positioned at user for a listing with opts.
+func NewCursor(user model.User, opts ListOptions) Cursor {
+	c := Cursor{Id: user.Id, Query: fingerprint(opts)}
+	switch opts.OrderBy {
+	case SortByName:
+		c.Key = user.Name
+	case SortByEmail:
+		c.Key = user.Email
+	case SortByCreatedAt:
+		c.Key = user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return c
+}
+
+// Encode returns the opaque page token for c.
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a page token produced by Cursor.Encode for a listing
+// with the same filter and order as opts. An empty token yields nil.
+func DecodeCursor(token string, opts ListOptions) (*Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	c, err := decode(token, fingerprint(opts))
+	if err != nil {
+		return nil, err
+	}
+	if opts.OrderBy == SortByCreatedAt {
+		if _, err := c.createdAt(); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return c, nil
+}
+
+// NewAuditCursor returns the cursor positioned at event in its user's history.
+func NewAuditCursor(event model.AuditEvent) Cursor {
+	return Cursor{Id: event.Id, Query: auditQuery(event.UserId)}
+}
+
+// DecodeAuditCursor parses a page token produced for the history of
+// userId and returns the id of the event it points at, or 0 for an empty
+// token.
+func DecodeAuditCursor(token string, userId int64) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	c, err := decode(token, auditQuery(userId))
+	if err != nil {
+		return 0, err
+	}
+	return c.Id, nil
+}
+
+// NewWatchCursor returns the position of the event with the given id in the
+// WatchUsers stream.
+func NewWatchCursor(id int64) Cursor {
+	return Cursor{Id: id, Query: watchQuery}
+}
+
+// DecodeWatchCursor parses a position token produced by NewWatchCursor and
+// returns the event id it points at.
+func DecodeWatchCursor(token string) (int64, error) {
+	c, err := decode(token, watchQuery)
+	if err != nil {
+		return 0, err
+	}
+	return c.Id, nil
+}
+
+const watchQuery = "watch"
+
+func auditQuery(userId int64) string {
+	return "audit/" + strconv.FormatInt(userId, 10)
+}
+
+func decode(token, query string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Query != query {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func (c Cursor) createdAt() (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, c.Key)
+}
+
+// fingerprint hashes everything about a listing except its position, so a
+// token cannot be replayed against another filter or order.
+func fingerprint(opts ListOptions) string {
+	b, _ := json.Marshal(struct {
+		Filter  Filter
+		OrderBy SortField
+		Desc    bool
+	}{opts.Filter, opts.OrderBy, opts.Desc})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
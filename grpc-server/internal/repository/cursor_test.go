@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"grpc-server/internal/model"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	user := model.User{
+		Id:        20,
+		Name:      "John",
+		Email:     "john@example.com",
+		CreatedAt: time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC),
+	}
+	tests := []struct {
+		name    string
+		opts    ListOptions
+		wantKey string
+	}{
+		{"by id", ListOptions{OrderBy: SortById}, ""},
+		{"by name", ListOptions{OrderBy: SortByName, Desc: true}, "John"},
+		{"by email", ListOptions{OrderBy: SortByEmail}, "john@example.com"},
+		{"by created_at", ListOptions{OrderBy: SortByCreatedAt}, "2024-05-01T12:30:00.123456Z"},
+		{"with a filter", ListOptions{OrderBy: SortById, Filter: Filter{EmailDomain: "example.com"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := NewCursor(user, tt.opts).Encode()
+			c, err := DecodeCursor(token, tt.opts)
+			if err != nil {
+				t.Fatalf("DecodeCursor() error = %v", err)
+			}
+			if c.Id != user.Id || c.Key != tt.wantKey {
+				t.Errorf("DecodeCursor() = %+v, want id %d and key %q", c, user.Id, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	opts := ListOptions{OrderBy: SortById}
+	token := NewCursor(model.User{Id: 20}, opts).Encode()
+	badTime := Cursor{Key: "yesterday", Id: 1, Query: fingerprint(ListOptions{OrderBy: SortByCreatedAt})}.Encode()
+
+	tests := []struct {
+		name  string
+		token string
+		opts  ListOptions
+	}{
+		{"not base64", "not a token!", opts},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("{")), opts},
+		{"other order", token, ListOptions{OrderBy: SortByName}},
+		{"other direction", token, ListOptions{OrderBy: SortById, Desc: true}},
+		{"other filter", token, ListOptions{OrderBy: SortById, Filter: Filter{NamePrefix: "J"}}},
+		{"audit token", NewAuditCursor(model.AuditEvent{Id: 3, UserId: 20}).Encode(), opts},
+		{"bad created_at key", badTime, ListOptions{OrderBy: SortByCreatedAt}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeCursor(tt.token, tt.opts); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("DecodeCursor() error = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorEmpty(t *testing.T) {
+	c, err := DecodeCursor("", ListOptions{})
+	if c != nil || err != nil {
+		t.Errorf("DecodeCursor(\"\") = %v, %v; want nil, nil", c, err)
+	}
+}
+
+func TestAuditAndWatchCursors(t *testing.T) {
+	token := NewAuditCursor(model.AuditEvent{Id: 42, UserId: 7}).Encode()
+	if id, err := DecodeAuditCursor(token, 7); id != 42 || err != nil {
+		t.Errorf("DecodeAuditCursor() = %d, %v; want 42, nil", id, err)
+	}
+	if _, err := DecodeAuditCursor(token, 8); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("DecodeAuditCursor() for another user error = %v, want ErrInvalidCursor", err)
+	}
+	if id, err := DecodeWatchCursor(NewWatchCursor(99).Encode()); id != 99 || err != nil {
+		t.Errorf("DecodeWatchCursor() = %d, %v; want 99, nil", id, err)
+	}
+	if _, err := DecodeWatchCursor(token); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("DecodeWatchCursor() of an audit token error = %v, want ErrInvalidCursor", err)
+	}
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidOrderBy is returned by ParseOrderBy for unknown fields or directions.
+var ErrInvalidOrderBy = errors.New("repository: invalid order_by")
+
+// SortField is a users column a listing can be ordered by. Each one is
+// indexed together with id, which breaks ties.
+type SortField string
+
+const (
+	SortById        SortField = "id"
+	SortByName      SortField = "name"
+	SortByEmail     SortField = "email"
+	SortByCreatedAt SortField = "created_at"
+)
+
+var sortFields = map[SortField]bool{
+	SortById:        true,
+	SortByName:      true,
+	SortByEmail:     true,
+	SortByCreatedAt: true,
+}
+
+// ParseOrderBy parses "<field>" or "<field> asc|desc". An empty string
+// orders by id ascending.
+func ParseOrderBy(s string) (field SortField, desc bool, err error) {
+	parts := strings.Fields(s)
+	switch len(parts) {
+	case 0:
+		return SortById, false, nil
+	case 1:
+	case 2:
+		switch strings.ToLower(parts[1]) {
+		case "asc":
+		case "desc":
+			desc = true
+		default:
+			return "", false, ErrInvalidOrderBy
+		}
+	default:
+		return "", false, ErrInvalidOrderBy
+	}
+	field = SortField(parts[0])
+	if !sortFields[field] {
+		return "", false, ErrInvalidOrderBy
+	}
+	return field, desc, nil
+}
+
+// Filter narrows a listing. Zero fields match everything.
+type Filter struct {
+	// EmailDomain matches the part of the email after '@', case-insensitively.
+	EmailDomain string
+	// NamePrefix matches names starting with it, case-sensitively.
+	NamePrefix string
+	// CreatedAfter is an inclusive lower bound on CreatedAt.
+	CreatedAfter *time.Time
+	// CreatedBefore is an exclusive upper bound on CreatedAt.
+	CreatedBefore *time.Time
+	Status        string
+}
+
+// ListOptions selects a page of users.
+type ListOptions struct {
+	Filter  Filter
+	OrderBy SortField
+	Desc    bool
+	// After is the position of the last row of the previous page, nil for
+	// the first page.
+	After *Cursor
+	Limit int
+}
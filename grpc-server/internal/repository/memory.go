@@ -0,0 +1,723 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"grpc-server/internal/audit"
+	"grpc-server/internal/model"
+	"grpc-server/internal/outbox"
+)
+
+// MemoryUserRepository is an in-memory UserRepository for tests and local
+// development. It mirrors the semantics of PostgresUserRepository.
+type MemoryUserRepository struct {
+	notifier
+	mu     sync.RWMutex
+	nextId int64
+	users  map[int64]model.User
+	events []model.AuditEvent
+	// published holds the outbox event of each entry in events.
+	published []outbox.Event
+	// verifications holds the pending email verification of each user.
+	verifications map[int64]model.EmailVerification
+	// resets holds the pending password reset of each user.
+	resets map[int64]model.PasswordReset
+	// refreshTokens holds unused refresh tokens by hash.
+	refreshTokens map[string]model.RefreshToken
+	nextAPIKeyId  int64
+	apiKeys       []model.APIKey
+
+	nextMessageId int64
+	outbox        []memoryMessage
+	deadLetters   []memoryMessage
+}
+
+// memoryMessage is a message in the outbox with its delivery state.
+type memoryMessage struct {
+	outbox.Message
+	lastError string
+	next      time.Time
+}
+
+// NewMemoryUserRepository returns an empty in-memory repository.
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:         make(map[int64]model.User),
+		verifications: make(map[int64]model.EmailVerification),
+		resets:        make(map[int64]model.PasswordReset),
+		refreshTokens: make(map[string]model.RefreshToken),
+	}
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, user *model.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.create(ctx, user)
+}
+
+func (r *MemoryUserRepository) CreateBatch(ctx context.Context, users []*model.User, atomic bool) ([]error, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if atomic {
+		// Check every user first so that a failure leaves nothing behind.
+		taken := r.emails()
+		for i, user := range users {
+			key := strings.ToLower(user.Email)
+			if taken[key] {
+				return nil, &BatchError{Index: i, Err: ErrEmailExists}
+			}
+			taken[key] = true
+		}
+	}
+	errs := make([]error, len(users))
+	for i, user := range users {
+		errs[i] = r.create(ctx, user)
+	}
+	return errs, nil
+}
+
+func (r *MemoryUserRepository) Import(ctx context.Context, users []*model.User, dryRun bool) ([]error, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	taken := r.emails()
+	errs := make([]error, len(users))
+	for i, user := range users {
+		if taken[strings.ToLower(user.Email)] {
+			errs[i] = ErrEmailExists
+			continue
+		}
+		if !dryRun {
+			errs[i] = r.create(ctx, user)
+		}
+	}
+	return errs, nil
+}
+
+// create inserts user, or returns ErrEmailExists. The caller holds r.mu.
+func (r *MemoryUserRepository) create(ctx context.Context, user *model.User) error {
+	if r.emailTaken(user.Email, 0) {
+		return ErrEmailExists
+	}
+	r.nextId++
+	user.Id = r.nextId
+	if user.Status == "" {
+		user.Status = model.StatusActive
+	}
+	user.Version = 1
+	user.CreatedAt = now()
+	user.UpdatedAt = user.CreatedAt
+	r.users[user.Id] = *user
+	r.record(ctx, model.OpCreate, nil, user)
+	return nil
+}
+
+// emails returns the lower-cased emails of live users. The caller holds r.mu.
+func (r *MemoryUserRepository) emails() map[string]bool {
+	taken := make(map[string]bool, len(r.users))
+	for _, user := range r.users {
+		if user.DeletedAt == nil {
+			taken[strings.ToLower(user.Email)] = true
+		}
+	}
+	return taken
+}
+
+// emailTaken reports whether a live user other than id uses email,
+// regardless of case, like the unique index of the users table. The caller
+// holds r.mu.
+func (r *MemoryUserRepository) emailTaken(email string, id int64) bool {
+	for _, user := range r.users {
+		if user.Id != id && user.DeletedAt == nil && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *MemoryUserRepository) Get(ctx context.Context, id int64) (*model.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, user := range r.users {
+		if user.DeletedAt == nil && strings.EqualFold(user.Email, email) {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryUserRepository) GetBatch(ctx context.Context, ids []int64) ([]*model.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]*model.User, len(ids))
+	for i, id := range ids {
+		if user, ok := r.users[id]; ok && user.DeletedAt == nil {
+			users[i] = &user
+		}
+	}
+	return users, nil
+}
+
+func (r *MemoryUserRepository) Update(ctx context.Context, user *model.User) (*model.User, error) {
+	return r.Patch(ctx, user.Id, user.Version, updatePatch(user))
+}
+
+func (r *MemoryUserRepository) Patch(ctx context.Context, id, version int64, patch UserPatch) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.users[id]
+	if !ok || stored.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	if version != 0 && version != stored.Version {
+		return nil, ErrVersionMismatch
+	}
+	before := stored
+	if patch.Name != nil {
+		stored.Name = *patch.Name
+	}
+	if patch.Email != nil {
+		if r.emailTaken(*patch.Email, id) {
+			return nil, ErrEmailExists
+		}
+		if *patch.Email != stored.Email {
+			stored.EmailVerifiedAt = nil
+		}
+		stored.Email = *patch.Email
+	}
+	if patch.Password != nil {
+		stored.Password = *patch.Password
+		delete(r.resets, id)
+	}
+	if patch.Status != nil {
+		stored.Status = *patch.Status
+	}
+	stored.Version++
+	stored.UpdatedAt = now()
+	r.users[id] = stored
+	r.record(ctx, model.OpUpdate, &before, &stored)
+	return &stored, nil
+}
+
+func (r *MemoryUserRepository) Delete(ctx context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.delete(ctx, id)
+}
+
+func (r *MemoryUserRepository) DeleteBatch(ctx context.Context, ids []int64, atomic bool) ([]error, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if atomic {
+		// Check every item first, so a failure leaves nothing to undo.
+		seen := make(map[int64]bool, len(ids))
+		for i, id := range ids {
+			user, ok := r.users[id]
+			if !ok || user.DeletedAt != nil || seen[id] {
+				return nil, &BatchError{Index: i, Err: ErrNotFound}
+			}
+			seen[id] = true
+		}
+	}
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		errs[i] = r.delete(ctx, id)
+	}
+	return errs, nil
+}
+
+// delete soft-deletes the user with the given id. The caller holds r.mu.
+func (r *MemoryUserRepository) delete(ctx context.Context, id int64) error {
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return ErrNotFound
+	}
+	before := user
+	deletedAt := now()
+	user.DeletedAt = &deletedAt
+	user.Version++
+	user.UpdatedAt = deletedAt
+	r.users[id] = user
+	r.record(ctx, model.OpDelete, &before, &user)
+	return nil
+}
+
+func (r *MemoryUserRepository) Restore(ctx context.Context, id int64) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	if r.emailTaken(user.Email, id) {
+		return nil, ErrEmailExists
+	}
+	before := user
+	user.DeletedAt = nil
+	user.Version++
+	user.UpdatedAt = now()
+	r.users[id] = user
+	r.record(ctx, model.OpRestore, &before, &user)
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) SaveEmailVerification(ctx context.Context, v model.EmailVerification) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[v.UserId]; !ok {
+		// Postgres fails on the foreign key instead.
+		return false, ErrNotFound
+	}
+	if pending, ok := r.verifications[v.UserId]; ok && pending.Email == v.Email && pending.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+	r.verifications[v.UserId] = v
+	return true, nil
+}
+
+func (r *MemoryUserRepository) VerifyEmail(ctx context.Context, userId int64, nonce string) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[userId]
+	pending, pok := r.verifications[userId]
+	if !ok || user.DeletedAt != nil || !pok || pending.Nonce != nonce ||
+		pending.Email != user.Email || !pending.ExpiresAt.After(time.Now()) {
+		return nil, ErrVerificationNotFound
+	}
+	delete(r.verifications, userId)
+	before := user
+	verifiedAt := now()
+	user.EmailVerifiedAt = &verifiedAt
+	user.Version++
+	user.UpdatedAt = verifiedAt
+	r.users[userId] = user
+	r.record(ctx, model.OpUpdate, &before, &user)
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) SavePasswordReset(ctx context.Context, reset model.PasswordReset) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[reset.UserId]; !ok {
+		return ErrNotFound
+	}
+	r.resets[reset.UserId] = reset
+	return nil
+}
+
+func (r *MemoryUserRepository) ResetPassword(ctx context.Context, tokenHash []byte, password string) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for userId, reset := range r.resets {
+		if !bytes.Equal(reset.TokenHash, tokenHash) {
+			continue
+		}
+		delete(r.resets, userId)
+		user, ok := r.users[userId]
+		if !ok || user.DeletedAt != nil || !reset.ExpiresAt.After(time.Now()) {
+			break
+		}
+		before := user
+		user.Password = password
+		user.Version++
+		user.UpdatedAt = now()
+		r.users[userId] = user
+		r.revokeRefreshTokens(userId)
+		r.record(ctx, model.OpUpdate, &before, &user)
+		return &user, nil
+	}
+	return nil, ErrPasswordResetNotFound
+}
+
+func (r *MemoryUserRepository) RecordLogin(ctx context.Context, id int64, password string) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	loginAt := now()
+	user.LastLoginAt = &loginAt
+	if password != "" {
+		user.Password = password
+	}
+	r.users[id] = user
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) SaveRefreshToken(ctx context.Context, t model.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[t.UserId]; !ok {
+		return ErrNotFound
+	}
+	r.refreshTokens[string(t.TokenHash)] = t
+	return nil
+}
+
+func (r *MemoryUserRepository) UseRefreshToken(ctx context.Context, tokenHash []byte) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.refreshTokens[string(tokenHash)]
+	if !ok || !t.ExpiresAt.After(time.Now()) {
+		return 0, ErrRefreshTokenNotFound
+	}
+	delete(r.refreshTokens, string(tokenHash))
+	return t.UserId, nil
+}
+
+// revokeRefreshTokens forgets the refresh tokens of a user. The caller holds
+// r.mu.
+func (r *MemoryUserRepository) revokeRefreshTokens(userId int64) {
+	for key, t := range r.refreshTokens {
+		if t.UserId == userId {
+			delete(r.refreshTokens, key)
+		}
+	}
+}
+
+func (r *MemoryUserRepository) CreateAPIKey(ctx context.Context, key *model.APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.apiKeys {
+		if k.Prefix == key.Prefix || bytes.Equal(k.KeyHash, key.KeyHash) {
+			return errors.New("repository: duplicate API key")
+		}
+	}
+	r.nextAPIKeyId++
+	key.Id, key.CreatedAt = r.nextAPIKeyId, now()
+	r.apiKeys = append(r.apiKeys, *key)
+	return nil
+}
+
+func (r *MemoryUserRepository) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]model.APIKey(nil), r.apiKeys...), nil
+}
+
+func (r *MemoryUserRepository) RevokeAPIKey(ctx context.Context, id int64) (*model.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.apiKeys {
+		key := &r.apiKeys[i]
+		if key.Id != id {
+			continue
+		}
+		if key.RevokedAt == nil {
+			revokedAt := now()
+			key.RevokedAt = &revokedAt
+		}
+		revoked := *key
+		return &revoked, nil
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (r *MemoryUserRepository) UseAPIKey(ctx context.Context, keyHash []byte) (*model.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	usedAt := now()
+	for i := range r.apiKeys {
+		key := &r.apiKeys[i]
+		if !bytes.Equal(key.KeyHash, keyHash) {
+			continue
+		}
+		if key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(usedAt)) {
+			break
+		}
+		if key.LastUsedAt == nil || usedAt.Sub(*key.LastUsedAt) >= apiKeyUseInterval {
+			key.LastUsedAt = &usedAt
+		}
+		used := *key
+		return &used, nil
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (r *MemoryUserRepository) Purge(ctx context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(r.users, id)
+	delete(r.verifications, id)
+	delete(r.resets, id)
+	r.revokeRefreshTokens(id)
+	r.record(ctx, model.OpPurge, &user, nil)
+	return nil
+}
+
+func (r *MemoryUserRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for id, user := range r.users {
+		if user.DeletedAt != nil && user.DeletedAt.Before(before) {
+			delete(r.users, id)
+			delete(r.verifications, id)
+			delete(r.resets, id)
+			r.revokeRefreshTokens(id)
+			r.record(ctx, model.OpPurge, &user, nil)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *MemoryUserRepository) List(ctx context.Context, opts ListOptions) ([]model.User, error) {
+	if !sortFields[opts.OrderBy] {
+		return nil, ErrInvalidOrderBy
+	}
+	var after *model.User
+	if c := opts.After; c != nil {
+		after = &model.User{Id: c.Id, Name: c.Key, Email: c.Key}
+		if opts.OrderBy == SortByCreatedAt {
+			at, err := c.createdAt()
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			after.CreatedAt = at
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var users []model.User
+	for _, user := range r.users {
+		if user.DeletedAt != nil || !matches(user, opts.Filter) {
+			continue
+		}
+		if after != nil && !less(*after, user, opts) {
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return less(users[i], users[j], opts) })
+	if len(users) > opts.Limit {
+		users = users[:opts.Limit]
+	}
+	return users, nil
+}
+
+func (r *MemoryUserRepository) Export(ctx context.Context, fn func(user *model.User) error) error {
+	// Copying the users gives the snapshot; memory use is not a concern for
+	// this repository.
+	r.mu.RLock()
+	users := make([]model.User, 0, len(r.users))
+	for _, user := range r.users {
+		if user.DeletedAt == nil {
+			users = append(users, user)
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	for i := range users {
+		if err := fn(&users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) ListAuditEvents(ctx context.Context, userId int64, opts AuditListOptions) ([]model.AuditEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var events []model.AuditEvent
+	for i := len(r.events) - 1; i >= 0 && len(events) < opts.Limit; i-- {
+		event := r.events[i]
+		if event.UserId == userId && (opts.Before == 0 || event.Id < opts.Before) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// record appends the audit event and the outbox message for a mutation. The caller holds r.mu.
+func (r *MemoryUserRepository) record(ctx context.Context, op string, before, after *model.User) {
+	event := audit.NewEvent(ctx, op, before, after)
+	event.Id = int64(len(r.events)) + 1
+	event.CreatedAt = time.Now().UTC()
+	r.events = append(r.events, event)
+
+	published := outbox.NewEvent(event, after)
+	r.published = append(r.published, published)
+	payload, _ := json.Marshal(published)
+	r.nextMessageId++
+	r.outbox = append(r.outbox, memoryMessage{
+		Message: outbox.Message{Id: r.nextMessageId, UserId: event.UserId, Payload: payload},
+	})
+	r.notify()
+}
+
+func (r *MemoryUserRepository) ListEvents(ctx context.Context, after int64, limit int) ([]outbox.Event, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var events []outbox.Event
+	for _, event := range r.published {
+		if len(events) == limit {
+			break
+		}
+		if event.Id > after {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (r *MemoryUserRepository) LatestEventId(ctx context.Context) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return int64(len(r.events)), nil
+}
+
+func (r *MemoryUserRepository) Pending(ctx context.Context, limit int) ([]outbox.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	waiting := make(map[int64]bool)
+	var msgs []outbox.Message
+	for _, m := range r.outbox {
+		if len(msgs) == limit {
+			break
+		}
+		if m.next.After(now) {
+			waiting[m.UserId] = true
+		}
+		if !waiting[m.UserId] {
+			msgs = append(msgs, m.Message)
+		}
+	}
+	return msgs, nil
+}
+
+func (r *MemoryUserRepository) Delivered(ctx context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeMessage(id)
+	return nil
+}
+
+func (r *MemoryUserRepository) Failed(ctx context.Context, id int64, cause string, next time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.outbox {
+		if m := &r.outbox[i]; m.Id == id {
+			m.Attempts++
+			m.lastError = cause
+			m.next = next
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) DeadLetter(ctx context.Context, id int64, cause string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.removeMessage(id); ok {
+		m.Attempts++
+		m.lastError = cause
+		r.deadLetters = append(r.deadLetters, m)
+	}
+	return nil
+}
+
+// removeMessage removes a message from the outbox. The caller holds r.mu.
+func (r *MemoryUserRepository) removeMessage(id int64) (memoryMessage, bool) {
+	for i, m := range r.outbox {
+		if m.Id == id {
+			r.outbox = append(r.outbox[:i], r.outbox[i+1:]...)
+			return m, true
+		}
+	}
+	return memoryMessage{}, false
+}
+
+// now returns the current time as Postgres would store it, in microseconds.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func matches(user model.User, f Filter) bool {
+	if f.EmailDomain != "" {
+		_, domain, _ := strings.Cut(user.Email, "@")
+		if !strings.EqualFold(domain, f.EmailDomain) {
+			return false
+		}
+	}
+	if f.NamePrefix != "" && !strings.HasPrefix(user.Name, f.NamePrefix) {
+		return false
+	}
+	if f.CreatedAfter != nil && user.CreatedAt.Before(*f.CreatedAfter) {
+		return false
+	}
+	if f.CreatedBefore != nil && !user.CreatedAt.Before(*f.CreatedBefore) {
+		return false
+	}
+	if f.Status != "" && user.Status != f.Status {
+		return false
+	}
+	return true
+}
+
+// less reports whether a sorts before b in the listing order.
+func less(a, b model.User, opts ListOptions) bool {
+	var cmp int
+	switch opts.OrderBy {
+	case SortByName:
+		cmp = strings.Compare(a.Name, b.Name)
+	case SortByEmail:
+		cmp = strings.Compare(a.Email, b.Email)
+	case SortByCreatedAt:
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if cmp == 0 {
+		switch {
+		case a.Id < b.Id:
+			cmp = -1
+		case a.Id > b.Id:
+			cmp = 1
+		}
+	}
+	if opts.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (r *MemoryUserRepository) UpgradePasswords(ctx context.Context, legacy func(stored string) bool, upgrade func(stored string) (string, error)) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var upgraded int64
+	for id, user := range r.users {
+		if !legacy(user.Password) {
+			continue
+		}
+		hash, err := upgrade(user.Password)
+		if err != nil {
+			return upgraded, err
+		}
+		user.Password = hash
+		r.users[id] = user
+		upgraded++
+	}
+	return upgraded, nil
+}
@@ -0,0 +1,39 @@
+package repository
+
+import "sync"
+
+// notifier wakes up subscribers when new events may have been recorded. The
+// zero value is ready to use.
+type notifier struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+// Subscribe returns a channel that receives a value after new events are
+// recorded, and a func that unsubscribes it. Wake-ups are coalesced: a slow
+// subscriber sees one value for any number of events.
+func (n *notifier) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subs == nil {
+		n.subs = make(map[chan struct{}]struct{})
+	}
+	n.subs[ch] = struct{}{}
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subs, ch)
+	}
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
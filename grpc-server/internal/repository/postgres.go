@@ -0,0 +1,939 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"grpc-server/internal/audit"
+	"grpc-server/internal/model"
+	"grpc-server/internal/outbox"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// userColumns lists the columns scanned into model.User.
+const userColumns = "id, name, email, password, status, version, created_at, updated_at, last_login_at, email_verified_at, deleted_at"
+
+// emailIndex keeps the emails of live users unique regardless of case.
+const emailIndex = "users_email_lower_key"
+
+// PostgresUserRepository is a UserRepository backed by the users table.
+type PostgresUserRepository struct {
+	notifier
+	db *sqlx.DB
+}
+
+// NewPostgresUserRepository returns a repository using db.
+func NewPostgresUserRepository(db *sqlx.DB) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) Create(ctx context.Context, user *model.User) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		return r.create(ctx, tx, user)
+	})
+}
+
+func (r *PostgresUserRepository) CreateBatch(ctx context.Context, users []*model.User, atomic bool) ([]error, error) {
+	return r.batch(ctx, len(users), atomic, func(tx *sqlx.Tx, i int) error {
+		return r.create(ctx, tx, users[i])
+	})
+}
+
+func (r *PostgresUserRepository) create(ctx context.Context, tx *sqlx.Tx, user *model.User) error {
+	query := `INSERT INTO users (name, email, password, status) VALUES ($1, $2, $3, COALESCE(NULLIF($4, ''), 'active'))
+		RETURNING id, status, version, created_at, updated_at`
+	err := tx.QueryRowxContext(ctx, query, user.Name, user.Email, user.Password, user.Status).
+		Scan(&user.Id, &user.Status, &user.Version, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return uniqueEmail(err)
+	}
+	return r.record(ctx, tx, model.OpCreate, nil, user)
+}
+
+func (r *PostgresUserRepository) Get(ctx context.Context, id int64) (*model.User, error) {
+	return getUser(ctx, r.db, "SELECT "+userColumns+" FROM users WHERE id=$1 AND deleted_at IS NULL", id)
+}
+
+func (r *PostgresUserRepository) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	return getUser(ctx, r.db, "SELECT "+userColumns+" FROM users WHERE lower(email)=lower($1) AND deleted_at IS NULL", email)
+}
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("repository: dry run")
+
+func (r *PostgresUserRepository) Import(ctx context.Context, users []*model.User, dryRun bool) ([]error, error) {
+	errs := make([]error, len(users))
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "CREATE TEMP TABLE import_users (name TEXT, email TEXT, password TEXT, status TEXT) ON COMMIT DROP")
+		if err != nil {
+			return err
+		}
+		err = copyIn(ctx, tx, "import_users", []string{"name", "email", "password", "status"}, len(users), func(i int) []interface{} {
+			u := users[i]
+			return []interface{}{u.Name, u.Email, u.Password, u.Status}
+		})
+		if err != nil {
+			return err
+		}
+
+		var inserted []model.User
+		err = tx.SelectContext(ctx, &inserted, `INSERT INTO users (name, email, password, status)
+			SELECT name, email, password, COALESCE(NULLIF(status, ''), 'active') FROM import_users
+			ON CONFLICT (lower(email)) WHERE deleted_at IS NULL DO NOTHING
+			RETURNING `+userColumns)
+		if err != nil {
+			return err
+		}
+		// RETURNING gives no row order, but emails are unique in the batch.
+		// Rows whose email is taken, even by a user created concurrently,
+		// are skipped and reported below.
+		byEmail := make(map[string]*model.User, len(inserted))
+		for i := range inserted {
+			byEmail[inserted[i].Email] = &inserted[i]
+		}
+		var created []*model.User
+		for i, user := range users {
+			stored, ok := byEmail[user.Email]
+			if !ok {
+				errs[i] = ErrEmailExists
+				continue
+			}
+			*user = *stored
+			created = append(created, user)
+		}
+		if err := r.recordAll(ctx, tx, created); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if dryRun && errors.Is(err, errDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+func (r *PostgresUserRepository) GetBatch(ctx context.Context, ids []int64) ([]*model.User, error) {
+	var found []model.User
+	err := r.db.SelectContext(ctx, &found,
+		"SELECT "+userColumns+" FROM users WHERE id = ANY($1) AND deleted_at IS NULL", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[int64]*model.User, len(found))
+	for i := range found {
+		byId[found[i].Id] = &found[i]
+	}
+	users := make([]*model.User, len(ids))
+	for i, id := range ids {
+		users[i] = byId[id]
+	}
+	return users, nil
+}
+
+func (r *PostgresUserRepository) Update(ctx context.Context, user *model.User) (*model.User, error) {
+	return r.Patch(ctx, user.Id, user.Version, updatePatch(user))
+}
+
+func (r *PostgresUserRepository) Patch(ctx context.Context, id, version int64, patch UserPatch) (*model.User, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	sets := []string{"version=version+1", "updated_at=now()"}
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"name", patch.Name},
+		{"email", patch.Email},
+		{"password", patch.Password},
+		{"status", patch.Status},
+	} {
+		if field.value != nil {
+			sets = append(sets, field.column+"="+arg(*field.value))
+		}
+	}
+	if patch.Email != nil {
+		// SET expressions see the old email.
+		sets = append(sets, "email_verified_at=CASE WHEN email="+arg(*patch.Email)+" THEN email_verified_at END")
+	}
+	query := "UPDATE users SET " + strings.Join(sets, ", ") + " WHERE id=" + arg(id) + " RETURNING " + userColumns
+
+	var stored *model.User
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		before, err := getUser(ctx, tx, "SELECT "+userColumns+" FROM users WHERE id=$1 AND deleted_at IS NULL FOR UPDATE", id)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return ErrVersionMismatch
+		}
+		if stored, err = getUser(ctx, tx, query, args...); err != nil {
+			return err
+		}
+		if patch.Password != nil {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM user_password_resets WHERE user_id=$1", id); err != nil {
+				return err
+			}
+		}
+		return r.record(ctx, tx, model.OpUpdate, before, stored)
+	})
+	return stored, err
+}
+
+func (r *PostgresUserRepository) Delete(ctx context.Context, id int64) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		return r.delete(ctx, tx, id)
+	})
+}
+
+func (r *PostgresUserRepository) DeleteBatch(ctx context.Context, ids []int64, atomic bool) ([]error, error) {
+	return r.batch(ctx, len(ids), atomic, func(tx *sqlx.Tx, i int) error {
+		return r.delete(ctx, tx, ids[i])
+	})
+}
+
+func (r *PostgresUserRepository) delete(ctx context.Context, tx *sqlx.Tx, id int64) error {
+	before, err := getUser(ctx, tx, "SELECT "+userColumns+" FROM users WHERE id=$1 AND deleted_at IS NULL FOR UPDATE", id)
+	if err != nil {
+		return err
+	}
+	after, err := getUser(ctx, tx, "UPDATE users SET deleted_at=now(), version=version+1, updated_at=now() WHERE id=$1 RETURNING "+userColumns, id)
+	if err != nil {
+		return err
+	}
+	return r.record(ctx, tx, model.OpDelete, before, after)
+}
+
+func (r *PostgresUserRepository) Restore(ctx context.Context, id int64) (*model.User, error) {
+	var after *model.User
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		before, err := getUser(ctx, tx, "SELECT "+userColumns+" FROM users WHERE id=$1 AND deleted_at IS NOT NULL FOR UPDATE", id)
+		if err != nil {
+			return err
+		}
+		after, err = getUser(ctx, tx, "UPDATE users SET deleted_at=NULL, version=version+1, updated_at=now() WHERE id=$1 RETURNING "+userColumns, id)
+		if err != nil {
+			return err
+		}
+		return r.record(ctx, tx, model.OpRestore, before, after)
+	})
+	return after, err
+}
+
+func (r *PostgresUserRepository) SaveEmailVerification(ctx context.Context, v model.EmailVerification) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `INSERT INTO user_email_verifications (user_id, email, nonce, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET email=excluded.email, nonce=excluded.nonce, expires_at=excluded.expires_at, created_at=now()
+		WHERE user_email_verifications.email <> excluded.email OR user_email_verifications.expires_at <= now()`,
+		v.UserId, v.Email, v.Nonce, v.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *PostgresUserRepository) VerifyEmail(ctx context.Context, userId int64, nonce string) (*model.User, error) {
+	var after *model.User
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		before, err := getUser(ctx, tx, "SELECT "+userColumns+" FROM users WHERE id=$1 AND deleted_at IS NULL FOR UPDATE", userId)
+		if errors.Is(err, ErrNotFound) {
+			return ErrVerificationNotFound
+		}
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM user_email_verifications
+			WHERE user_id=$1 AND nonce=$2 AND email=$3 AND expires_at > now()`, userId, nonce, before.Email)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrVerificationNotFound
+		}
+		after, err = getUser(ctx, tx, `UPDATE users SET email_verified_at=now(), version=version+1, updated_at=now()
+			WHERE id=$1 RETURNING `+userColumns, userId)
+		if err != nil {
+			return err
+		}
+		return r.record(ctx, tx, model.OpUpdate, before, after)
+	})
+	return after, err
+}
+
+func (r *PostgresUserRepository) SavePasswordReset(ctx context.Context, reset model.PasswordReset) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO user_password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET token_hash=excluded.token_hash, expires_at=excluded.expires_at, created_at=now()`,
+		reset.UserId, reset.TokenHash, reset.ExpiresAt)
+	return err
+}
+
+func (r *PostgresUserRepository) ResetPassword(ctx context.Context, tokenHash []byte, password string) (*model.User, error) {
+	var after *model.User
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		var userId int64
+		err := tx.GetContext(ctx, &userId, `DELETE FROM user_password_resets
+			WHERE token_hash=$1 AND expires_at > now() RETURNING user_id`, tokenHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPasswordResetNotFound
+		}
+		if err != nil {
+			return err
+		}
+		before, err := getUser(ctx, tx, "SELECT "+userColumns+" FROM users WHERE id=$1 AND deleted_at IS NULL FOR UPDATE", userId)
+		if errors.Is(err, ErrNotFound) {
+			return ErrPasswordResetNotFound
+		}
+		if err != nil {
+			return err
+		}
+		after, err = getUser(ctx, tx, `UPDATE users SET password=$2, version=version+1, updated_at=now()
+			WHERE id=$1 RETURNING `+userColumns, userId, password)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM user_refresh_tokens WHERE user_id=$1", userId); err != nil {
+			return err
+		}
+		return r.record(ctx, tx, model.OpUpdate, before, after)
+	})
+	return after, err
+}
+
+func (r *PostgresUserRepository) RecordLogin(ctx context.Context, id int64, password string) (*model.User, error) {
+	return getUser(ctx, r.db, `UPDATE users SET last_login_at=now(), password=COALESCE(NULLIF($2, ''), password)
+		WHERE id=$1 AND deleted_at IS NULL RETURNING `+userColumns, id, password)
+}
+
+func (r *PostgresUserRepository) SaveRefreshToken(ctx context.Context, t model.RefreshToken) error {
+	_, err := r.db.ExecContext(ctx, "INSERT INTO user_refresh_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		t.TokenHash, t.UserId, t.ExpiresAt)
+	return err
+}
+
+func (r *PostgresUserRepository) UseRefreshToken(ctx context.Context, tokenHash []byte) (int64, error) {
+	var userId int64
+	err := r.db.GetContext(ctx, &userId,
+		"DELETE FROM user_refresh_tokens WHERE token_hash=$1 AND expires_at > now() RETURNING user_id", tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrRefreshTokenNotFound
+	}
+	return userId, err
+}
+
+const apiKeyColumns = "id, name, prefix, key_hash, scopes, expires_at, last_used_at, created_at, revoked_at"
+
+// apiKeyRow scans an api_keys row, with the scopes array decoded by pq.
+type apiKeyRow struct {
+	model.APIKey
+	Scopes pq.StringArray `db:"scopes"`
+}
+
+func (row apiKeyRow) key() *model.APIKey {
+	key := row.APIKey
+	key.Scopes = row.Scopes
+	return &key
+}
+
+// getAPIKey runs a query returning one api_keys row, mapping no rows to
+// ErrAPIKeyNotFound.
+func getAPIKey(ctx context.Context, q sqlx.QueryerContext, query string, args ...interface{}) (*model.APIKey, error) {
+	var row apiKeyRow
+	err := sqlx.GetContext(ctx, q, &row, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row.key(), nil
+}
+
+func (r *PostgresUserRepository) CreateAPIKey(ctx context.Context, key *model.APIKey) error {
+	return r.db.QueryRowxContext(ctx, `INSERT INTO api_keys (name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		key.Name, key.Prefix, key.KeyHash, pq.Array(key.Scopes), key.ExpiresAt).Scan(&key.Id, &key.CreatedAt)
+}
+
+func (r *PostgresUserRepository) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	var rows []apiKeyRow
+	if err := r.db.SelectContext(ctx, &rows, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id"); err != nil {
+		return nil, err
+	}
+	keys := make([]model.APIKey, len(rows))
+	for i, row := range rows {
+		keys[i] = *row.key()
+	}
+	return keys, nil
+}
+
+func (r *PostgresUserRepository) RevokeAPIKey(ctx context.Context, id int64) (*model.APIKey, error) {
+	return getAPIKey(ctx, r.db, `UPDATE api_keys SET revoked_at=COALESCE(revoked_at, now())
+		WHERE id=$1 RETURNING `+apiKeyColumns, id)
+}
+
+func (r *PostgresUserRepository) UseAPIKey(ctx context.Context, keyHash []byte) (*model.APIKey, error) {
+	key, err := getAPIKey(ctx, r.db, "SELECT "+apiKeyColumns+` FROM api_keys
+		WHERE key_hash=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	if key.LastUsedAt != nil && time.Since(*key.LastUsedAt) < apiKeyUseInterval {
+		return key, nil
+	}
+	err = r.db.GetContext(ctx, &key.LastUsedAt, "UPDATE api_keys SET last_used_at=now() WHERE id=$1 RETURNING last_used_at", key.Id)
+	return key, err
+}
+
+func (r *PostgresUserRepository) Purge(ctx context.Context, id int64) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		before, err := getUser(ctx, tx, "DELETE FROM users WHERE id=$1 RETURNING "+userColumns, id)
+		if err != nil {
+			return err
+		}
+		return r.record(ctx, tx, model.OpPurge, before, nil)
+	})
+}
+
+func (r *PostgresUserRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	var n int64
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		var purged []model.User
+		err := tx.SelectContext(ctx, &purged, "DELETE FROM users WHERE deleted_at < $1 RETURNING "+userColumns, before)
+		if err != nil {
+			return err
+		}
+		for i := range purged {
+			if err := r.record(ctx, tx, model.OpPurge, &purged[i], nil); err != nil {
+				return err
+			}
+		}
+		n = int64(len(purged))
+		return nil
+	})
+	return n, err
+}
+
+func (r *PostgresUserRepository) Export(ctx context.Context, fn func(user *model.User) error) error {
+	tx, err := r.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Rows are read from the connection as they are scanned, not buffered.
+	rows, err := tx.QueryxContext(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user model.User
+		if err := rows.StructScan(&user); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *PostgresUserRepository) ListAuditEvents(ctx context.Context, userId int64, opts AuditListOptions) ([]model.AuditEvent, error) {
+	query := "SELECT id, user_id, actor, operation, changes, request_id, created_at FROM user_audit_events WHERE user_id=$1"
+	args := []interface{}{userId}
+	if opts.Before != 0 {
+		query += " AND id < $2"
+		args = append(args, opts.Before)
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", opts.Limit)
+
+	rows, err := r.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []model.AuditEvent
+	for rows.Next() {
+		var event model.AuditEvent
+		var changes []byte
+		err := rows.Scan(&event.Id, &event.UserId, &event.Actor, &event.Operation, &changes, &event.RequestId, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &event.Changes); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// eventsChannel is notified whenever events are recorded.
+const eventsChannel = "user_events"
+
+// record writes the audit event and the outbox message for a mutation in the
+// mutation's transaction.
+func (r *PostgresUserRepository) record(ctx context.Context, tx *sqlx.Tx, op string, before, after *model.User) error {
+	if err := assignTxId(ctx, tx); err != nil {
+		return err
+	}
+	event := audit.NewEvent(ctx, op, before, after)
+	err := tx.QueryRowxContext(ctx, "SELECT nextval('user_audit_events_id_seq'), now()").Scan(&event.Id, &event.CreatedAt)
+	if err != nil {
+		return err
+	}
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(outbox.NewEvent(event, after))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_audit_events (id, user_id, actor, operation, changes, request_id, created_at, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		event.Id, event.UserId, event.Actor, event.Operation, changes, event.RequestId, event.CreatedAt, payload)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO user_outbox (user_id, payload) VALUES ($1, $2)", event.UserId, payload); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "NOTIFY "+eventsChannel)
+	return err
+}
+
+// recordAll records the events for creating users, like record, using COPY
+// to write them in bulk.
+func (r *PostgresUserRepository) recordAll(ctx context.Context, tx *sqlx.Tx, users []*model.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	if err := assignTxId(ctx, tx); err != nil {
+		return err
+	}
+	var ids []int64
+	err := tx.SelectContext(ctx, &ids, "SELECT nextval('user_audit_events_id_seq') FROM generate_series(1, $1)", len(users))
+	if err != nil {
+		return err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var now time.Time
+	if err := tx.GetContext(ctx, &now, "SELECT now()"); err != nil {
+		return err
+	}
+
+	events := make([]model.AuditEvent, len(users))
+	changes := make([]string, len(users))
+	payloads := make([]string, len(users))
+	for i, user := range users {
+		events[i] = audit.NewEvent(ctx, model.OpCreate, nil, user)
+		events[i].Id = ids[i]
+		events[i].CreatedAt = now
+		c, err := json.Marshal(events[i].Changes)
+		if err != nil {
+			return err
+		}
+		p, err := json.Marshal(outbox.NewEvent(events[i], user))
+		if err != nil {
+			return err
+		}
+		// COPY would encode []byte as bytea.
+		changes[i], payloads[i] = string(c), string(p)
+	}
+	err = copyIn(ctx, tx, "user_audit_events",
+		[]string{"id", "user_id", "actor", "operation", "changes", "request_id", "created_at", "payload"},
+		len(events), func(i int) []interface{} {
+			e := events[i]
+			return []interface{}{e.Id, e.UserId, e.Actor, e.Operation, changes[i], e.RequestId, e.CreatedAt, payloads[i]}
+		})
+	if err != nil {
+		return err
+	}
+	err = copyIn(ctx, tx, "user_outbox", []string{"user_id", "payload"}, len(events), func(i int) []interface{} {
+		return []interface{}{events[i].UserId, payloads[i]}
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "NOTIFY "+eventsChannel)
+	return err
+}
+
+// assignTxId gives the transaction its id before it allocates event ids,
+// so eventsHorizon can wait for it to finish without blocking anyone.
+func assignTxId(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_current_xact_id()")
+	return err
+}
+
+// eventsHorizonPoll is how often eventsHorizon checks whether the
+// transactions it waits for have finished.
+const eventsHorizonPoll = 10 * time.Millisecond
+
+// eventsHorizon returns the highest event id allocated so far, once every
+// transaction that allocated one has finished. Events up to it can no longer
+// appear, so ListEvents readers never skip one that commits late.
+//
+// Recording transactions have an id before they allocate event ids, so any
+// of them still running after the sequence is read is in the snapshot taken
+// next. Only those transactions are waited for.
+func (r *PostgresUserRepository) eventsHorizon(ctx context.Context) (int64, error) {
+	var horizon int64
+	err := r.db.GetContext(ctx, &horizon,
+		"SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM user_audit_events_id_seq")
+	if err != nil {
+		return 0, err
+	}
+	var snapshot string
+	if err := r.db.GetContext(ctx, &snapshot, "SELECT pg_current_snapshot()::text"); err != nil {
+		return 0, err
+	}
+	for {
+		var running bool
+		err := r.db.GetContext(ctx, &running,
+			`SELECT EXISTS (SELECT 1 FROM pg_snapshot_xip($1::pg_snapshot) AS xid
+			WHERE pg_xact_status(xid) = 'in progress')`, snapshot)
+		if err != nil || !running {
+			return horizon, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(eventsHorizonPoll):
+		}
+	}
+}
+
+// copyIn loads n rows into table with COPY.
+func copyIn(ctx context.Context, tx *sqlx.Tx, table string, columns []string, n int, row func(i int) []interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := 0; i < n; i++ {
+		if _, err := stmt.ExecContext(ctx, row(i)...); err != nil {
+			return err
+		}
+	}
+	// An empty Exec flushes the buffered rows.
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+func (r *PostgresUserRepository) ListEvents(ctx context.Context, after int64, limit int) ([]outbox.Event, error) {
+	horizon, err := r.eventsHorizon(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryxContext(ctx,
+		"SELECT payload FROM user_audit_events WHERE id > $1 AND id <= $2 AND payload IS NOT NULL ORDER BY id LIMIT $3",
+		after, horizon, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []outbox.Event
+	for rows.Next() {
+		var payload []byte
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var event outbox.Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (r *PostgresUserRepository) LatestEventId(ctx context.Context) (int64, error) {
+	return r.eventsHorizon(ctx)
+}
+
+// Listen wakes up Subscribe channels when events are recorded, by this or
+// any other process sharing the database. It returns once listening.
+func (r *PostgresUserRepository) Listen(dataSourceName string) error {
+	l := pq.NewListener(dataSourceName, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Event listener: %v", err)
+		}
+	})
+	if err := l.Listen(eventsChannel); err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		for {
+			select {
+			// Notify also yields nil after reconnecting, when notifications
+			// may have been missed, so readers should check for events then too.
+			case <-l.Notify:
+				r.notify()
+			case <-time.After(90 * time.Second):
+				go l.Ping()
+			}
+		}
+	}()
+	return nil
+}
+
+// outboxLockKey identifies the advisory lock held by the outbox relay.
+const outboxLockKey = 7_311_944_020
+
+// Lock implements outbox.Locker with a Postgres advisory lock, held on a
+// dedicated connection until unlock is called.
+func (r *PostgresUserRepository) Lock(ctx context.Context) (func(), error) {
+	conn, err := r.db.Connx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", outboxLockKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", outboxLockKey)
+		conn.Close()
+	}, nil
+}
+
+func (r *PostgresUserRepository) Pending(ctx context.Context, limit int) ([]outbox.Message, error) {
+	// Skip messages queued behind an older one for the same user that is
+	// waiting to be retried.
+	rows, err := r.db.QueryxContext(ctx, `SELECT id, user_id, payload, attempts FROM user_outbox o
+		WHERE next_attempt_at <= now() AND NOT EXISTS (
+			SELECT 1 FROM user_outbox p WHERE p.user_id = o.user_id AND p.id < o.id AND p.next_attempt_at > now()
+		)
+		ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []outbox.Message
+	for rows.Next() {
+		var msg outbox.Message
+		var payload []byte
+		if err := rows.Scan(&msg.Id, &msg.UserId, &payload, &msg.Attempts); err != nil {
+			return nil, err
+		}
+		msg.Payload = payload
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (r *PostgresUserRepository) Delivered(ctx context.Context, id int64) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM user_outbox WHERE id=$1", id)
+	return err
+}
+
+func (r *PostgresUserRepository) Failed(ctx context.Context, id int64, cause string, next time.Time) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE user_outbox SET attempts=attempts+1, last_error=$2, next_attempt_at=$3 WHERE id=$1",
+		id, cause, next)
+	return err
+}
+
+func (r *PostgresUserRepository) DeadLetter(ctx context.Context, id int64, cause string) error {
+	_, err := r.db.ExecContext(ctx, `WITH moved AS (
+			DELETE FROM user_outbox WHERE id=$1 RETURNING id, user_id, payload, attempts, created_at
+		)
+		INSERT INTO user_outbox_dead_letters (id, user_id, payload, attempts, last_error, created_at)
+		SELECT id, user_id, payload, attempts+1, $2, created_at FROM moved`, id, cause)
+	return err
+}
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func (r *PostgresUserRepository) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// batch runs fn for items 0 to n-1 in one transaction and returns their
+// errors. If atomic, the first failure rolls back the transaction and is
+// returned as a *BatchError. Otherwise each item runs in a savepoint, so a
+// failure undoes only that item.
+func (r *PostgresUserRepository) batch(ctx context.Context, n int, atomic bool, fn func(tx *sqlx.Tx, i int) error) ([]error, error) {
+	errs := make([]error, n)
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		for i := 0; i < n; i++ {
+			if atomic {
+				if err := fn(tx, i); err != nil {
+					return &BatchError{Index: i, Err: err}
+				}
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+				return err
+			}
+			release := "RELEASE SAVEPOINT batch_item"
+			if errs[i] = fn(tx, i); errs[i] != nil {
+				release = "ROLLBACK TO SAVEPOINT batch_item"
+			}
+			if _, err := tx.ExecContext(ctx, release); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// getUser runs a query returning one user row, mapping no rows to ErrNotFound
+// and a taken email to ErrEmailExists.
+func getUser(ctx context.Context, q sqlx.QueryerContext, query string, args ...interface{}) (*model.User, error) {
+	var user model.User
+	err := sqlx.GetContext(ctx, q, &user, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, uniqueEmail(err)
+	}
+	return &user, nil
+}
+
+// uniqueEmail maps a violation of emailIndex to ErrEmailExists.
+func uniqueEmail(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == emailIndex {
+		return ErrEmailExists
+	}
+	return err
+}
+
+func (r *PostgresUserRepository) List(ctx context.Context, opts ListOptions) ([]model.User, error) {
+	// Only values are passed as parameters; column names come from the
+	// SortField whitelist, never from the request.
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{"deleted_at IS NULL"}
+	f := opts.Filter
+	if f.EmailDomain != "" {
+		where = append(where, "lower(split_part(email, '@', 2)) = lower("+arg(f.EmailDomain)+")")
+	}
+	if f.NamePrefix != "" {
+		where = append(where, "name LIKE "+arg(escapeLike(f.NamePrefix)+"%"))
+	}
+	if f.CreatedAfter != nil {
+		where = append(where, "created_at >= "+arg(*f.CreatedAfter))
+	}
+	if f.CreatedBefore != nil {
+		where = append(where, "created_at < "+arg(*f.CreatedBefore))
+	}
+	if f.Status != "" {
+		where = append(where, "status = "+arg(f.Status))
+	}
+
+	column := string(opts.OrderBy)
+	if !sortFields[opts.OrderBy] {
+		return nil, ErrInvalidOrderBy
+	}
+	op, dir := ">", "ASC"
+	if opts.Desc {
+		op, dir = "<", "DESC"
+	}
+	if c := opts.After; c != nil {
+		switch opts.OrderBy {
+		case SortById:
+			where = append(where, "id "+op+" "+arg(c.Id))
+		case SortByCreatedAt:
+			at, err := c.createdAt()
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			where = append(where, fmt.Sprintf("(created_at, id) %s (%s, %s)", op, arg(at), arg(c.Id)))
+		default:
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", column, op, arg(c.Key), arg(c.Id)))
+		}
+	}
+
+	query := "SELECT " + userColumns + " FROM users WHERE " + strings.Join(where, " AND ")
+	query += " ORDER BY " + column + " " + dir
+	if opts.OrderBy != SortById {
+		query += ", id " + dir
+	}
+	query += " LIMIT " + arg(opts.Limit)
+
+	var users []model.User
+	err := r.db.SelectContext(ctx, &users, query, args...)
+	return users, err
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (r *PostgresUserRepository) UpgradePasswords(ctx context.Context, legacy func(stored string) bool, upgrade func(stored string) (string, error)) (int64, error) {
+	// Hashes are recognized in SQL too, so that only candidates are read.
+	var rows []struct {
+		Id       int64  `db:"id"`
+		Password string `db:"password"`
+	}
+	err := r.db.SelectContext(ctx, &rows, `SELECT id, password FROM users
+		WHERE password <> '' AND password NOT LIKE '$argon2id$%' AND password !~ '^\$2[aby]\$' ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	var upgraded int64
+	for _, row := range rows {
+		if !legacy(row.Password) {
+			continue
+		}
+		hash, err := upgrade(row.Password)
+		if err != nil {
+			return upgraded, err
+		}
+		res, err := r.db.ExecContext(ctx, "UPDATE users SET password=$3 WHERE id=$1 AND password=$2", row.Id, row.Password, hash)
+		if err != nil {
+			return upgraded, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return upgraded, err
+		}
+		upgraded += n
+	}
+	return upgraded, nil
+}
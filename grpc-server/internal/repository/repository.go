@@ -0,0 +1,209 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"grpc-server/internal/model"
+	"grpc-server/internal/outbox"
+)
+
+// ErrNotFound is returned when no user matches the given id.
+var ErrNotFound = errors.New("repository: user not found")
+
+// ErrVersionMismatch is returned when an update expects a version other
+// than the stored one.
+var ErrVersionMismatch = errors.New("repository: user version mismatch")
+
+// ErrEmailExists is returned when an email is already used by another user.
+var ErrEmailExists = errors.New("repository: email already in use")
+
+// ErrVerificationNotFound is returned when a user has no pending email
+// verification with the given nonce, or it has expired.
+var ErrVerificationNotFound = errors.New("repository: email verification not found")
+
+// ErrPasswordResetNotFound is returned when no unexpired password reset has
+// the given token.
+var ErrPasswordResetNotFound = errors.New("repository: password reset not found")
+
+// ErrRefreshTokenNotFound is returned when no unexpired refresh token has
+// the given hash.
+var ErrRefreshTokenNotFound = errors.New("repository: refresh token not found")
+
+// ErrAPIKeyNotFound is returned when no API key has the given id, or no
+// usable API key has the given hash.
+var ErrAPIKeyNotFound = errors.New("repository: API key not found")
+
+// UserRepository persists users.
+//
+// Soft-deleted users are invisible to Get, Update, Delete and List.
+//
+// Every mutation records an audit event (see package audit) atomically
+// with the change, attributed to the audit.Metadata in its context.
+//
+// Implementations store the Password field as given; hashing is the caller's
+// job. Update leaves the stored password and status untouched when they are
+// empty. Create defaults Status to model.StatusActive. Update and Patch clear
+// EmailVerifiedAt when they change the email.
+type UserRepository interface {
+	// Create inserts user and sets its Id.
+	Create(ctx context.Context, user *model.User) error
+	// Get returns the user with the given id, or ErrNotFound.
+	Get(ctx context.Context, id int64) (*model.User, error)
+	// Update overwrites the name, email and (if set) password and status of
+	// user.Id and returns the row as stored, or ErrNotFound. If user.Version
+	// is non-zero the update only applies to that version and otherwise
+	// fails with ErrVersionMismatch.
+	Update(ctx context.Context, user *model.User) (*model.User, error)
+	// Patch changes only the fields set in patch, with the same version and
+	// not-found semantics as Update.
+	Patch(ctx context.Context, id, version int64, patch UserPatch) (*model.User, error)
+	// Delete soft-deletes the user with the given id, or returns ErrNotFound.
+	Delete(ctx context.Context, id int64) error
+	// CreateBatch creates users like Create and returns one error per user,
+	// nil for those created. If atomic, the first failure undoes the whole
+	// batch and is returned as a *BatchError instead.
+	CreateBatch(ctx context.Context, users []*model.User, atomic bool) ([]error, error)
+	// Import creates users in one transaction, in bulk, skipping those whose
+	// email is used by an existing user regardless of case. It returns one
+	// error per user: ErrEmailExists for skipped users and nil for the
+	// others. Emails must be unique within users, regardless of case. With
+	// dryRun, nothing is written but the same errors are returned.
+	Import(ctx context.Context, users []*model.User, dryRun bool) ([]error, error)
+	// GetByEmail returns the user with the given email, regardless of case,
+	// or ErrNotFound.
+	GetByEmail(ctx context.Context, email string) (*model.User, error)
+	// GetBatch returns the users with the given ids in the same order, with
+	// nil for ids that name no user.
+	GetBatch(ctx context.Context, ids []int64) ([]*model.User, error)
+	// DeleteBatch deletes users like Delete, with the same results as
+	// CreateBatch.
+	DeleteBatch(ctx context.Context, ids []int64, atomic bool) ([]error, error)
+	// Restore undoes Delete and returns the restored user, or ErrNotFound
+	// if the id does not name a soft-deleted user.
+	//
+	// Update, Patch and Restore increment the stored version.
+	Restore(ctx context.Context, id int64) (*model.User, error)
+	// Purge permanently removes the user with the given id, deleted or not,
+	// or returns ErrNotFound.
+	Purge(ctx context.Context, id int64) error
+	// PurgeDeleted permanently removes users soft-deleted before the given
+	// time and returns how many were removed.
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+	// List returns up to opts.Limit users matching opts.Filter, ordered by
+	// opts.OrderBy and then id, starting after opts.After.
+	List(ctx context.Context, opts ListOptions) ([]model.User, error)
+	// Export calls fn for every user, ordered by id, as of one consistent
+	// snapshot, without loading them all into memory. It stops at the first
+	// error returned by fn.
+	Export(ctx context.Context, fn func(user *model.User) error) error
+	// ListAuditEvents returns up to opts.Limit audit events of a user,
+	// newest first, starting before opts.Before. Events of purged users
+	// remain available.
+	ListAuditEvents(ctx context.Context, userId int64, opts AuditListOptions) ([]model.AuditEvent, error)
+	// ListEvents returns up to limit published events recorded after the
+	// event with id after, oldest first. Events become visible in id order,
+	// so a reader that remembers the last id it saw misses none.
+	ListEvents(ctx context.Context, after int64, limit int) ([]outbox.Event, error)
+	// LatestEventId returns the id of the most recent event, or 0.
+	LatestEventId(ctx context.Context) (int64, error)
+	// SaveEmailVerification stores v as the pending email verification of
+	// v.UserId, replacing any other, unless an unexpired one for the same
+	// email is already pending. It reports whether v was stored.
+	SaveEmailVerification(ctx context.Context, v model.EmailVerification) (bool, error)
+	// VerifyEmail completes the pending verification of a user if it has the
+	// given nonce, has not expired and is for the user's current email. It
+	// sets EmailVerifiedAt and returns the user, or ErrVerificationNotFound.
+	// A verification can only be completed once.
+	VerifyEmail(ctx context.Context, userId int64, nonce string) (*model.User, error)
+	// SavePasswordReset stores r as the pending password reset of r.UserId,
+	// replacing any other. Changing the user's password with Update or Patch
+	// drops it.
+	SavePasswordReset(ctx context.Context, r model.PasswordReset) error
+	// ResetPassword completes the unexpired password reset with the given
+	// token hash: it sets the user's password to the given encoded hash and
+	// returns the user, or ErrPasswordResetNotFound. A reset can only be
+	// completed once. It also revokes the user's refresh tokens.
+	ResetPassword(ctx context.Context, tokenHash []byte, password string) (*model.User, error)
+	// RecordLogin sets the LastLoginAt of a user to now and, if password is
+	// not empty, replaces the stored hash with it, e.g. to upgrade it. It
+	// returns the user, or ErrNotFound. Neither counts as a change: the
+	// version, UpdatedAt and the audit log are left alone.
+	RecordLogin(ctx context.Context, id int64, password string) (*model.User, error)
+	// UpgradePasswords calls upgrade with the stored password of every user,
+	// deleted ones included, for which legacy reports true, and stores what
+	// it returns unless the password changed in the meantime. It returns how
+	// many passwords were replaced. Like RecordLogin, this is not a change.
+	UpgradePasswords(ctx context.Context, legacy func(stored string) bool, upgrade func(stored string) (string, error)) (int64, error)
+	// SaveRefreshToken stores an issued refresh token.
+	SaveRefreshToken(ctx context.Context, t model.RefreshToken) error
+	// UseRefreshToken deletes the unexpired refresh token with the given
+	// hash and returns its user id, or ErrRefreshTokenNotFound.
+	UseRefreshToken(ctx context.Context, tokenHash []byte) (int64, error)
+	// CreateAPIKey stores key and sets its Id and CreatedAt. API keys are
+	// not users: they have no audit events or change events.
+	CreateAPIKey(ctx context.Context, key *model.APIKey) error
+	// ListAPIKeys returns every API key, revoked ones included, by id.
+	ListAPIKeys(ctx context.Context) ([]model.APIKey, error)
+	// RevokeAPIKey sets the RevokedAt of the API key with the given id,
+	// unless it is already set, and returns the key, or ErrAPIKeyNotFound.
+	RevokeAPIKey(ctx context.Context, id int64) (*model.APIKey, error)
+	// UseAPIKey returns the unrevoked, unexpired API key with the given
+	// hash, or ErrAPIKeyNotFound. It sets LastUsedAt to now, at most once
+	// per apiKeyUseInterval.
+	UseAPIKey(ctx context.Context, keyHash []byte) (*model.APIKey, error)
+	// Subscribe returns a channel that receives a value after new events are
+	// recorded, and a func that unsubscribes it.
+	Subscribe() (<-chan struct{}, func())
+
+	// Every mutation also queues an outbox.Event in the same transaction.
+	outbox.Store
+}
+
+// apiKeyUseInterval limits how often UseAPIKey writes LastUsedAt, so that
+// busy clients do not cause a write per request.
+const apiKeyUseInterval = time.Minute
+
+// AuditListOptions selects a page of audit events.
+type AuditListOptions struct {
+	// Before is the id of the last event of the previous page, 0 for the
+	// first page.
+	Before int64
+	Limit  int
+}
+
+// UserPatch lists the fields to change; nil fields are left alone.
+type UserPatch struct {
+	Name     *string
+	Email    *string
+	Password *string // encoded hash
+	Status   *string
+}
+
+// updatePatch expresses Update in terms of Patch.
+func updatePatch(user *model.User) UserPatch {
+	patch := UserPatch{Name: &user.Name, Email: &user.Email}
+	if user.Password != "" {
+		patch.Password = &user.Password
+	}
+	if user.Status != "" {
+		patch.Status = &user.Status
+	}
+	return patch
+}
+
+// BatchError reports the item that made an atomic batch fail.
+type BatchError struct {
+	Index int // position of the item in the batch
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("repository: batch item %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
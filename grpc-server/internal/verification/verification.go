@@ -0,0 +1,157 @@
+// Package verification proves that users control their email addresses.
+package verification
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"grpc-server/internal/mailer"
+	"grpc-server/internal/model"
+	"grpc-server/internal/repository"
+)
+
+// DefaultTTL is how long a token stays valid.
+const DefaultTTL = 24 * time.Hour
+
+// ErrInvalidToken is returned for tokens that were not issued by this
+// server, have been used or were superseded by a newer token.
+var ErrInvalidToken = errors.New("verification: invalid token")
+
+// ErrExpiredToken is returned for tokens older than their TTL.
+var ErrExpiredToken = errors.New("verification: token expired")
+
+// nonceSize is the number of random bytes in a token.
+const nonceSize = 16
+
+// Config configures a Verifier.
+type Config struct {
+	// Key signs tokens. Tokens signed with another key are invalid.
+	Key []byte
+	TTL time.Duration
+	// URL is the page users are sent to, with the token added as the
+	// "token" query parameter. When empty, emails contain the bare token.
+	URL string
+}
+
+// Verifier mails users single-use tokens that prove control of their email
+// address, and completes verifications with them.
+//
+// A token is the user id, an expiry time and a random nonce, signed with
+// HMAC-SHA256. The nonce is also stored as the user's pending verification,
+// so a token only works once and only while it is the latest one issued.
+type Verifier struct {
+	repo   repository.UserRepository
+	mailer mailer.Mailer
+	cfg    Config
+}
+
+// New returns a Verifier. With a nil mailer no emails are sent, but tokens
+// issued earlier can still be used.
+func New(repo repository.UserRepository, m mailer.Mailer, cfg Config) *Verifier {
+	return &Verifier{repo: repo, mailer: m, cfg: cfg}
+}
+
+// Send mails a token for the current email of user, unless it is already
+// verified or an unexpired token for it was sent before.
+func (v *Verifier) Send(ctx context.Context, user *model.User) error {
+	if v.mailer == nil || user.EmailVerifiedAt != nil {
+		return nil
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(v.cfg.TTL).Truncate(time.Second)
+	saved, err := v.repo.SaveEmailVerification(ctx, model.EmailVerification{
+		UserId:    user.Id,
+		Email:     user.Email,
+		Nonce:     hex.EncodeToString(nonce),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil || !saved {
+		return err
+	}
+	return v.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body:    v.body(user, v.sign(user.Id, expiresAt, nonce), expiresAt),
+	})
+}
+
+func (v *Verifier) body(user *model.User, token string, expiresAt time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hello %s,\n\n", user.Name)
+	if v.cfg.URL != "" {
+		link, sep := v.cfg.URL, "?"
+		if strings.Contains(link, "?") {
+			sep = "&"
+		}
+		fmt.Fprintf(&b, "Please confirm your email address by opening this link:\n\n%s%stoken=%s\n\n", link, sep, url.QueryEscape(token))
+	} else {
+		fmt.Fprintf(&b, "Please confirm your email address with this token:\n\n%s\n\n", token)
+	}
+	fmt.Fprintf(&b, "It expires at %s.", expiresAt.UTC().Format(time.RFC1123))
+	return b.String()
+}
+
+// Verify completes the verification token was issued for and returns the
+// verified user.
+func (v *Verifier) Verify(ctx context.Context, token string) (*model.User, error) {
+	userId, expiresAt, nonce, err := v.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(expiresAt) {
+		return nil, ErrExpiredToken
+	}
+	user, err := v.repo.VerifyEmail(ctx, userId, hex.EncodeToString(nonce))
+	if errors.Is(err, repository.ErrVerificationNotFound) {
+		return nil, ErrInvalidToken
+	}
+	return user, err
+}
+
+// sign encodes a token as base64url(payload) "." base64url(HMAC of payload),
+// where payload is the user id, the expiry in Unix seconds and the nonce.
+func (v *Verifier) sign(userId int64, expiresAt time.Time, nonce []byte) string {
+	payload := make([]byte, 16, 16+len(nonce))
+	binary.BigEndian.PutUint64(payload, uint64(userId))
+	binary.BigEndian.PutUint64(payload[8:], uint64(expiresAt.Unix()))
+	payload = append(payload, nonce...)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(v.mac(payload))
+}
+
+func (v *Verifier) parse(token string) (userId int64, expiresAt time.Time, nonce []byte, err error) {
+	p, s, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, time.Time{}, nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil || len(payload) != 16+nonceSize {
+		return 0, time.Time{}, nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, v.mac(payload)) {
+		return 0, time.Time{}, nil, ErrInvalidToken
+	}
+	userId = int64(binary.BigEndian.Uint64(payload))
+	expiresAt = time.Unix(int64(binary.BigEndian.Uint64(payload[8:])), 0)
+	return userId, expiresAt, bytes.Clone(payload[16:]), nil
+}
+
+func (v *Verifier) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, v.cfg.Key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,175 @@
+package verification
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"grpc-server/internal/mailer"
+	"grpc-server/internal/model"
+	"grpc-server/internal/repository"
+)
+
+// recordingMailer keeps the messages it is asked to send.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *recordingMailer) Send(_ context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// token returns the token in the last message sent.
+func (m *recordingMailer) token(t *testing.T) string {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		t.Fatal("no email was sent")
+	}
+	_, rest, _ := strings.Cut(m.sent[len(m.sent)-1].Body, "with this token:\n\n")
+	token, _, _ := strings.Cut(rest, "\n")
+	if token == "" {
+		t.Fatalf("no token in %q", m.sent[len(m.sent)-1].Body)
+	}
+	return token
+}
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestVerifier returns a Verifier over a memory repository holding the
+// user john@example.com, and sends john a token.
+func newTestVerifier(t *testing.T, ttl time.Duration) (*Verifier, *recordingMailer, repository.UserRepository, *model.User) {
+	t.Helper()
+	repo := repository.NewMemoryUserRepository()
+	user := &model.User{Name: "John", Email: "john@example.com", Password: "hash"}
+	if err := repo.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	m := &recordingMailer{}
+	v := New(repo, m, Config{Key: testKey, TTL: ttl})
+	if err := v.Send(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return v, m, repo, user
+}
+
+func TestSignAndParse(t *testing.T) {
+	v := New(nil, nil, Config{Key: testKey})
+	expiresAt := time.Unix(1_700_000_000, 0)
+	nonce := []byte("0123456789abcdef")
+	userId, gotExpiry, gotNonce, err := v.parse(v.sign(42, expiresAt, nonce))
+	if err != nil || userId != 42 || !gotExpiry.Equal(expiresAt) || string(gotNonce) != string(nonce) {
+		t.Errorf("parse(sign()) = %d, %v, %q, %v", userId, gotExpiry, gotNonce, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	v, m, _, user := newTestVerifier(t, DefaultTTL)
+	ctx := context.Background()
+	token := m.token(t)
+	verified, err := v.Verify(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Id != user.Id || verified.EmailVerifiedAt == nil {
+		t.Errorf("Verify() = %+v, want john verified", verified)
+	}
+	if _, err := v.Verify(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second Verify() error = %v, want ErrInvalidToken", err)
+	}
+	// Verified users get no more emails.
+	if err := v.Send(ctx, verified); err != nil || len(m.sent) != 1 {
+		t.Errorf("Send() to a verified user: %d emails sent, error %v", len(m.sent), err)
+	}
+}
+
+func TestSendOnlyOnce(t *testing.T) {
+	v, m, _, user := newTestVerifier(t, DefaultTTL)
+	if err := v.Send(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 {
+		t.Errorf("%d emails sent while a token is pending, want 1", len(m.sent))
+	}
+}
+
+func TestVerifyInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// prepare runs between sending the token and using it, and returns
+		// the token to use.
+		prepare func(t *testing.T, v *Verifier, repo repository.UserRepository, token string) string
+		wantErr error
+	}{
+		{"expired", -time.Minute, nil, ErrExpiredToken},
+		{"malformed", DefaultTTL, func(*testing.T, *Verifier, repository.UserRepository, string) string {
+			return "not a token"
+		}, ErrInvalidToken},
+		{"tampered MAC", DefaultTTL, func(_ *testing.T, _ *Verifier, _ repository.UserRepository, token string) string {
+			payload, mac, _ := strings.Cut(token, ".")
+			sig, _ := base64.RawURLEncoding.DecodeString(mac)
+			sig[0] ^= 1
+			return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+		}, ErrInvalidToken},
+		{"tampered payload", DefaultTTL, func(_ *testing.T, _ *Verifier, _ repository.UserRepository, token string) string {
+			payload, mac, _ := strings.Cut(token, ".")
+			b, _ := base64.RawURLEncoding.DecodeString(payload)
+			b[15]++ // a later expiry
+			return base64.RawURLEncoding.EncodeToString(b) + "." + mac
+		}, ErrInvalidToken},
+		{"signed with another key", DefaultTTL, func(t *testing.T, v *Verifier, _ repository.UserRepository, token string) string {
+			userId, expiresAt, nonce, err := v.parse(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := New(nil, nil, Config{Key: []byte("another key")})
+			return other.sign(userId, expiresAt, nonce)
+		}, ErrInvalidToken},
+		{"email changed since", DefaultTTL, func(t *testing.T, _ *Verifier, repo repository.UserRepository, token string) string {
+			email := "johnny@example.com"
+			if _, err := repo.Patch(context.Background(), 1, 0, repository.UserPatch{Email: &email}); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}, ErrInvalidToken},
+		{"replaced by a token for a new email", DefaultTTL, func(t *testing.T, v *Verifier, repo repository.UserRepository, token string) string {
+			email := "johnny@example.com"
+			user, err := repo.Patch(context.Background(), 1, 0, repository.UserPatch{Email: &email})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := v.Send(context.Background(), user); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}, ErrInvalidToken},
+		{"user deleted since", DefaultTTL, func(t *testing.T, _ *Verifier, repo repository.UserRepository, token string) string {
+			if err := repo.Delete(context.Background(), 1); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, m, repo, _ := newTestVerifier(t, tt.ttl)
+			token := m.token(t)
+			if tt.prepare != nil {
+				token = tt.prepare(t, v, repo, token)
+			}
+			if _, err := v.Verify(context.Background(), token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
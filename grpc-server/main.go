@@ -2,10 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
+	"grpc-server/internal/apikey"
+	"grpc-server/internal/audit"
+	"grpc-server/internal/auth"
+	"grpc-server/internal/grpcerr"
+	"grpc-server/internal/importer"
+	"grpc-server/internal/mailer"
+	"grpc-server/internal/migrate"
+	"grpc-server/internal/model"
+	"grpc-server/internal/outbox"
+	"grpc-server/internal/password"
+	"grpc-server/internal/passwordreset"
+	"grpc-server/internal/ratelimit"
+	"grpc-server/internal/repository"
+	"grpc-server/internal/verification"
 	pb "grpc-server/proto" // Import generated protobuf package
 
 	"github.com/jmoiron/sqlx"
@@ -16,6 +41,11 @@ import (
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
@@ -24,122 +54,1212 @@ const (
 	driverName     = "postgres"
 )
 
-// User represents a user model
-type User struct {
-	Id       int64  `db:"id"`
-	Name     string `db:"name"`
-	Email    string `db:"email"`
-	Password string `db:"password"`
-}
-
-var db *sqlx.DB
+// Page sizes for ListUsers and ListUserAuditEvents.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
 
 type server struct {
 	pb.UnimplementedUserServiceServer
+	repo   repository.UserRepository
+	hasher *password.Hasher
+	// verifier and resetter are nil when no mailer is configured.
+	verifier *verification.Verifier
+	resetter *passwordreset.Resetter
+	// resetsPerEmail and resetsPerClient limit RequestPasswordReset calls.
+	resetsPerEmail  *ratelimit.Limiter
+	resetsPerClient *ratelimit.Limiter
+	// auth is nil when no signing key is configured.
+	auth *auth.Authenticator
+	// loginsPerEmail and loginsPerClient limit Authenticate calls;
+	// loginsPerEmail also limits current password checks.
+	loginsPerEmail  *ratelimit.Limiter
+	loginsPerClient *ratelimit.Limiter
+	apiKeys         *apikey.Issuer
+	// trustedProxies may forward the end client's address, see clientAddr,
+	// and are the only callers allowed to purge users.
+	trustedProxies []netip.Prefix
+}
+
+// mailTimeout bounds sending one email.
+const mailTimeout = 30 * time.Second
+
+// sendVerification mails user a token to verify their email, if needed, in
+// the background so that slow mail servers do not hold up the request.
+func (s *server) sendVerification(ctx context.Context, user *model.User) {
+	if s.verifier == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	go func() {
+		defer cancel()
+		if err := s.verifier.Send(ctx, user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.Id, err)
+		}
+	}()
 }
 
 func (s *server) CreateUser(ctx context.Context, req *pb.UserRequest) (*pb.UserResponse, error) {
 	tr := otel.Tracer("grpc-server")
 	ctx, span := tr.Start(ctx, "CreateUser")
 	defer span.End()
-	user := &User{
+	hash, err := s.hasher.Hash(req.Password)
+	if err != nil {
+		return nil, err
+	}
+	user := &model.User{
 		Name:     req.Name,
-		Email:    req.Email,
-		Password: req.Password,
+		Email:    model.NormalizeEmail(req.Email),
+		Password: hash,
 	}
-	query := "INSERT INTO users (name, email, password) VALUES ($1, $2, $3) RETURNING id"
-	var id int64
-	err := db.QueryRowContext(ctx, query, user.Name, user.Email, user.Password).Scan(&id)
-	if err != nil {
+	if err := s.repo.Create(ctx, user); err != nil {
 		return nil, err
 	}
-	fmt.Printf("Insert user with ID: %d\n", id)
-	user.Id = id
-	return &pb.UserResponse{User: &pb.User{
-		Id:       user.Id,
-		Name:     user.Name,
-		Email:    user.Email,
-		Password: user.Password,
-	}}, nil
+	s.sendVerification(ctx, user)
+	return &pb.UserResponse{User: toProtoUser(user)}, nil
 }
 
 func (s *server) GetUser(ctx context.Context, req *pb.UserID) (*pb.UserResponse, error) {
 	tr := otel.Tracer("grpc-server")
 	ctx, span := tr.Start(ctx, "GetUser")
 	defer span.End()
-	var user User
-	err := db.GetContext(ctx, &user, "SELECT id, name, email, password FROM users WHERE id=$1", req.Id)
+	user, err := s.repo.Get(ctx, req.Id)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Get user with ID: %d\n", user.Id)
-	return &pb.UserResponse{User: &pb.User{
-		Id:       user.Id,
-		Name:     user.Name,
-		Email:    user.Email,
-		Password: user.Password,
-	}}, nil
+	return &pb.UserResponse{User: toProtoUser(user)}, nil
 }
 
 func (s *server) UpdateUser(ctx context.Context, req *pb.User) (*pb.UserResponse, error) {
 	tr := otel.Tracer("grpc-server")
 	ctx, span := tr.Start(ctx, "UpdateUser")
 	defer span.End()
-	user := &User{
-		Id:       req.Id,
-		Name:     req.Name,
-		Email:    req.Email,
-		Password: req.Password,
+	if req.Status != "" && !model.ValidStatus(req.Status) {
+		return nil, grpcerr.InvalidArgument("status", "must be active or disabled")
+	}
+	user := &model.User{
+		Id:      req.Id,
+		Name:    req.Name,
+		Email:   model.NormalizeEmail(req.Email),
+		Status:  req.Status,
+		Version: req.Version,
+	}
+	// An empty password leaves the stored hash untouched.
+	if req.Password != "" {
+		hash, err := s.hasher.Hash(req.Password)
+		if err != nil {
+			return nil, err
+		}
+		user.Password = hash
+	}
+	before, err := s.repo.Get(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if req.CurrentPassword != "" {
+		if err := s.checkCurrentPassword(before, req.CurrentPassword); err != nil {
+			return nil, err
+		}
+		// Fail rather than apply the update if the password changes meanwhile.
+		if user.Version == 0 {
+			user.Version = before.Version
+		}
 	}
+	stored, err := s.repo.Update(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Email != before.Email {
+		s.sendVerification(ctx, stored)
+	}
+	return &pb.UserResponse{User: toProtoUser(stored)}, nil
+}
+
+// checkCurrentPassword checks the current password sent along with a change
+// of user. Attempts count against the login limit for the user's email.
+func (s *server) checkCurrentPassword(user *model.User, current string) error {
+	if ok, retryAfter := s.loginsPerEmail.Allow(strings.ToLower(user.Email)); !ok {
+		return grpcerr.RateLimited(retryAfter)
+	}
+	ok, err := s.hasher.Verify(current, user.Password)
+	if err != nil && !errors.Is(err, password.ErrUnknownFormat) {
+		return err
+	}
+	if !ok {
+		return grpcerr.InvalidArgument("current_password", "does not match")
+	}
+	return nil
+}
 
-	_, err := db.ExecContext(ctx, "UPDATE users SET name=$1, email=$2, password=$3 WHERE id=$4",
-		user.Name, user.Email, user.Password, user.Id)
+func (s *server) PatchUser(ctx context.Context, req *pb.PatchUserRequest) (*pb.UserResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "PatchUser")
+	defer span.End()
+	if req.User == nil {
+		return nil, grpcerr.InvalidArgument("user", "must be set")
+	}
+	paths := req.UpdateMask.GetPaths()
+	if len(paths) == 0 {
+		return nil, grpcerr.InvalidArgument("update_mask", "must list at least one field")
+	}
+	var patch repository.UserPatch
+	for _, path := range paths {
+		switch path {
+		case "name":
+			patch.Name = &req.User.Name
+		case "email":
+			email := model.NormalizeEmail(req.User.Email)
+			patch.Email = &email
+		case "password":
+			hash, err := s.hasher.Hash(req.User.Password)
+			if err != nil {
+				return nil, err
+			}
+			patch.Password = &hash
+		case "status":
+			if !model.ValidStatus(req.User.Status) {
+				return nil, grpcerr.InvalidArgument("status", "must be active or disabled")
+			}
+			patch.Status = &req.User.Status
+		default:
+			return nil, grpcerr.InvalidArgument("update_mask", fmt.Sprintf("%q is not a patchable field", path))
+		}
+	}
+	version := req.User.Version
+	if req.User.CurrentPassword != "" {
+		before, err := s.repo.Get(ctx, req.User.Id)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkCurrentPassword(before, req.User.CurrentPassword); err != nil {
+			return nil, err
+		}
+		if version == 0 {
+			version = before.Version
+		}
+	}
+	stored, err := s.repo.Patch(ctx, req.User.Id, version, patch)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Update user with ID: %d\n", user.Id)
-	return &pb.UserResponse{User: &pb.User{
-		Id:       user.Id,
-		Name:     user.Name,
-		Email:    user.Email,
-		Password: user.Password,
-	}}, nil
+	if patch.Email != nil {
+		s.sendVerification(ctx, stored)
+	}
+	return &pb.UserResponse{User: toProtoUser(stored)}, nil
 }
 
 func (s *server) DeleteUser(ctx context.Context, req *pb.UserID) (*pb.UserResponse, error) {
 	tr := otel.Tracer("grpc-server")
 	ctx, span := tr.Start(ctx, "DeleteUser")
 	defer span.End()
-	_, err := db.ExecContext(ctx, "DELETE FROM users WHERE id=$1", req.Id)
+	if err := s.repo.Delete(ctx, req.Id); err != nil {
+		return nil, err
+	}
+	return &pb.UserResponse{}, nil
+}
+
+func (s *server) RestoreUser(ctx context.Context, req *pb.UserID) (*pb.UserResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "RestoreUser")
+	defer span.End()
+	user, err := s.repo.Restore(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UserResponse{User: toProtoUser(user)}, nil
+}
+
+// errVerificationDisabled and errResetDisabled are returned by the email
+// verification and password reset RPCs when the server has no mailer.
+var (
+	errVerificationDisabled = status.Error(codes.Unimplemented, "email verification is not configured; start the server with -mailer")
+	errResetDisabled        = status.Error(codes.Unimplemented, "password reset is not configured; start the server with -mailer")
+)
+
+func (s *server) VerifyEmail(ctx context.Context, req *pb.VerifyEmailRequest) (*pb.UserResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "VerifyEmail")
+	defer span.End()
+	if s.verifier == nil {
+		return nil, errVerificationDisabled
+	}
+	if req.Token == "" {
+		return nil, grpcerr.InvalidArgument("token", "must not be empty")
+	}
+	user, err := s.verifier.Verify(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UserResponse{User: toProtoUser(user)}, nil
+}
+
+func (s *server) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "RequestPasswordReset")
+	defer span.End()
+	if s.resetter == nil {
+		return nil, errResetDisabled
+	}
+	email := model.NormalizeEmail(req.Email)
+	if email == "" {
+		return nil, grpcerr.InvalidArgument("email", "must not be empty")
+	}
+	// Limits apply whether or not the email exists, so they reveal nothing.
+	if ok, retryAfter := s.resetsPerClient.Allow(s.clientAddr(ctx)); !ok {
+		return nil, grpcerr.RateLimited(retryAfter)
+	}
+	if ok, retryAfter := s.resetsPerEmail.Allow(strings.ToLower(email)); !ok {
+		return nil, grpcerr.RateLimited(retryAfter)
+	}
+	// Sent in the background so the response takes as long for unknown
+	// emails as for known ones.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	go func() {
+		defer cancel()
+		if err := s.resetter.Request(ctx, email); err != nil {
+			log.Printf("Failed to send password reset email: %v", err)
+		}
+	}()
+	return &pb.RequestPasswordResetResponse{}, nil
+}
+
+func (s *server) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.UserResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "ResetPassword")
+	defer span.End()
+	if s.resetter == nil {
+		return nil, errResetDisabled
+	}
+	if req.Token == "" {
+		return nil, grpcerr.InvalidArgument("token", "must not be empty")
+	}
+	if ok, retryAfter := s.resetsPerClient.Allow(s.clientAddr(ctx)); !ok {
+		return nil, grpcerr.RateLimited(retryAfter)
+	}
+	user, err := s.resetter.Reset(ctx, req.Token, req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UserResponse{User: toProtoUser(user)}, nil
+}
+
+// errAuthDisabled is returned by Authenticate and RefreshToken when the
+// server has no signing key.
+var errAuthDisabled = status.Error(codes.Unimplemented, "authentication is not configured; start the server with -jwt-key")
+
+func (s *server) Authenticate(ctx context.Context, req *pb.AuthenticateRequest) (*pb.AuthenticateResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "Authenticate")
+	defer span.End()
+	if s.auth == nil {
+		return nil, errAuthDisabled
+	}
+	email := model.NormalizeEmail(req.Email)
+	if ok, retryAfter := s.loginsPerClient.Allow(s.clientAddr(ctx)); !ok {
+		return nil, grpcerr.RateLimited(retryAfter)
+	}
+	if ok, retryAfter := s.loginsPerEmail.Allow(strings.ToLower(email)); !ok {
+		return nil, grpcerr.RateLimited(retryAfter)
+	}
+	user, tokens, err := s.auth.Login(ctx, email, req.Password)
+	if err != nil {
+		return nil, err
+	}
+	return toProtoAuthenticateResponse(user, tokens), nil
+}
+
+func (s *server) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.AuthenticateResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "RefreshToken")
+	defer span.End()
+	if s.auth == nil {
+		return nil, errAuthDisabled
+	}
+	user, tokens, err := s.auth.Refresh(ctx, req.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return toProtoAuthenticateResponse(user, tokens), nil
+}
+
+func toProtoAuthenticateResponse(user *model.User, tokens auth.Tokens) *pb.AuthenticateResponse {
+	return &pb.AuthenticateResponse{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(tokens.ExpiresIn / time.Second),
+		RefreshToken: tokens.RefreshToken,
+		User:         toProtoUser(user),
+	}
+}
+
+func (s *server) CreateApiKey(ctx context.Context, req *pb.CreateApiKeyRequest) (*pb.CreateApiKeyResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "CreateApiKey")
+	defer span.End()
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, grpcerr.InvalidArgument("name", "must not be empty")
+	}
+	if len(req.Scopes) == 0 {
+		return nil, grpcerr.InvalidArgument("scopes", "must not be empty")
+	}
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !apikey.ValidScope(scope) {
+			return nil, grpcerr.InvalidArgument("scopes", fmt.Sprintf("unknown scope %q, must be one of %s", scope, strings.Join(apikey.Scopes, ", ")))
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	var expiresAt *time.Time
+	if req.ExpireTime != nil {
+		t := req.ExpireTime.AsTime()
+		if !t.After(time.Now()) {
+			return nil, grpcerr.InvalidArgument("expire_time", "must be in the future")
+		}
+		expiresAt = &t
+	}
+	key, secret, err := s.apiKeys.Create(ctx, name, scopes, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CreateApiKeyResponse{ApiKey: toProtoApiKey(key), Key: secret}, nil
+}
+
+func (s *server) ListApiKeys(ctx context.Context, req *pb.ListApiKeysRequest) (*pb.ListApiKeysResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "ListApiKeys")
+	defer span.End()
+	keys, err := s.repo.ListAPIKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.ListApiKeysResponse{ApiKeys: make([]*pb.ApiKey, len(keys))}
+	for i := range keys {
+		resp.ApiKeys[i] = toProtoApiKey(&keys[i])
+	}
+	return resp, nil
+}
+
+func (s *server) RevokeApiKey(ctx context.Context, req *pb.RevokeApiKeyRequest) (*pb.ApiKey, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "RevokeApiKey")
+	defer span.End()
+	key, err := s.repo.RevokeAPIKey(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return toProtoApiKey(key), nil
+}
+
+func (s *server) AuthenticateApiKey(ctx context.Context, req *pb.AuthenticateApiKeyRequest) (*pb.ApiKey, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "AuthenticateApiKey")
+	defer span.End()
+	key, err := s.apiKeys.Authenticate(ctx, req.Key)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Delete user with ID: %d\n", req.Id)
+	return toProtoApiKey(key), nil
+}
+
+// toProtoApiKey converts a stored API key to its wire form, without the
+// key hash.
+func toProtoApiKey(key *model.APIKey) *pb.ApiKey {
+	k := &pb.ApiKey{
+		Id:         key.Id,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreateTime: timestamppb.New(key.CreatedAt),
+	}
+	if key.ExpiresAt != nil {
+		k.ExpireTime = timestamppb.New(*key.ExpiresAt)
+	}
+	if key.LastUsedAt != nil {
+		k.LastUsedTime = timestamppb.New(*key.LastUsedAt)
+	}
+	if key.RevokedAt != nil {
+		k.RevokeTime = timestamppb.New(*key.RevokedAt)
+	}
+	return k
+}
+
+// clientAddr identifies the end client of a call for rate limiting: the
+// peer address or, for calls from a trusted proxy such as the HTTP gateway,
+// the address it forwards in "x-forwarded-for" metadata. Other callers
+// cannot escape the limits by sending their own "x-forwarded-for".
+func (s *server) clientAddr(ctx context.Context) string {
+	host := peerHost(ctx)
+	if !s.trustedProxy(host) {
+		return host
+	}
+	if values := metadata.ValueFromIncomingContext(ctx, "x-forwarded-for"); len(values) > 0 {
+		addr, _, _ := strings.Cut(values[0], ",")
+		return strings.TrimSpace(addr)
+	}
+	return host
+}
+
+// fromTrustedProxy reports whether the call comes from one of the trusted
+// proxies, whose metadata about the end client and actor is believed.
+func (s *server) fromTrustedProxy(ctx context.Context) bool {
+	return s.trustedProxy(peerHost(ctx))
+}
+
+// peerHost returns the address of the caller without the port, or "" if
+// it is unknown.
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return host
+}
+
+func (s *server) trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// prefixes.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(field); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+var errPurgeForbidden = status.Error(codes.PermissionDenied, "users can only be purged through the gateway")
+
+func (s *server) PurgeUser(ctx context.Context, req *pb.UserID) (*pb.UserResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "PurgeUser")
+	defer span.End()
+	// The gateway only lets administrators purge; nobody else may call this
+	// even if the port is reachable.
+	if !s.fromTrustedProxy(ctx) {
+		return nil, errPurgeForbidden
+	}
+	if err := s.repo.Purge(ctx, req.Id); err != nil {
+		return nil, err
+	}
 	return &pb.UserResponse{}, nil
 }
 
-func main() {
-	initTracer()
-	// Connect to PostgreSQL database
+func (s *server) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "ListUsers")
+	defer span.End()
+	opts, err := listOptions(req)
+	if err != nil {
+		return nil, err
+	}
+	// Fetch one extra row to learn whether another page follows.
+	pageSize := opts.Limit
+	opts.Limit++
+	users, err := s.repo.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.ListUsersResponse{}
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		resp.NextPageToken = repository.NewCursor(users[pageSize-1], opts).Encode()
+	}
+	for i := range users {
+		resp.Users = append(resp.Users, toProtoUser(&users[i]))
+	}
+	return resp, nil
+}
+
+// maxBatchSize bounds the items in one batch call.
+const maxBatchSize = 1000
+
+func (s *server) BatchCreateUsers(ctx context.Context, req *pb.BatchCreateUsersRequest) (*pb.BatchUsersResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "BatchCreateUsers")
+	defer span.End()
+	if len(req.Users) > maxBatchSize {
+		return nil, grpcerr.InvalidArgument("users", fmt.Sprintf("must not have more than %d items", maxBatchSize))
+	}
+	results := make([]*pb.BatchUserResult, len(req.Users))
+	var users []*model.User
+	var positions []int // positions[j] is the index of users[j] in the request
+	for i, u := range req.Users {
+		hash, err := s.hasher.Hash(u.Password)
+		if err != nil {
+			if req.Atomic {
+				return nil, &repository.BatchError{Index: i, Err: err}
+			}
+			results[i] = batchFailure(err)
+			continue
+		}
+		users = append(users, &model.User{Name: u.Name, Email: model.NormalizeEmail(u.Email), Password: hash})
+		positions = append(positions, i)
+	}
+	errs, err := s.repo.CreateBatch(ctx, users, req.Atomic)
+	if err != nil {
+		var batchErr *repository.BatchError
+		if errors.As(err, &batchErr) {
+			batchErr.Index = positions[batchErr.Index]
+		}
+		return nil, err
+	}
+	for j, user := range users {
+		if errs[j] != nil {
+			results[positions[j]] = batchFailure(errs[j])
+			continue
+		}
+		results[positions[j]] = &pb.BatchUserResult{User: toProtoUser(user)}
+		s.sendVerification(ctx, user)
+	}
+	return &pb.BatchUsersResponse{Results: results}, nil
+}
+
+func (s *server) BatchGetUsers(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchUsersResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "BatchGetUsers")
+	defer span.End()
+	if len(req.Ids) > maxBatchSize {
+		return nil, grpcerr.InvalidArgument("ids", fmt.Sprintf("must not have more than %d items", maxBatchSize))
+	}
+	users, err := s.repo.GetBatch(ctx, req.Ids)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*pb.BatchUserResult, len(users))
+	for i, user := range users {
+		if user == nil {
+			if req.Atomic {
+				return nil, &repository.BatchError{Index: i, Err: repository.ErrNotFound}
+			}
+			results[i] = batchFailure(repository.ErrNotFound)
+			continue
+		}
+		results[i] = &pb.BatchUserResult{User: toProtoUser(user)}
+	}
+	return &pb.BatchUsersResponse{Results: results}, nil
+}
+
+func (s *server) BatchDeleteUsers(ctx context.Context, req *pb.BatchDeleteUsersRequest) (*pb.BatchUsersResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "BatchDeleteUsers")
+	defer span.End()
+	if len(req.Ids) > maxBatchSize {
+		return nil, grpcerr.InvalidArgument("ids", fmt.Sprintf("must not have more than %d items", maxBatchSize))
+	}
+	errs, err := s.repo.DeleteBatch(ctx, req.Ids, req.Atomic)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*pb.BatchUserResult, len(errs))
+	for i, err := range errs {
+		results[i] = &pb.BatchUserResult{}
+		if err != nil {
+			results[i] = batchFailure(err)
+		}
+	}
+	return &pb.BatchUsersResponse{Results: results}, nil
+}
+
+func (s *server) ImportUsers(stream pb.UserService_ImportUsersServer) error {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(stream.Context(), "ImportUsers")
+	defer span.End()
+	var im *importer.Importer
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if im == nil {
+			im = importer.New(s.repo, s.hasher, req.DryRun)
+		}
+		for _, row := range req.Rows {
+			err := im.Add(ctx, importer.Row{
+				Row:          row.Row,
+				Name:         row.Name,
+				Email:        row.Email,
+				Password:     row.Password,
+				PasswordHash: row.PasswordHash,
+				Status:       row.Status,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if im == nil {
+		return stream.SendAndClose(&pb.ImportUsersResponse{})
+	}
+	report, err := im.Close(ctx)
+	if err != nil {
+		return err
+	}
+	resp := &pb.ImportUsersResponse{Rows: report.Rows, Imported: report.Imported}
+	for _, e := range report.Errors {
+		resp.Errors = append(resp.Errors, &pb.ImportRowError{Row: e.Row, Field: e.Field, Message: e.Message})
+	}
+	return stream.SendAndClose(resp)
+}
+
+// exportChunkSize is the number of users per ExportUsers message.
+const exportChunkSize = 500
+
+func (s *server) ExportUsers(req *pb.ExportUsersRequest, stream pb.UserService_ExportUsersServer) error {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(stream.Context(), "ExportUsers")
+	defer span.End()
+	resp := &pb.ExportUsersResponse{}
+	err := s.repo.Export(ctx, func(user *model.User) error {
+		resp.Users = append(resp.Users, toProtoUser(user))
+		if len(resp.Users) < exportChunkSize {
+			return nil
+		}
+		err := stream.Send(resp)
+		resp = &pb.ExportUsersResponse{}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Users) > 0 {
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchFailure reports a failed batch item with the status the error would
+// have as the result of a single call.
+func batchFailure(err error) *pb.BatchUserResult {
+	st := status.Convert(grpcerr.FromError(err))
+	return &pb.BatchUserResult{Error: &pb.BatchItemError{
+		Code:    int32(st.Code()),
+		Message: st.Message(),
+		Reason:  grpcerr.Reason(st),
+	}}
+}
+
+// listOptions validates a ListUsers request.
+func listOptions(req *pb.ListUsersRequest) (repository.ListOptions, error) {
+	var opts repository.ListOptions
 	var err error
-	db, err = sqlx.Connect(driverName, dataSourceName)
+	if opts.OrderBy, opts.Desc, err = repository.ParseOrderBy(req.OrderBy); err != nil {
+		return opts, err
+	}
+
+	if f := req.Filter; f != nil {
+		opts.Filter.EmailDomain = f.EmailDomain
+		opts.Filter.NamePrefix = f.NamePrefix
+		if f.Status != "" && !model.ValidStatus(f.Status) {
+			return opts, grpcerr.InvalidArgument("filter.status", "must be active or disabled")
+		}
+		opts.Filter.Status = f.Status
+		if f.CreatedAfter != nil {
+			if err := f.CreatedAfter.CheckValid(); err != nil {
+				return opts, grpcerr.InvalidArgument("filter.created_after", err.Error())
+			}
+			at := f.CreatedAfter.AsTime()
+			opts.Filter.CreatedAfter = &at
+		}
+		if f.CreatedBefore != nil {
+			if err := f.CreatedBefore.CheckValid(); err != nil {
+				return opts, grpcerr.InvalidArgument("filter.created_before", err.Error())
+			}
+			at := f.CreatedBefore.AsTime()
+			opts.Filter.CreatedBefore = &at
+		}
+	}
+
+	if opts.Limit, err = pageSize(req.PageSize); err != nil {
+		return opts, err
+	}
+
+	// The token is checked against the filter and order parsed above.
+	opts.After, err = repository.DecodeCursor(req.PageToken, opts)
+	return opts, err
+}
+
+func (s *server) ListUserAuditEvents(ctx context.Context, req *pb.ListUserAuditEventsRequest) (*pb.ListUserAuditEventsResponse, error) {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(ctx, "ListUserAuditEvents")
+	defer span.End()
+	pageSize, err := pageSize(req.PageSize)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		return nil, err
+	}
+	before, err := repository.DecodeAuditCursor(req.PageToken, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	events, err := s.repo.ListAuditEvents(ctx, req.UserId, repository.AuditListOptions{Before: before, Limit: pageSize + 1})
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.ListUserAuditEventsResponse{}
+	if len(events) > pageSize {
+		events = events[:pageSize]
+		resp.NextPageToken = repository.NewAuditCursor(events[pageSize-1]).Encode()
+	}
+	for _, event := range events {
+		resp.Events = append(resp.Events, toProtoAuditEvent(event))
+	}
+	return resp, nil
+}
+
+// watchBatchSize is the number of events WatchUsers reads at a time.
+const watchBatchSize = 100
+
+// watchPollInterval bounds how long WatchUsers waits for a notification
+// before checking for events anyway.
+const watchPollInterval = 30 * time.Second
+
+func (s *server) WatchUsers(req *pb.WatchUsersRequest, stream pb.UserService_WatchUsersServer) error {
+	tr := otel.Tracer("grpc-server")
+	ctx, span := tr.Start(stream.Context(), "WatchUsers")
+	defer span.End()
+	// Subscribe before reading, so no event recorded in between is missed.
+	changes, unsubscribe := s.repo.Subscribe()
+	defer unsubscribe()
+	var after int64
+	var err error
+	if req.PositionToken != "" {
+		if after, err = repository.DecodeWatchCursor(req.PositionToken); err != nil {
+			return grpcerr.InvalidArgument("position_token", "was not issued by WatchUsers")
+		}
+	} else {
+		after, err = s.repo.LatestEventId(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			events, err := s.repo.ListEvents(ctx, after, watchBatchSize)
+			if err != nil {
+				return err
+			}
+			for _, event := range events {
+				if err := stream.Send(toProtoUserEvent(event)); err != nil {
+					return err
+				}
+				after = event.Id
+			}
+			if len(events) < watchBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
+
+func toProtoUserEvent(event outbox.Event) *pb.UserEvent {
+	e := &pb.UserEvent{
+		Type:          event.Type,
+		UserId:        event.UserId,
+		Actor:         event.Actor,
+		RequestId:     event.RequestId,
+		CreateTime:    timestamppb.New(event.OccurredAt),
+		PositionToken: repository.NewWatchCursor(event.Id).Encode(),
+	}
+	if u := event.User; u != nil {
+		e.User = &pb.User{
+			Id:         u.Id,
+			Name:       u.Name,
+			Email:      u.Email,
+			Status:     u.Status,
+			Version:    u.Version,
+			CreateTime: timestamppb.New(u.CreatedAt),
+			UpdateTime: timestamppb.New(u.UpdatedAt),
+		}
+		if u.LastLoginAt != nil {
+			e.User.LastLoginTime = timestamppb.New(*u.LastLoginAt)
+		}
+		if u.EmailVerifiedAt != nil {
+			e.User.EmailVerifiedTime = timestamppb.New(*u.EmailVerifiedAt)
+		}
+	}
+	return e
+}
+
+// pageSize applies the default and maximum page size to a requested one.
+func pageSize(requested int32) (int, error) {
+	switch {
+	case requested < 0:
+		return 0, grpcerr.InvalidArgument("page_size", "must not be negative")
+	case requested == 0:
+		return defaultPageSize, nil
+	case requested > maxPageSize:
+		return maxPageSize, nil
+	default:
+		return int(requested), nil
+	}
+}
+
+func toProtoAuditEvent(event model.AuditEvent) *pb.AuditEvent {
+	changes := make(map[string]*pb.FieldChange, len(event.Changes))
+	for field, change := range event.Changes {
+		changes[field] = &pb.FieldChange{Before: change.Before, After: change.After}
+	}
+	return &pb.AuditEvent{
+		Id:         event.Id,
+		UserId:     event.UserId,
+		Actor:      event.Actor,
+		Operation:  event.Operation,
+		Changes:    changes,
+		RequestId:  event.RequestId,
+		CreateTime: timestamppb.New(event.CreatedAt),
+	}
+}
+
+// toProtoUser converts a stored user to its wire form. The password hash is
+// deliberately left out.
+func toProtoUser(user *model.User) *pb.User {
+	u := &pb.User{
+		Id:         user.Id,
+		Name:       user.Name,
+		Email:      user.Email,
+		Status:     user.Status,
+		Version:    user.Version,
+		CreateTime: timestamppb.New(user.CreatedAt),
+		UpdateTime: timestamppb.New(user.UpdatedAt),
+	}
+	if user.LastLoginAt != nil {
+		u.LastLoginTime = timestamppb.New(*user.LastLoginAt)
+	}
+	if user.EmailVerifiedAt != nil {
+		u.EmailVerifiedTime = timestamppb.New(*user.EmailVerifiedAt)
+	}
+	return u
+}
+
+// shutdownTimeout bounds how long the server waits for in-flight calls when
+// shutting down.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	argon2Memory := flag.Uint("argon2-memory", uint(password.DefaultParams.Memory), "argon2id memory cost in KiB")
+	argon2Time := flag.Uint("argon2-time", uint(password.DefaultParams.Iterations), "argon2id iterations")
+	argon2Threads := flag.Uint("argon2-threads", uint(password.DefaultParams.Parallelism), "argon2id parallelism")
+	store := flag.String("store", "postgres", "user store: postgres or memory")
+	autoMigrate := flag.Bool("auto-migrate", true, "apply pending schema migrations on startup")
+	purgeRetention := flag.Duration("purge-retention", 30*24*time.Hour, "how long soft-deleted users are kept before being purged; 0 disables purging")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "how often to purge soft-deleted users")
+	mailerSpec := flag.String("mailer", "none", `how to send verification and password reset emails: "smtp://[user:password@]host:port?from=<address>", "file:<path>", "stdout" for local development, or "none" to disable email verification and password reset`)
+	verificationKey := flag.String("verification-key", "", "secret signing email verification tokens; a random key, which does not survive restarts, is used when empty")
+	verificationTTL := flag.Duration("verification-ttl", verification.DefaultTTL, "how long email verification tokens are valid")
+	verificationURL := flag.String("verification-url", "", "page linked from verification emails, which receives the token as the token query parameter; emails contain the bare token when empty")
+	resetTTL := flag.Duration("reset-ttl", passwordreset.DefaultTTL, "how long password reset tokens are valid")
+	resetURL := flag.String("reset-url", "", "page linked from password reset emails, which receives the token as the token query parameter; emails contain the bare token when empty")
+	jwtKey := flag.String("jwt-key", "", "PEM file with the private key signing access tokens (Ed25519, P-256 or RSA); Authenticate is disabled when empty")
+	jwtIssuer := flag.String("jwt-issuer", auth.DefaultIssuer, `"iss" claim of access tokens`)
+	jwtAudience := flag.String("jwt-audience", auth.DefaultAudience, `"aud" claim of access tokens`)
+	jwtAccessTTL := flag.Duration("jwt-access-ttl", auth.DefaultAccessTTL, "how long access tokens are valid")
+	jwtRefreshTTL := flag.Duration("jwt-refresh-ttl", auth.DefaultRefreshTTL, "how long refresh tokens are valid")
+	trustedProxies := flag.String("trusted-proxies", "127.0.0.1,::1", "comma-separated addresses or CIDR prefixes of HTTP gateways trusted to forward client addresses in x-forwarded-for and actors and request ids for the audit log, and to purge users")
+	outboxPublisher := flag.String("outbox-publisher", "none", `where to publish user change events: "file:<path>", an http(s) URL, "stdout" for local development, or "none" to leave them in the outbox`)
+	flag.Parse()
+
+	if flag.Arg(0) == "migrate" {
+		runMigrate(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "jwks" {
+		runJWKS(*jwtKey)
+		return
+	}
+
+	initTracer()
+
+	// Stop serving, and the background work tied to ctx, on SIGINT or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var repo repository.UserRepository
+	switch *store {
+	case "postgres":
+		// Connect to PostgreSQL database
+		db, err := sqlx.Connect(driverName, dataSourceName)
+		if err != nil {
+			log.Fatalf("Failed to connect to database: %v", err)
+		}
+		defer db.Close()
+		if *autoMigrate {
+			migrateUp(db)
+		}
+		pg := repository.NewPostgresUserRepository(db)
+		if err := pg.Listen(dataSourceName); err != nil {
+			log.Fatalf("Failed to listen for user events: %v", err)
+		}
+		repo = pg
+	case "memory":
+		repo = repository.NewMemoryUserRepository()
+	default:
+		log.Fatalf("Unknown store %q", *store)
+	}
+
+	if *purgeRetention > 0 {
+		go purgeDeleted(repo, *purgeRetention, *purgeInterval)
+	}
+
+	relayDone := make(chan struct{})
+	if *outboxPublisher != "none" {
+		publisher, err := outbox.NewPublisher(*outboxPublisher)
+		if err != nil {
+			log.Fatalf("Failed to create outbox publisher: %v", err)
+		}
+		relay := outbox.NewRelay(repo, publisher, outbox.DefaultRelayConfig)
+		go func() {
+			defer close(relayDone)
+			if err := relay.Run(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Outbox relay stopped: %v", err)
+			}
+		}()
+	} else {
+		close(relayDone)
+	}
+
+	var m mailer.Mailer
+	var verifier *verification.Verifier
+	if *mailerSpec != "none" {
+		var err error
+		if m, err = mailer.New(*mailerSpec); err != nil {
+			log.Fatalf("Failed to create mailer: %v", err)
+		}
+		key := []byte(*verificationKey)
+		if len(key) == 0 {
+			log.Printf("No -verification-key set; verification tokens will not survive restarts")
+			key = make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				log.Fatalf("Failed to generate verification key: %v", err)
+			}
+		}
+		verifier = verification.New(repo, m, verification.Config{Key: key, TTL: *verificationTTL, URL: *verificationURL})
+	} else {
+		log.Printf("No -mailer set; email verification and password reset are disabled")
 	}
-	defer db.Close()
 
 	// Create gRPC server
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
-	s := grpc.NewServer()
-	pb.RegisterUserServiceServer(s, &server{})
+	params := password.DefaultParams
+	params.Memory = uint32(*argon2Memory)
+	params.Iterations = uint32(*argon2Time)
+	params.Parallelism = uint8(*argon2Threads)
+	hasher := password.NewHasher(params)
+	upgradeLegacyPasswords(repo, hasher)
+	var authenticator *auth.Authenticator
+	if *jwtKey != "" {
+		key, err := auth.LoadSigningKey(*jwtKey)
+		if err != nil {
+			log.Fatalf("Failed to load JWT signing key: %v", err)
+		}
+		authenticator, err = auth.New(repo, hasher, key, auth.Config{
+			Issuer:     *jwtIssuer,
+			Audience:   *jwtAudience,
+			AccessTTL:  *jwtAccessTTL,
+			RefreshTTL: *jwtRefreshTTL,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create authenticator: %v", err)
+		}
+		log.Printf("Signing access tokens with %s key %s", key.Method.Alg(), key.Id)
+	}
+	var resetter *passwordreset.Resetter
+	if m != nil {
+		resetter = passwordreset.New(repo, m, hasher, passwordreset.Config{TTL: *resetTTL, URL: *resetURL})
+	}
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Failed to parse -trusted-proxies: %v", err)
+	}
+	srv := &server{
+		repo:            repo,
+		hasher:          hasher,
+		verifier:        verifier,
+		resetter:        resetter,
+		resetsPerEmail:  ratelimit.New(3, time.Hour),
+		resetsPerClient: ratelimit.New(10, time.Minute),
+		auth:            authenticator,
+		loginsPerEmail:  ratelimit.New(10, 15*time.Minute),
+		loginsPerClient: ratelimit.New(30, time.Minute),
+		apiKeys:         apikey.New(repo),
+		trustedProxies:  proxies,
+	}
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			audit.UnaryServerInterceptor(srv.fromTrustedProxy),
+			grpcerr.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			audit.StreamServerInterceptor(srv.fromTrustedProxy),
+			grpcerr.StreamServerInterceptor(),
+		),
+	)
+	pb.RegisterUserServiceServer(s, srv)
+
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		// Watch streams only end when their client goes away, so don't
+		// wait for them forever.
+		time.AfterFunc(shutdownTimeout, s.Stop)
+		s.GracefulStop()
+	}()
 
 	log.Printf("gRPC server listening on port %s", port)
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	<-relayDone
+}
+
+// upgradeLegacyPasswords hashes passwords stored in plaintext before
+// passwords were hashed, so those users can log in and the plaintext no
+// longer sits in the database.
+func upgradeLegacyPasswords(repo repository.UserRepository, hasher *password.Hasher) {
+	n, err := repo.UpgradePasswords(context.Background(), password.IsLegacy, hasher.Hash)
+	if err != nil {
+		log.Fatalf("Failed to hash legacy plaintext passwords: %v", err)
+	}
+	if n > 0 {
+		log.Printf("Hashed %d legacy plaintext passwords", n)
+	}
+}
+
+// purgeDeleted permanently removes users that have been soft-deleted for
+// longer than retention, checking every interval.
+func purgeDeleted(repo repository.UserRepository, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := repo.PurgeDeleted(context.Background(), time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Failed to purge deleted users: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d deleted users", n)
+		}
+		<-ticker.C
+	}
+}
+
+// runMigrate implements the "migrate up|down|status" subcommand.
+func runMigrate(args []string) {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		log.Fatalf("Usage: grpc-server migrate up|down|status")
+	}
+	db, err := sqlx.Connect(driverName, dataSourceName)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		migrateUp(db)
+	case "down":
+		m := newMigrator(db)
+		rolledBack, err := m.Down(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to roll back migration: %v", err)
+		}
+		if rolledBack == nil {
+			log.Printf("No migration to roll back")
+			return
+		}
+		log.Printf("Rolled back migration %d_%s", rolledBack.Version, rolledBack.Name)
+	case "status":
+		m := newMigrator(db)
+		statuses, err := m.Status(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+	}
+}
+
+// runJWKS prints the JSON Web Key Set that verifies access tokens signed
+// with the -jwt-key key, for the gateway's -jwks flag.
+func runJWKS(path string) {
+	if path == "" {
+		log.Fatalf("Usage: grpc-server -jwt-key <file> jwks")
+	}
+	key, err := auth.LoadSigningKey(path)
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing key: %v", err)
+	}
+	set, err := auth.JWKS(key)
+	if err != nil {
+		log.Fatalf("Failed to encode JWKS: %v", err)
+	}
+	fmt.Println(string(set))
+}
+
+func migrateUp(db *sqlx.DB) {
+	applied, err := newMigrator(db).Up(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to apply migrations: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %d_%s", m.Version, m.Name)
+	}
+}
+
+func newMigrator(db *sqlx.DB) *migrate.Migrator {
+	m, err := migrate.New(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	return m
 }
 
 func initTracer() {
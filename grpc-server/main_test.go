@@ -0,0 +1,735 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"grpc-server/internal/grpcerr"
+	"grpc-server/internal/mailer"
+	"grpc-server/internal/model"
+	"grpc-server/internal/password"
+	"grpc-server/internal/passwordreset"
+	"grpc-server/internal/ratelimit"
+	"grpc-server/internal/repository"
+	pb "grpc-server/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// newTestServer returns a server backed by an empty in-memory repository,
+// with cheap password hashing and no mailer.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	repo := repository.NewMemoryUserRepository()
+	return &server{
+		repo:           repo,
+		hasher:         password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}),
+		loginsPerEmail: ratelimit.New(10, 15*time.Minute),
+	}
+}
+
+// code returns the gRPC code clients would see for err.
+func code(err error) codes.Code {
+	return status.Code(grpcerr.FromError(err))
+}
+
+func createUser(t *testing.T, s *server, name, email string) *pb.User {
+	t.Helper()
+	resp, err := s.CreateUser(context.Background(), &pb.UserRequest{Name: name, Email: email, Password: "secret"})
+	if err != nil {
+		t.Fatalf("CreateUser(%q) error = %v", email, err)
+	}
+	return resp.User
+}
+
+func TestCreateAndGetUser(t *testing.T) {
+	s := newTestServer(t)
+	created := createUser(t, s, "John", " John@Example.COM ")
+
+	got, err := s.GetUser(context.Background(), &pb.UserID{Id: created.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := got.User
+	if u.Name != "John" || u.Email != "John@example.com" || u.Status != "active" || u.Version != 1 {
+		t.Errorf("GetUser() = %+v", u)
+	}
+	if u.Password != "" {
+		t.Errorf("GetUser() returned the password hash %q", u.Password)
+	}
+	stored, _ := s.repo.Get(context.Background(), created.Id)
+	if ok, err := s.hasher.Verify("secret", stored.Password); !ok || err != nil {
+		t.Errorf("stored password %q does not verify: %v", stored.Password, err)
+	}
+}
+
+func TestCreateUserErrors(t *testing.T) {
+	s := newTestServer(t)
+	createUser(t, s, "John", "john@example.com")
+
+	tests := []struct {
+		name string
+		req  *pb.UserRequest
+		want codes.Code
+	}{
+		{"empty password", &pb.UserRequest{Name: "Jane", Email: "jane@example.com"}, codes.InvalidArgument},
+		{"email taken regardless of case", &pb.UserRequest{Name: "Jane", Email: "JOHN@example.com", Password: "x"}, codes.AlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.CreateUser(context.Background(), tt.req)
+			if got := code(err); got != tt.want {
+				t.Errorf("CreateUser() code = %v, want %v (err %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     func(id int64) *pb.User
+		want    codes.Code
+		wantErr bool
+	}{
+		{"full update", func(id int64) *pb.User {
+			return &pb.User{Id: id, Name: "Johnny", Email: "johnny@example.com", Status: "disabled"}
+		}, codes.OK, false},
+		{"matching version", func(id int64) *pb.User {
+			return &pb.User{Id: id, Name: "Johnny", Email: "johnny@example.com", Version: 1}
+		}, codes.OK, false},
+		{"stale version", func(id int64) *pb.User {
+			return &pb.User{Id: id, Name: "Johnny", Email: "johnny@example.com", Version: 7}
+		}, codes.FailedPrecondition, true},
+		{"invalid status", func(id int64) *pb.User {
+			return &pb.User{Id: id, Name: "Johnny", Email: "johnny@example.com", Status: "banned"}
+		}, codes.InvalidArgument, true},
+		{"missing user", func(id int64) *pb.User {
+			return &pb.User{Id: id + 100, Name: "Johnny", Email: "johnny@example.com"}
+		}, codes.NotFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			created := createUser(t, s, "John", "john@example.com")
+			resp, err := s.UpdateUser(context.Background(), tt.req(created.Id))
+			if got := code(err); got != tt.want {
+				t.Fatalf("UpdateUser() code = %v, want %v (err %v)", got, tt.want, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if resp.User.Name != "Johnny" || resp.User.Email != "johnny@example.com" || resp.User.Version != 2 {
+				t.Errorf("UpdateUser() = %+v", resp.User)
+			}
+			stored, _ := s.repo.Get(context.Background(), created.Id)
+			if ok, _ := s.hasher.Verify("secret", stored.Password); !ok {
+				t.Error("an update without a password replaced the stored password")
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		user  *pb.User
+		paths []string
+		want  codes.Code
+		check func(t *testing.T, u *pb.User)
+	}{
+		{"only masked fields change", &pb.User{Name: "Johnny", Email: "ignored@example.com"}, []string{"name"}, codes.OK, func(t *testing.T, u *pb.User) {
+			if u.Name != "Johnny" || u.Email != "john@example.com" {
+				t.Errorf("PatchUser() = %+v", u)
+			}
+		}},
+		{"email is normalized", &pb.User{Email: " Johnny@EXAMPLE.com"}, []string{"email"}, codes.OK, func(t *testing.T, u *pb.User) {
+			if u.Email != "Johnny@example.com" {
+				t.Errorf("PatchUser() email = %q", u.Email)
+			}
+		}},
+		{"masked empty name", &pb.User{}, []string{"name"}, codes.OK, func(t *testing.T, u *pb.User) {
+			if u.Name != "" {
+				t.Errorf("PatchUser() name = %q, want empty", u.Name)
+			}
+		}},
+		{"matching version", &pb.User{Status: "disabled", Version: 1}, []string{"status"}, codes.OK, func(t *testing.T, u *pb.User) {
+			if u.Status != "disabled" || u.Version != 2 {
+				t.Errorf("PatchUser() = %+v", u)
+			}
+		}},
+		{"stale version", &pb.User{Name: "Johnny", Version: 3}, []string{"name"}, codes.FailedPrecondition, nil},
+		{"empty mask", &pb.User{Name: "Johnny"}, nil, codes.InvalidArgument, nil},
+		{"unknown field", &pb.User{}, []string{"id"}, codes.InvalidArgument, nil},
+		{"invalid status", &pb.User{Status: "banned"}, []string{"status"}, codes.InvalidArgument, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			created := createUser(t, s, "John", "john@example.com")
+			tt.user.Id = created.Id
+			resp, err := s.PatchUser(context.Background(), &pb.PatchUserRequest{
+				User:       tt.user,
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: tt.paths},
+			})
+			if got := code(err); got != tt.want {
+				t.Fatalf("PatchUser() code = %v, want %v (err %v)", got, tt.want, err)
+			}
+			if tt.check != nil {
+				tt.check(t, resp.User)
+			}
+		})
+	}
+}
+
+func TestCurrentPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		want    codes.Code
+	}{
+		{"not sent", "", codes.OK},
+		{"matching", "secret", codes.OK},
+		{"wrong", "guess", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			created := createUser(t, s, "John", "john@example.com")
+			ctx := context.Background()
+
+			_, err := s.UpdateUser(ctx, &pb.User{Id: created.Id, Name: "John", Email: "john@example.com", Password: "new", CurrentPassword: tt.current})
+			if got := code(err); got != tt.want {
+				t.Errorf("UpdateUser() code = %v, want %v (err %v)", got, tt.want, err)
+			}
+			_, err = s.PatchUser(ctx, &pb.PatchUserRequest{
+				User:       &pb.User{Id: created.Id, Password: "newer", CurrentPassword: tt.current},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"password"}},
+			})
+			if tt.current == "secret" {
+				// The update above changed the password.
+				tt.want = codes.InvalidArgument
+			}
+			if got := code(err); got != tt.want {
+				t.Errorf("PatchUser() code = %v, want %v (err %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	s := newTestServer(t)
+	created := createUser(t, s, "John", "john@example.com")
+	ctx := context.Background()
+
+	if _, err := s.DeleteUser(ctx, &pb.UserID{Id: created.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(ctx, &pb.UserID{Id: created.Id}); code(err) != codes.NotFound {
+		t.Errorf("GetUser() after delete error = %v, want NotFound", err)
+	}
+	if _, err := s.DeleteUser(ctx, &pb.UserID{Id: created.Id}); code(err) != codes.NotFound {
+		t.Errorf("second DeleteUser() error = %v, want NotFound", err)
+	}
+	restored, err := s.RestoreUser(ctx, &pb.UserID{Id: created.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The delete and the restore each bump the version.
+	if want := created.Version + 2; restored.User.Version != want {
+		t.Errorf("RestoreUser() version = %d, want %d", restored.User.Version, want)
+	}
+}
+
+func TestUpgradeLegacyPasswords(t *testing.T) {
+	s := newTestServer(t)
+	created := createUser(t, s, "John", "john@example.com")
+	ctx := context.Background()
+	if _, err := s.repo.RecordLogin(ctx, created.Id, "plaintext"); err != nil {
+		t.Fatal(err)
+	}
+
+	upgradeLegacyPasswords(s.repo, s.hasher)
+
+	stored, _ := s.repo.Get(ctx, created.Id)
+	if ok, err := s.hasher.Verify("plaintext", stored.Password); !ok || err != nil {
+		t.Errorf("legacy password was not hashed: %q, %v", stored.Password, err)
+	}
+}
+
+func TestPurgeUserOnlyFromTrustedProxies(t *testing.T) {
+	s := newTestServer(t)
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.trustedProxies = proxies
+	user := createUser(t, s, "John", "john@example.com")
+	from := func(addr string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 4242}})
+	}
+
+	if _, err := s.PurgeUser(from("198.51.100.1"), &pb.UserID{Id: user.Id}); code(err) != codes.PermissionDenied {
+		t.Errorf("PurgeUser() from an untrusted peer error = %v, want PermissionDenied", err)
+	}
+	if _, err := s.PurgeUser(context.Background(), &pb.UserID{Id: user.Id}); code(err) != codes.PermissionDenied {
+		t.Errorf("PurgeUser() from an unknown peer error = %v, want PermissionDenied", err)
+	}
+	if _, err := s.GetUser(context.Background(), &pb.UserID{Id: user.Id}); err != nil {
+		t.Fatalf("user is gone after refused purges: %v", err)
+	}
+	if _, err := s.PurgeUser(from("10.1.2.3"), &pb.UserID{Id: user.Id}); err != nil {
+		t.Fatalf("PurgeUser() from the gateway error = %v", err)
+	}
+	if _, err := s.GetUser(context.Background(), &pb.UserID{Id: user.Id}); code(err) != codes.NotFound {
+		t.Errorf("GetUser() after purge error = %v, want NotFound", err)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{trustedProxies: proxies}
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded string
+		want      string
+	}{
+		{"trusted proxy", "10.1.2.3", "203.0.113.7", "203.0.113.7"},
+		{"trusted IPv6 proxy", "::1", "203.0.113.7", "203.0.113.7"},
+		{"trusted proxy without forwarding", "10.1.2.3", "", "10.1.2.3"},
+		{"untrusted peer", "198.51.100.1", "203.0.113.7", "198.51.100.1"},
+		{"untrusted peer without forwarding", "198.51.100.1", "", "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 4242}})
+			if tt.forwarded != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", tt.forwarded))
+			}
+			if got := s.clientAddr(ctx); got != tt.want {
+				t.Errorf("clientAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := parseTrustedProxies("127.0.0.1,gateway"); err == nil {
+		t.Error("parseTrustedProxies() accepted a host name")
+	}
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	createUser(t, s, "John", "john@example.com")
+	if _, err := s.RequestPasswordReset(ctx, &pb.RequestPasswordResetRequest{Email: "john@example.com"}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("RequestPasswordReset() without a mailer: error = %v, want Unimplemented", err)
+	}
+	if _, err := s.ResetPassword(ctx, &pb.ResetPasswordRequest{Token: "token", NewPassword: "secret"}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ResetPassword() without a mailer: error = %v, want Unimplemented", err)
+	}
+
+	s.resetter = passwordreset.New(s.repo, discardMailer{}, s.hasher, passwordreset.Config{TTL: passwordreset.DefaultTTL})
+	s.resetsPerEmail = ratelimit.New(1, time.Hour)
+	s.resetsPerClient = ratelimit.New(10, time.Minute)
+	// Known and unknown emails get the same answer.
+	for _, email := range []string{"john@example.com", "nobody@example.com"} {
+		resp, err := s.RequestPasswordReset(ctx, &pb.RequestPasswordResetRequest{Email: email})
+		if err != nil || !proto.Equal(resp, &pb.RequestPasswordResetResponse{}) {
+			t.Errorf("RequestPasswordReset(%q) = %v, %v", email, resp, err)
+		}
+	}
+	for _, email := range []string{"JOHN@example.com", "nobody@EXAMPLE.com"} {
+		if _, err := s.RequestPasswordReset(ctx, &pb.RequestPasswordResetRequest{Email: email}); code(err) != codes.ResourceExhausted {
+			t.Errorf("RequestPasswordReset(%q) over the limit: error = %v, want ResourceExhausted", email, err)
+		}
+	}
+}
+
+type discardMailer struct{}
+
+func (discardMailer) Send(context.Context, mailer.Message) error {
+	return nil
+}
+
+// watchStream is a WatchUsers stream that hands sent events to a channel and
+// calls sent, if set, after each one.
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *pb.UserEvent
+	sent   func(*pb.UserEvent)
+}
+
+func (w *watchStream) Context() context.Context {
+	return w.ctx
+}
+
+func (w *watchStream) Send(event *pb.UserEvent) error {
+	w.events <- event
+	if w.sent != nil {
+		w.sent(event)
+	}
+	return nil
+}
+
+// watch starts WatchUsers from token and returns its stream.
+func watch(t *testing.T, s *server, token string, sent func(*pb.UserEvent)) *watchStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watchStream{ctx: ctx, events: make(chan *pb.UserEvent, 100), sent: sent}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WatchUsers(&pb.WatchUsersRequest{PositionToken: token}, w)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; status.Code(err) != codes.Canceled {
+			t.Errorf("WatchUsers() error = %v, want Canceled", err)
+		}
+	})
+	return w
+}
+
+// next returns the next event sent on the stream. WatchUsers only polls
+// every watchPollInterval, so events must arrive by notification.
+func (w *watchStream) next(t *testing.T) *pb.UserEvent {
+	t.Helper()
+	select {
+	case event := <-w.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was sent")
+		return nil
+	}
+}
+
+// startedRepository closes started once LatestEventId was called.
+type startedRepository struct {
+	repository.UserRepository
+	started chan struct{}
+}
+
+func (r startedRepository) LatestEventId(ctx context.Context) (int64, error) {
+	defer close(r.started)
+	return r.UserRepository.LatestEventId(ctx)
+}
+
+func TestWatchUsers(t *testing.T) {
+	s := newTestServer(t)
+	john := createUser(t, s, "John", "john@example.com")
+	jane := createUser(t, s, "Jane", "jane@example.com")
+
+	// Without a token the stream starts with the next change after it
+	// read the latest event.
+	started := make(chan struct{})
+	s.repo = startedRepository{s.repo, started}
+	live := watch(t, s, "", nil)
+	<-started
+	bob := createUser(t, s, "Bob", "bob@example.com")
+	event := live.next(t)
+	if event.Type != "user.created" || event.UserId != bob.Id || event.User.Email != "bob@example.com" {
+		t.Errorf("first event = %v, want bob's creation", event)
+	}
+
+	// Resuming after john's creation replays the changes made since.
+	resumed := watch(t, s, repository.NewWatchCursor(1).Encode(), nil)
+	for _, want := range []int64{jane.Id, bob.Id} {
+		if event := resumed.next(t); event.UserId != want {
+			t.Errorf("replayed event for user %d, want %d", event.UserId, want)
+		}
+	}
+	if _, err := s.DeleteUser(context.Background(), &pb.UserID{Id: john.Id}); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []*watchStream{live, resumed} {
+		if event := w.next(t); event.Type != "user.deleted" || event.UserId != john.Id {
+			t.Errorf("event = %v, want john's deletion", event)
+		}
+	}
+
+	// Position tokens resume each other's streams.
+	from := watch(t, s, event.PositionToken, nil)
+	if event := from.next(t); event.Type != "user.deleted" {
+		t.Errorf("event after bob's creation = %v, want john's deletion", event)
+	}
+}
+
+func TestWatchUsersReplayGap(t *testing.T) {
+	s := newTestServer(t)
+	createUser(t, s, "John", "john@example.com")
+	// A change made while the stream replays comes after the events
+	// already read, and before the stream waits for a notification.
+	var once sync.Once
+	w := watch(t, s, repository.NewWatchCursor(0).Encode(), func(*pb.UserEvent) {
+		once.Do(func() { createUser(t, s, "Jane", "jane@example.com") })
+	})
+	for _, want := range []string{"john@example.com", "jane@example.com"} {
+		if event := w.next(t); event.User.GetEmail() != want {
+			t.Errorf("event = %v, want the creation of %s", event, want)
+		}
+	}
+}
+
+func TestWatchUsersInvalidToken(t *testing.T) {
+	s := newTestServer(t)
+	w := &watchStream{ctx: context.Background()}
+	for _, token := range []string{"garbage", repository.NewAuditCursor(model.AuditEvent{Id: 1, UserId: 1}).Encode()} {
+		if err := s.WatchUsers(&pb.WatchUsersRequest{PositionToken: token}, w); code(err) != codes.InvalidArgument {
+			t.Errorf("WatchUsers(%q) error = %v, want InvalidArgument", token, err)
+		}
+	}
+}
+
+func TestBatchCreateUsers(t *testing.T) {
+	s := newTestServer(t)
+	createUser(t, s, "John", "john@example.com")
+	ctx := context.Background()
+
+	// Rows failing before the repository is reached are left out of the
+	// batch, and the results of the others still line up with the request.
+	resp, err := s.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Users: []*pb.UserRequest{
+		{Name: "Jane", Email: "jane@example.com", Password: "secret"},
+		{Name: "Nopass", Email: "nopass@example.com"},
+		{Name: "John", Email: "JOHN@example.com", Password: "secret"},
+		{Name: "Bob", Email: "bob@EXAMPLE.com", Password: "secret"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := resp.Results
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want 4", len(results))
+	}
+	if results[0].User.GetEmail() != "jane@example.com" || results[3].User.GetEmail() != "bob@example.com" {
+		t.Errorf("created users = %v, %v", results[0].User, results[3].User)
+	}
+	if e := results[1].Error; e.GetReason() != grpcerr.ReasonInvalidArgument || codes.Code(e.GetCode()) != codes.InvalidArgument {
+		t.Errorf("result 1 error = %v, want InvalidArgument", e)
+	}
+	if e := results[2].Error; e.GetReason() != grpcerr.ReasonEmailExists || codes.Code(e.GetCode()) != codes.AlreadyExists {
+		t.Errorf("result 2 error = %v, want AlreadyExists", e)
+	}
+}
+
+func TestBatchCreateUsersAtomic(t *testing.T) {
+	tests := []struct {
+		name        string
+		users       []*pb.UserRequest
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		{"invalid row", []*pb.UserRequest{
+			{Name: "Jane", Email: "jane@example.com", Password: "secret"},
+			{Name: "Nopass", Email: "nopass@example.com"},
+		}, codes.InvalidArgument, "item 1: invalid password: must not be empty"},
+		{"taken email", []*pb.UserRequest{
+			{Name: "Jane", Email: "jane@example.com", Password: "secret"},
+			{Name: "Bob", Email: "bob@example.com", Password: "secret"},
+			{Name: "John", Email: "john@EXAMPLE.com", Password: "secret"},
+		}, codes.AlreadyExists, "item 2: email is already used by another user"},
+		{"email repeated in the batch", []*pb.UserRequest{
+			{Name: "Jane", Email: "jane@example.com", Password: "secret"},
+			{Name: "Jane", Email: "JANE@example.com", Password: "secret"},
+		}, codes.AlreadyExists, "item 1: email is already used by another user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			createUser(t, s, "John", "john@example.com")
+			ctx := context.Background()
+			_, err := s.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Users: tt.users, Atomic: true})
+			st := status.Convert(grpcerr.FromError(err))
+			if st.Code() != tt.wantCode || st.Message() != tt.wantMessage {
+				t.Errorf("BatchCreateUsers() error = %v, want %v %q", err, tt.wantCode, tt.wantMessage)
+			}
+			if _, err := s.repo.GetByEmail(ctx, "jane@example.com"); code(err) != codes.NotFound {
+				t.Errorf("failed atomic batch created jane: error = %v", err)
+			}
+		})
+	}
+
+	s := newTestServer(t)
+	resp, err := s.BatchCreateUsers(context.Background(), &pb.BatchCreateUsersRequest{Atomic: true, Users: []*pb.UserRequest{
+		{Name: "Jane", Email: "jane@example.com", Password: "secret"},
+		{Name: "Bob", Email: "bob@example.com", Password: "secret"},
+	}})
+	if err != nil || len(resp.Results) != 2 || resp.Results[1].User.GetEmail() != "bob@example.com" {
+		t.Errorf("BatchCreateUsers() = %v, %v", resp, err)
+	}
+}
+
+// exportStream collects the messages sent by ExportUsers.
+type exportStream struct {
+	grpc.ServerStream
+	sent []*pb.ExportUsersResponse
+}
+
+func (e *exportStream) Context() context.Context {
+	return context.Background()
+}
+
+func (e *exportStream) Send(resp *pb.ExportUsersResponse) error {
+	e.sent = append(e.sent, resp)
+	return nil
+}
+
+func TestExportUsers(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	const total = 2*exportChunkSize + 3
+	for i := 0; i < total; i++ {
+		err := s.repo.Create(ctx, &model.User{Name: "User", Email: fmt.Sprintf("user%d@example.com", i), Password: "hash"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []int64{2, exportChunkSize + 1} {
+		if err := s.repo.Delete(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream := &exportStream{}
+	if err := s.ExportUsers(&pb.ExportUsersRequest{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	var last int64
+	for _, resp := range stream.sent {
+		sizes = append(sizes, len(resp.Users))
+		for _, u := range resp.Users {
+			if u.Id <= last {
+				t.Fatalf("user %d exported after %d", u.Id, last)
+			}
+			if u.Id == 2 || u.Id == exportChunkSize+1 {
+				t.Errorf("deleted user %d was exported", u.Id)
+			}
+			last = u.Id
+		}
+	}
+	// The deleted users shorten the last message only.
+	if want := []int{exportChunkSize, exportChunkSize, 1}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("message sizes = %v, want %v", sizes, want)
+	}
+
+	empty := &exportStream{}
+	if err := newTestServer(t).ExportUsers(&pb.ExportUsersRequest{}, empty); err != nil || len(empty.sent) != 0 {
+		t.Errorf("ExportUsers() of no users sent %v, error %v", empty.sent, err)
+	}
+}
+
+// listAll pages through ListUsers and returns the ids of the users listed.
+func listAll(t *testing.T, s *server, req *pb.ListUsersRequest) []int64 {
+	t.Helper()
+	var ids []int64
+	for page := 0; ; page++ {
+		if page > 10 {
+			t.Fatal("ListUsers() does not stop paging")
+		}
+		resp, err := s.ListUsers(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Users) == 0 {
+			t.Fatalf("page %d is empty", page)
+		}
+		for _, u := range resp.Users {
+			ids = append(ids, u.Id)
+		}
+		if resp.NextPageToken == "" {
+			return ids
+		}
+		req = proto.Clone(req).(*pb.ListUsersRequest)
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+func TestListUsersPaging(t *testing.T) {
+	s := newTestServer(t)
+	// Users 1 to 6; several share a name, so the id breaks ties.
+	for i, name := range []string{"Sam", "Alex", "Sam", "Sam", "Alex", "Kim"} {
+		createUser(t, s, name, fmt.Sprintf("user%d@example.com", i+1))
+	}
+	tests := []struct {
+		orderBy string
+		want    []int64
+	}{
+		{"", []int64{1, 2, 3, 4, 5, 6}},
+		{"name", []int64{2, 5, 6, 1, 3, 4}},
+		{"name desc", []int64{4, 3, 1, 6, 5, 2}},
+		{"email desc", []int64{6, 5, 4, 3, 2, 1}},
+		{"created_at", []int64{1, 2, 3, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.orderBy, func(t *testing.T) {
+			// Six users in pages of two: the third page is the last, with
+			// no token pointing at an empty fourth page.
+			got := listAll(t, s, &pb.ListUsersRequest{PageSize: 2, OrderBy: tt.orderBy})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	filtered := listAll(t, s, &pb.ListUsersRequest{PageSize: 1, OrderBy: "name", Filter: &pb.UserFilter{NamePrefix: "Sa"}})
+	if want := []int64{1, 3, 4}; !reflect.DeepEqual(filtered, want) {
+		t.Errorf("filtered listing = %v, want %v", filtered, want)
+	}
+}
+
+func TestListUsersInvalidToken(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		createUser(t, s, "Sam", fmt.Sprintf("user%d@example.com", i))
+	}
+	ctx := context.Background()
+	resp, err := s.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1, OrderBy: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := resp.NextPageToken
+	corrupted := []byte(token)
+	corrupted[len(corrupted)/2] ^= 1
+	tampered := repository.Cursor{Key: "Sam", Id: 1, Query: "0123456789abcdef"}.Encode()
+
+	tests := []struct {
+		name string
+		req  *pb.ListUsersRequest
+	}{
+		{"garbage", &pb.ListUsersRequest{PageToken: "garbage", OrderBy: "name"}},
+		{"corrupted", &pb.ListUsersRequest{PageToken: string(corrupted), OrderBy: "name"}},
+		{"tampered", &pb.ListUsersRequest{PageToken: tampered, OrderBy: "name"}},
+		{"other order", &pb.ListUsersRequest{PageToken: token, OrderBy: "email"}},
+		{"other direction", &pb.ListUsersRequest{PageToken: token, OrderBy: "name desc"}},
+		{"other filter", &pb.ListUsersRequest{PageToken: token, OrderBy: "name", Filter: &pb.UserFilter{Status: model.StatusActive}}},
+		{"audit token", &pb.ListUsersRequest{PageToken: repository.NewAuditCursor(model.AuditEvent{Id: 1, UserId: 1}).Encode()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.ListUsers(ctx, tt.req)
+			if code(err) != codes.InvalidArgument {
+				t.Fatalf("ListUsers() error = %v, want InvalidArgument", err)
+			}
+			if reason := grpcerr.Reason(status.Convert(grpcerr.FromError(err))); reason != grpcerr.ReasonInvalidArgument {
+				t.Errorf("reason = %q", reason)
+			}
+		})
+	}
+}